@@ -6,6 +6,7 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"strings"
 
 	"github.com/osf4/socks5/internal/errio"
 )
@@ -23,28 +24,61 @@ func ParseNetAddr(addr net.Addr) *Addr {
 	return ParseAddr(addr.Network(), addr.String())
 }
 
-// Parse Addr from a string
+// Parse Addr from a string.
+// nil is returned, if the address is invalid (see ParseAddrErr)
 func ParseAddr(network, addr string) *Addr {
+	a, _ := ParseAddrErr(network, addr)
+	return a
+}
+
+// Parse Addr from a string.
+//
+// Error is returned, if the address has no port, the port is invalid or the domain is longer than 255 bytes
+func ParseAddrErr(network, addr string) (*Addr, error) {
 	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		return nil
+		return nil, ErrProtocol.Wrap(err, "unable to parse the address (%v)", addr)
 	}
 
 	if host == "" {
 		host = "0.0.0.0"
 	}
 
+	host, zone := splitZone(host)
+
 	portUint, err := strconv.ParseUint(port, 10, 16)
 	if err != nil {
-		return nil
+		return nil, ErrProtocol.Wrap(err, "invalid port of the address (%v)", addr)
+	}
+
+	atyp := parseAtyp(host)
+	if atyp == AddrDomain && len(host) > maxDomainLength {
+		return nil, ErrProtocol.New("the domain of the address is longer than %v bytes (%v)", maxDomainLength, len(host))
 	}
 
 	return &Addr{
 		network: network,
-		Atyp:    parseAtyp(host),
+		Atyp:    atyp,
 		Host:    host,
+		Zone:    zone,
 		Port:    uint16(portUint),
+	}, nil
+}
+
+// Split the scoped IPv6 address into the address and the zone ("fe80::1%eth0" -> "fe80::1", "eth0").
+// Other hosts are returned as is
+func splitZone(host string) (string, string) {
+	i := strings.LastIndexByte(host, '%')
+	if i < 0 {
+		return host, ""
 	}
+
+	ip := net.ParseIP(host[:i])
+	if ip == nil || ip.To4() != nil {
+		return host, ""
+	}
+
+	return host[:i], host[i+1:]
 }
 
 func parseAtyp(host string) addrType {
@@ -62,6 +96,8 @@ func parseAtyp(host string) addrType {
 }
 
 var (
+	// NilAddr represents the address 0.0.0.0:0.
+	// It is shared between all the users, so NilAddr.Clone() must be used to get a modifiable copy
 	NilAddr = &Addr{
 		network: "tcp",
 
@@ -77,10 +113,15 @@ type Addr struct {
 
 	Atyp addrType // ATYP field
 	Host string   // string presentation of the host ("127.0.0.1", "google.com")
+	Zone string   // zone of the scoped IPv6 address ("eth0"). It is not sent in requests and replies
 	Port uint16   // PORT field
 }
 
 func (a *Addr) Write(wr io.Writer) error {
+	if a.Atyp == AddrDomain && len(a.Host) > maxDomainLength {
+		return ErrProtocol.New("the domain is longer than %v bytes (%v)", maxDomainLength, len(a.Host))
+	}
+
 	w := bufio.NewWriterSize(wr, a.Len())
 
 	w.WriteByte(byte(a.Atyp))
@@ -155,7 +196,61 @@ func (a *Addr) Network() string {
 
 func (a *Addr) String() string {
 	stringPort := strconv.FormatUint(uint64(a.Port), 10)
-	return net.JoinHostPort(a.Host, stringPort)
+
+	host := a.Host
+	if a.Zone != "" {
+		host += "%" + a.Zone
+	}
+
+	return net.JoinHostPort(host, stringPort)
+}
+
+// Implement encoding.TextMarshaler ("google.com:80", "[::1]:1080")
+func (a *Addr) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// Implement encoding.TextUnmarshaler.
+//
+// The network of the address is kept, if it is set. Otherwise "tcp" is used
+func (a *Addr) UnmarshalText(text []byte) error {
+	network := a.network
+	if network == "" {
+		network = "tcp"
+	}
+
+	addr, err := ParseAddrErr(network, string(text))
+	if err != nil {
+		return err
+	}
+
+	*a = *addr
+	return nil
+}
+
+// True, if a and other represent the same address.
+//
+// IP addresses are compared by value ("::1" == "0:0:0:0:0:0:0:1"), domains are compared case-insensitively
+func (a *Addr) Equal(other *Addr) bool {
+	if a == nil || other == nil {
+		return a == other
+	}
+
+	if a.Atyp != other.Atyp || a.Port != other.Port || a.Zone != other.Zone {
+		return false
+	}
+
+	if a.Atyp == AddrDomain {
+		return strings.EqualFold(a.Host, other.Host)
+	}
+
+	return net.ParseIP(a.Host).Equal(net.ParseIP(other.Host))
+}
+
+// Return a copy of the address
+func (a *Addr) Clone() *Addr {
+	clone := *a
+	return &clone
 }
 
 func (a *Addr) Len() int {
@@ -172,6 +267,7 @@ func (a *Addr) UDP() net.Addr {
 	return &net.UDPAddr{
 		IP:   net.ParseIP(a.Host),
 		Port: int(a.Port),
+		Zone: a.Zone,
 	}
 }
 
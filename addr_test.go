@@ -0,0 +1,225 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/joomcode/errorx"
+)
+
+func TestAddrEqual(t *testing.T) {
+	tests := []struct {
+		a, b  *Addr
+		equal bool
+	}{
+		{&Addr{Atyp: AddrIPv6, Host: "::1", Port: 80}, &Addr{Atyp: AddrIPv6, Host: "0:0:0:0:0:0:0:1", Port: 80}, true},
+		{&Addr{Atyp: AddrIPv6, Host: "2001:db8::1", Port: 80}, &Addr{Atyp: AddrIPv6, Host: "2001:0DB8:0000::0001", Port: 80}, true},
+		{ParseAddr("tcp", "192.0.2.1:80"), ParseAddr("tcp", "192.0.2.1:80"), true},
+		{ParseAddr("tcp", "192.0.2.1:80"), ParseAddr("tcp", "192.0.2.1:81"), false},
+		{ParseAddr("tcp", "192.0.2.1:80"), ParseAddr("tcp", "192.0.2.2:80"), false},
+		{ParseAddr("tcp", "Example.COM:80"), ParseAddr("tcp", "example.com:80"), true},
+		{ParseAddr("tcp", "[fe80::1%eth0]:80"), ParseAddr("tcp", "[fe80::1%eth1]:80"), false},
+		{nil, nil, true},
+		{ParseAddr("tcp", "192.0.2.1:80"), nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.a.Equal(tt.b); got != tt.equal {
+			t.Errorf("%v == %v: got %v, want %v", tt.a, tt.b, got, tt.equal)
+		}
+
+		if got := tt.b.Equal(tt.a); got != tt.equal {
+			t.Errorf("%v == %v: got %v, want %v", tt.b, tt.a, got, tt.equal)
+		}
+	}
+}
+
+func TestAddrClone(t *testing.T) {
+	a := ParseAddr("tcp", "192.0.2.1:80")
+
+	clone := a.Clone()
+	if clone == a || !clone.Equal(a) {
+		t.Fatalf("the clone %v of %v", clone, a)
+	}
+
+	clone.Host = "192.0.2.2"
+	clone.Port = 81
+
+	if a.String() != "192.0.2.1:80" {
+		t.Fatalf("the original address is modified by the clone: %v", a)
+	}
+}
+
+func TestAddrUnmarshalText(t *testing.T) {
+	tests := []struct {
+		text string
+		atyp addrType
+		host string
+		port uint16
+	}{
+		{"192.0.2.1:80", AddrIPV4, "192.0.2.1", 80},
+		{"[2001:db8::1]:443", AddrIPv6, "2001:db8::1", 443},
+		{"[fe80::1%eth0]:53", AddrIPv6, "fe80::1", 53},
+		{"google.com:80", AddrDomain, "google.com", 80},
+	}
+
+	for _, tt := range tests {
+		a := &Addr{}
+
+		err := a.UnmarshalText([]byte(tt.text))
+		if err != nil {
+			t.Errorf("%v: %v", tt.text, err)
+			continue
+		}
+
+		if a.Atyp != tt.atyp || a.Host != tt.host || a.Port != tt.port || a.Network() != "tcp" {
+			t.Errorf("%v: unmarshalled %+v", tt.text, a)
+		}
+
+		text, err := a.MarshalText()
+		if err != nil || string(text) != tt.text {
+			t.Errorf("%v: marshalled %q, %v", tt.text, text, err)
+		}
+	}
+}
+
+func TestAddrUnmarshalTextKeepsNetwork(t *testing.T) {
+	a := ParseAddr("udp", "0.0.0.0:0")
+
+	err := a.UnmarshalText([]byte("192.0.2.1:53"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Network() != "udp" {
+		t.Fatalf("the network is %v", a.Network())
+	}
+}
+
+func TestAddrUnmarshalTextInvalid(t *testing.T) {
+	for _, text := range []string{"", "google.com", "192.0.2.1:port", "192.0.2.1:65536"} {
+		if err := (&Addr{}).UnmarshalText([]byte(text)); err == nil {
+			t.Errorf("%q is unmarshalled", text)
+		}
+	}
+}
+
+func TestAddrJSONConfig(t *testing.T) {
+	var config struct {
+		Allow []*Addr `json:"allow"`
+	}
+
+	err := json.Unmarshal([]byte(`{"allow": ["192.0.2.1:80", "[::1]:8080", "example.com:443"]}`), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != `{"allow":["192.0.2.1:80","[::1]:8080","example.com:443"]}` {
+		t.Fatalf("marshalled %s", b)
+	}
+}
+
+func TestAddrDomainTooLong(t *testing.T) {
+	domain := strings.Repeat("a", 300)
+
+	_, err := ParseAddrErr("tcp", domain+":80")
+	if !errorx.IsOfType(err, ErrProtocol) {
+		t.Errorf("ParseAddrErr with the 300-byte domain: %v", err)
+	}
+
+	if a := ParseAddr("tcp", domain+":80"); a != nil {
+		t.Errorf("ParseAddr with the 300-byte domain: %v", a)
+	}
+
+	var b bytes.Buffer
+
+	a := &Addr{Atyp: AddrDomain, Host: domain, Port: 80}
+	if err := a.Write(bufio.NewWriter(&b)); !errorx.IsOfType(err, ErrProtocol) {
+		t.Errorf("Addr.Write with the 300-byte domain: %v", err)
+	}
+
+	err = (&Request{Cmd: CmdConnect, Dst: a}).Write(&b)
+	if !errorx.IsOfType(err, ErrProtocol) || b.Len() != 0 {
+		t.Fatalf("the request with the 300-byte domain is written (%v bytes): %v", b.Len(), err)
+	}
+}
+
+func TestAddrDomainMaxLength(t *testing.T) {
+	domain := strings.Repeat("a", 255)
+
+	a, err := ParseAddrErr("tcp", domain+":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+
+	err = (&Request{Cmd: CmdConnect, Dst: a}).Write(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &Request{}
+	err = req.Read(&b)
+	if err != nil || req.Dst.Host != domain || req.Dst.Port != 80 {
+		t.Fatalf("the request is read as %v: %v", req.Dst, err)
+	}
+}
+
+func TestAddrZoneRoundTrip(t *testing.T) {
+	a := ParseAddr("udp", "[fe80::1%eth0]:80")
+	if a == nil || a.Atyp != AddrIPv6 || a.Host != "fe80::1" || a.Zone != "eth0" || a.Port != 80 {
+		t.Fatalf("the zoned address is parsed as %#v", a)
+	}
+
+	if s := a.String(); s != "[fe80::1%eth0]:80" {
+		t.Errorf("String: %v", s)
+	}
+
+	udp, ok := a.UDP().(*net.UDPAddr)
+	if !ok || !udp.IP.Equal(net.ParseIP("fe80::1")) || udp.Zone != "eth0" || udp.Port != 80 {
+		t.Fatalf("UDP: %#v", a.UDP())
+	}
+
+	if back := ParseNetAddr(udp); !back.Equal(a) {
+		t.Errorf("the UDP address is parsed back as %v", back)
+	}
+
+	if other := ParseAddr("udp", "[fe80::1%eth1]:80"); a.Equal(other) {
+		t.Errorf("%v is equal to %v", a, other)
+	}
+
+	// the zone is local to the host, it is not sent
+	var b bytes.Buffer
+
+	err := (&Request{Cmd: CmdUDP, Dst: a}).Write(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &Request{}
+	err = req.Read(&b)
+	if err != nil || req.Dst.Host != "fe80::1" || req.Dst.Zone != "" {
+		t.Fatalf("the request is read as %#v: %v", req.Dst, err)
+	}
+}
+
+func TestAddrWithoutZone(t *testing.T) {
+	a := ParseAddr("udp", "[fe80::1]:80")
+	if a == nil || a.Zone != "" || a.String() != "[fe80::1]:80" {
+		t.Fatalf("the address is parsed as %#v", a)
+	}
+
+	if udp := a.UDP().(*net.UDPAddr); udp.Zone != "" {
+		t.Errorf("UDP has the zone %q", udp.Zone)
+	}
+}
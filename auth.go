@@ -1,12 +1,34 @@
 package socks5
 
-import "context"
+import (
+	"context"
+	"fmt"
+)
 
 type authMethod byte
 
+func (m authMethod) String() string {
+	switch m {
+	case MethodNotRequired:
+		return "NO AUTHENTICATION REQUIRED"
+
+	case MethodPassword:
+		return "USERNAME/PASSWORD"
+
+	case MethodChallenge:
+		return "CHALLENGE-RESPONSE"
+
+	case MethodNoAcceptable:
+		return "NO ACCEPTABLE METHODS"
+	}
+
+	return fmt.Sprintf("METHOD(%#02x)", byte(m))
+}
+
 const (
 	MethodNotRequired  authMethod = 0x00
 	MethodPassword     authMethod = 0x02
+	MethodChallenge    authMethod = 0x80 // challenge-response authentication (private range)
 	MethodNoAcceptable authMethod = 0xFF
 )
 
@@ -15,6 +37,8 @@ const (
 // NoAuth - no authentication is required.
 //
 // PassAuth - password authentication.
+//
+// ChallengeAuth - challenge-response authentication with a shared secret.
 type Auth interface {
 	Request(ctx context.Context, conn *Conn) error // Send the authentication request to the server
 	Reply(ctx context.Context, conn *Conn) error   // Read the authentication request from the client
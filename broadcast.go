@@ -0,0 +1,70 @@
+package socks5
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const broadcastsTTL = 30 * time.Second // period the directed broadcast addresses of the local networks are cached for
+
+// Directed broadcast addresses of the local networks
+var localBroadcasts = &broadcastCache{}
+
+// broadcastCache caches the directed broadcast addresses of the local IPv4 networks, so the interfaces are not listed for every datagram
+type broadcastCache struct {
+	mu      sync.Mutex
+	addrs   []net.IP
+	updated time.Time
+}
+
+// True, if ip is the directed broadcast address of a local IPv4 network
+func (c *broadcastCache) contains(ip net.IP) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.updated) >= broadcastsTTL {
+		c.addrs = directedBroadcasts()
+		c.updated = time.Now()
+	}
+
+	for _, addr := range c.addrs {
+		if addr.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return the directed broadcast addresses of the local IPv4 networks.
+// Networks /31 and /32 have no broadcast address (RFC 3021)
+func directedBroadcasts() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+
+	var broadcasts []net.IP
+	for _, addr := range addrs {
+		network, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		ip := network.IP.To4()
+		ones, bits := network.Mask.Size()
+		if ip == nil || bits != 8*net.IPv4len || ones >= 31 {
+			continue
+		}
+
+		broadcast := make(net.IP, net.IPv4len)
+		for i := range broadcast {
+			broadcast[i] = ip[i] | ^network.Mask[i]
+		}
+
+		broadcasts = append(broadcasts, broadcast)
+	}
+
+	return broadcasts
+}
@@ -0,0 +1,80 @@
+package socks5
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIsBroadcast(t *testing.T) {
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"255.255.255.255", true},
+		{"127.0.0.1", false},
+		{"224.0.0.251", false}, // multicast (mDNS)
+		{"ff02::fb", false},
+		{"8.8.8.8", false},
+		{"example.com", false},
+	}
+
+	for _, tt := range tests {
+		got := isBroadcast(&Addr{Host: tt.host, Port: 53})
+		if got != tt.want {
+			t.Errorf("isBroadcast(%v) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+// Send the datagram to the directed broadcast address of the loopback network through the server.
+// Return true, if the datagram is received by the socket listening at all the addresses
+func relayBroadcast(t *testing.T, allow bool) bool {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	_, addr := startServer(t, func(srv *Server) {
+		srv.AllowUDPBroadcast = allow
+	})
+
+	c, err := NewClient(addr).UDP(testContext(t, 10*time.Second), "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	dst, _ := net.ResolveUDPAddr("udp4", net.JoinHostPort("127.255.255.255", strconv.Itoa(port)))
+
+	_, err = c.WriteTo([]byte("broadcast"), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pc.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+
+	b := make([]byte, 64)
+	n, _, err := pc.ReadFrom(b)
+
+	return err == nil && string(b[:n]) == "broadcast"
+}
+
+func TestUDPBroadcastDestination(t *testing.T) {
+	if !localBroadcasts.contains(net.IPv4(127, 255, 255, 255)) {
+		t.Skip("the loopback network has no directed broadcast address")
+	}
+
+	if !relayBroadcast(t, true) {
+		t.Error("the broadcast datagram is not relayed with AllowUDPBroadcast")
+	}
+
+	if relayBroadcast(t, false) {
+		t.Error("the broadcast datagram is relayed without AllowUDPBroadcast")
+	}
+}
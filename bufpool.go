@@ -0,0 +1,35 @@
+package socks5
+
+import "sync"
+
+// BufferPool represents a pool of buffers for UDP datagrams (see Server.UDPBufferPool).
+//
+// Get must return buffers of the same size, that is large enough for the relayed datagrams (longer datagrams are truncated)
+type BufferPool interface {
+	Get() []byte  // Take a buffer from the pool
+	Put(b []byte) // Return the buffer to the pool
+}
+
+// syncBufferPool is a BufferPool based on sync.Pool
+type syncBufferPool struct {
+	pool sync.Pool
+}
+
+// Return a BufferPool of buffers with the size that is safe for concurrent use
+func NewBufferPool(size int) BufferPool {
+	p := &syncBufferPool{}
+	p.pool.New = func() any {
+		b := make([]byte, size)
+		return &b
+	}
+
+	return p
+}
+
+func (p *syncBufferPool) Get() []byte {
+	return *p.pool.Get().(*[]byte)
+}
+
+func (p *syncBufferPool) Put(b []byte) {
+	p.pool.Put(&b)
+}
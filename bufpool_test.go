@@ -0,0 +1,108 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingPool counts the buffers taken from the pool and not returned yet
+type countingPool struct {
+	BufferPool
+	taken atomic.Int64
+}
+
+func (p *countingPool) Get() []byte {
+	p.taken.Add(1)
+	return p.BufferPool.Get()
+}
+
+func (p *countingPool) Put(b []byte) {
+	p.taken.Add(-1)
+	p.BufferPool.Put(b)
+}
+
+func TestUDPBufferPoolIdleAssociation(t *testing.T) {
+	echo, _ := startUDPEcho(t)
+	pool := &countingPool{BufferPool: NewBufferPool(maxUDPHeaderLength)}
+
+	_, addr := startServer(t, func(srv *Server) {
+		srv.UDPBufferPool = pool
+	})
+
+	c, err := NewClient(addr).UDP(testContext(t, 10*time.Second), "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	if n := pool.taken.Load(); n != 0 {
+		t.Fatalf("the idle association holds %v buffers", n)
+	}
+
+	c.WriteTo([]byte("ping"), echo.LocalAddr())
+	readDatagram(t, c, "ping")
+
+	time.Sleep(50 * time.Millisecond)
+	if n := pool.taken.Load(); n != 0 {
+		t.Fatalf("the buffers are not returned after the datagram is relayed (%v)", n)
+	}
+}
+
+// Open b.N idle associations and report the heap memory used per association
+func benchmarkIdleAssociations(b *testing.B, pool BufferPool) {
+	srv := NewServer("127.0.0.1:0")
+	srv.DisableLogger()
+	srv.UDPBufferPool = pool
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	go srv.Serve(l)
+	defer srv.Close()
+
+	client := NewClient(l.Addr().String())
+	conns := make([]*UDPConn, 0, b.N)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c, err := client.UDP(context.Background(), "0.0.0.0:0")
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		conns = append(conns, c)
+	}
+	b.StopTimer()
+
+	// let the relays of the last associations start waiting for datagrams
+	time.Sleep(50 * time.Millisecond)
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	b.ReportMetric(float64(int64(after.HeapInuse)-int64(before.HeapInuse))/float64(b.N), "heap-B/assoc")
+}
+
+func BenchmarkIdleAssociationsBuffer(b *testing.B) {
+	benchmarkIdleAssociations(b, nil)
+}
+
+func BenchmarkIdleAssociationsPool(b *testing.B) {
+	benchmarkIdleAssociations(b, NewBufferPool(maxUDPHeaderLength))
+}
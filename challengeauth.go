@@ -0,0 +1,149 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"hash"
+	"io"
+
+	"github.com/osf4/socks5/internal/errio"
+)
+
+const (
+	nonceLength = 32
+)
+
+// ChallengeAuth represents the challenge-response authentication method (MethodChallenge).
+//
+// The server sends a random nonce, the client replies with HMAC of the nonce keyed with the shared secret.
+// The secret is never sent over the network and every nonce is used only once
+type ChallengeAuth struct {
+	Hash func() hash.Hash // Hash function used by HMAC (sha256.New by default)
+
+	secret []byte
+}
+
+func NewChallengeAuth(secret []byte) *ChallengeAuth {
+	return &ChallengeAuth{
+		Hash:   sha256.New,
+		secret: secret,
+	}
+}
+
+func (a *ChallengeAuth) Request(ctx context.Context, c *Conn) error {
+	nonce := &ChallengeMessage{}
+	err := c.ReadMessage(ctx, nonce)
+	if err != nil {
+		return err
+	}
+
+	res := &ChallengeMessage{Data: a.sign(nonce.Data)}
+	err = c.WriteMessage(ctx, res)
+	if err != nil {
+		return err
+	}
+
+	rep := &PassReply{}
+	err = c.ReadMessage(ctx, rep)
+	if err != nil {
+		return err
+	}
+
+	if rep.Status != StatusOK {
+		return ErrProtocol.New("challenge response is rejected by the server (status: %v)", rep.Status)
+	}
+
+	return nil
+}
+
+func (a *ChallengeAuth) Reply(ctx context.Context, c *Conn) error {
+	nonce := &ChallengeMessage{Data: make([]byte, nonceLength)}
+
+	_, err := rand.Read(nonce.Data)
+	if err != nil {
+		return ErrProtocol.Wrap(err, "unable to generate the nonce")
+	}
+
+	err = c.WriteMessage(ctx, nonce)
+	if err != nil {
+		return err
+	}
+
+	res := &ChallengeMessage{}
+	err = c.ReadMessage(ctx, res)
+	if err != nil {
+		return err
+	}
+
+	rep := &PassReply{Status: StatusOK}
+	if !hmac.Equal(res.Data, a.sign(nonce.Data)) {
+		rep.Status = StatusFailure
+		c.WriteMessage(ctx, rep)
+
+		return ErrProtocol.New("challenge response of the client (%v) is wrong", c.Raw().RemoteAddr())
+	}
+
+	return c.WriteMessage(ctx, rep)
+}
+
+func (a *ChallengeAuth) Method() authMethod {
+	return MethodChallenge
+}
+
+// HMAC of the nonce keyed with the secret
+func (a *ChallengeAuth) sign(nonce []byte) []byte {
+	h := a.Hash
+	if h == nil {
+		h = sha256.New
+	}
+
+	mac := hmac.New(h, a.secret)
+	mac.Write(nonce)
+
+	return mac.Sum(nil)
+}
+
+// ChallengeMessage represents the nonce sent by the server and the response sent by the client
+type ChallengeMessage struct {
+	Data []byte
+}
+
+func (m *ChallengeMessage) Write(wr io.Writer) error {
+	if len(m.Data) > 255 {
+		return ErrProtocol.New("challenge message is too long (%v bytes)", len(m.Data))
+	}
+
+	w := bufio.NewWriterSize(wr, 2+len(m.Data))
+
+	w.Write([]byte{subnegotiationVersion, byte(len(m.Data))})
+	w.Write(m.Data)
+
+	err := w.Flush()
+	if err != nil {
+		return ErrProtocol.Wrap(err, "unable to write the challenge message")
+	}
+
+	return nil
+}
+
+func (m *ChallengeMessage) Read(rd io.Reader) error {
+	erd := errio.NewReader(rd)
+	b := make([]byte, 2)
+
+	erd.Read(b)
+	if err := erd.Error(); err != nil {
+		return ErrProtocol.Wrap(err, "unable to read the challenge message")
+	}
+
+	if b[0] != subnegotiationVersion {
+		return ErrProtocol.New("subnegotiation version is wrong (%v)", b[0])
+	}
+
+	m.Data = make([]byte, b[1])
+	io.ReadFull(erd, m.Data)
+
+	return erd.Wrap(ErrProtocol, "unable to read the challenge message")
+}
@@ -0,0 +1,142 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"testing"
+	"time"
+)
+
+// Run the challenge-response authentication between the client and the server authenticators.
+// Return the errors of the client and the server sides
+func challengeExchange(t *testing.T, client, server *ChallengeAuth) (clientErr, serverErr error) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cr, sr := tcpPipe(t)
+	defer cr.Close()
+	defer sr.Close()
+
+	res := make(chan error, 1)
+	go func() {
+		res <- server.Reply(ctx, NewConn(sr))
+	}()
+
+	clientErr = client.Request(ctx, NewConn(cr))
+	serverErr = <-res
+
+	return clientErr, serverErr
+}
+
+func TestChallengeAuthRoundTrip(t *testing.T) {
+	sha512Auth := func(secret string) *ChallengeAuth {
+		a := NewChallengeAuth([]byte(secret))
+		a.Hash = sha512.New
+
+		return a
+	}
+
+	tests := []struct {
+		name           string
+		client, server *ChallengeAuth
+		ok             bool
+	}{
+		{"same secret", NewChallengeAuth([]byte("secret")), NewChallengeAuth([]byte("secret")), true},
+		{"same secret and SHA-512", sha512Auth("secret"), sha512Auth("secret"), true},
+		{"wrong secret", NewChallengeAuth([]byte("wrong")), NewChallengeAuth([]byte("secret")), false},
+		{"different hash", sha512Auth("secret"), NewChallengeAuth([]byte("secret")), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientErr, serverErr := challengeExchange(t, tt.client, tt.server)
+			if (clientErr == nil) != tt.ok || (serverErr == nil) != tt.ok {
+				t.Fatalf("client: %v, server: %v", clientErr, serverErr)
+			}
+		})
+	}
+}
+
+func TestChallengeAuthResponseReplay(t *testing.T) {
+	ctx := testContext(t, 5*time.Second)
+	server := NewChallengeAuth([]byte("secret"))
+
+	// Return the nonce and the response of the exchange, the response of the client is replaced with replay (if it is not nil)
+	exchange := func(replay []byte) (nonce, response []byte, serverErr error) {
+		cr, sr := tcpPipe(t)
+		defer cr.Close()
+		defer sr.Close()
+
+		res := make(chan error, 1)
+		go func() { res <- server.Reply(ctx, NewConn(sr)) }()
+
+		client := NewConn(cr)
+
+		msg := &ChallengeMessage{}
+		err := client.ReadMessage(ctx, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response = replay
+		if response == nil {
+			response = server.sign(msg.Data)
+		}
+
+		err = client.WriteMessage(ctx, &ChallengeMessage{Data: response})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return msg.Data, response, <-res
+	}
+
+	nonce, response, err := exchange(nil)
+	if err != nil {
+		t.Fatalf("the valid response: %v", err)
+	}
+
+	replayedNonce, _, err := exchange(response)
+	if err == nil {
+		t.Fatal("the replayed response is accepted")
+	}
+
+	if bytes.Equal(nonce, replayedNonce) || len(nonce) != nonceLength {
+		t.Fatalf("the nonces %x and %x", nonce, replayedNonce)
+	}
+}
+
+func TestChallengeAuthServer(t *testing.T) {
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Auth = NewChallengeAuth([]byte("secret"))
+	})
+
+	client := NewClient(addr)
+	client.Auth = NewChallengeAuth([]byte("secret"))
+
+	c, err := client.Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c, "ping")
+
+	client.Auth = NewChallengeAuth([]byte("wrong"))
+	_, err = client.Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err == nil {
+		t.Fatal("the wrong secret is accepted by the server")
+	}
+}
+
+func TestChallengeMessageTooLong(t *testing.T) {
+	var b bytes.Buffer
+
+	err := (&ChallengeMessage{Data: make([]byte, 256)}).Write(&b)
+	if err == nil {
+		t.Fatal("the message of 256 bytes is written")
+	}
+}
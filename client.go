@@ -3,16 +3,37 @@ package socks5
 import (
 	"context"
 	"net"
+	"time"
 )
 
+// Client represents SOCKS5 client.
+//
+// Command methods (Connect, Bind, UDP) do not modify the client, so it is safe to call them from multiple goroutines.
+// The fields must not be modified while the commands are running
 type Client struct {
-	Proxy string
+	Proxy     string
+	HTTPProxy string // Address of the HTTP proxy, the connection to Proxy is tunneled through with HTTP CONNECT (empty connects directly)
 
 	Dialer    Dialer
 	Auth      Auth
-	UDPBuffer int // Buffer size for UDP headers sent by the server
+	UDPBuffer int           // Buffer size for UDP headers sent by the server
+	KeepAlive time.Duration // Period of TCP keepalive probes on the proxy connection (0 leaves the dialer settings)
+	LocalAddr net.Addr      // Local address the proxy connection is bound to. Applied only if Dialer is a *net.Dialer
+
+	AllowDirectFallback bool   // Connect dials the destination directly with Dialer, if the proxy is unreachable (requests rejected by the proxy are not retried)
+	Logger              Logger // Logger for client events, e.g. the direct fallback (nil disables logging)
+
+	// Resolve domain destinations of SOCKSDialer locally and send the first IP address to the proxy.
+	// The Resolver of Dialer is used, if Dialer is a *net.Dialer with the resolver (net.DefaultResolver otherwise).
+	// By default the domains are sent to the proxy, so the proxy resolves them
+	ResolveLocally bool
+
+	// Reject CONNECT replies, whose BND.ADDR family (IPv4/IPv6) does not match the IP destination.
+	// If StrictReply is false, the mismatch is only logged at the debug level
+	StrictReply bool
 }
 
+// Return a SOCKS5 client with default options that makes connections through the proxy
 func NewClient(proxy string) *Client {
 	return &Client{
 		Proxy:  proxy,
@@ -27,13 +48,23 @@ func (c *Client) Connect(ctx context.Context, address string) (net.Conn, error)
 		panic("context must be non-nil")
 	}
 
-	proxy, err := c.proxy(ctx)
+	raw, err := c.dialProxy(ctx)
+	if err != nil {
+		if c.AllowDirectFallback {
+			return c.dialDirect(ctx, address, err)
+		}
+
+		return nil, err
+	}
+
+	proxy, err := c.handshake(ctx, raw)
 	if err != nil {
 		return nil, err
 	}
 
 	_, _, err = c.cmd(ctx, proxy, CmdConnect, address)
 	if err != nil {
+		proxy.Close()
 		return nil, err
 	}
 
@@ -55,15 +86,25 @@ func (c *Client) Bind(ctx context.Context, address string, bindAddr chan net.Add
 
 	req, rep, err := c.cmd(ctx, proxy, CmdBind, address)
 	if err != nil {
+		proxy.Close()
 		return nil, err
 	}
 
 	bindAddr <- rep.Bnd
 
 	_, err = c.readReply(ctx, proxy, req)
-	return proxy.Raw(), err
+	if err != nil {
+		proxy.Close()
+		return nil, err
+	}
+
+	return proxy.Raw(), nil
 }
 
+// Send the UDP ASSOCIATE request and return the connection relaying datagrams through the proxy.
+//
+// address is the address the datagrams are sent from ("0.0.0.0:0", if it is unknown).
+// The proxy drops the datagrams sent from other addresses, the zero IP and port match any IP and port of the client
 func (c *Client) UDP(ctx context.Context, address string) (*UDPConn, error) {
 	if ctx == nil {
 		panic("context must be non-nil")
@@ -74,18 +115,81 @@ func (c *Client) UDP(ctx context.Context, address string) (*UDPConn, error) {
 		return nil, err
 	}
 
+	udp, err := c.associate(ctx, proxy, address, true)
+	if err != nil {
+		proxy.Close()
+		return nil, err
+	}
+
+	return udp, nil
+}
+
+// Send the UDP ASSOCIATE request over the existing connection to the proxy (e.g. NewConn(raw)).
+// If the handshake is not completed on proxy, the client negotiates and authenticates first.
+//
+// The caller keeps the ownership of proxy: UDPConn.Close closes only the data socket,
+// and the association lasts till the caller closes proxy. proxy must not be used for other commands after the call
+func (c *Client) UDPOn(ctx context.Context, proxy *Conn, address string) (*UDPConn, error) {
+	if ctx == nil {
+		panic("context must be non-nil")
+	}
+
+	if !proxy.HandshakeComplete() {
+		err := c.authenticate(ctx, proxy)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c.associate(ctx, proxy, address, false)
+}
+
+// Send the UDP ASSOCIATE request and dial the data socket.
+// If ownsControl is true, UDPConn.Close closes the control connection as well
+func (c *Client) associate(ctx context.Context, proxy *Conn, address string, ownsControl bool) (*UDPConn, error) {
 	_, rep, err := c.cmd(ctx, proxy, CmdUDP, address)
 	if err != nil {
 		return nil, err
 	}
 
 	control := proxy.Raw() // raw TCP connection to the server
-	data, err := net.Dial("udp", rep.Bnd.String())
+	data, err := c.Dialer.DialContext(ctx, "udp", rep.Bnd.String())
 	if err != nil {
 		return nil, ErrProtocol.Wrap(err, "unable to establish the connection to the UDP server")
 	}
 
-	return NewUDPConnSize(control, data, c.UDPBuffer), nil
+	return newUDPConn(control, data, c.UDPBuffer, 0, ownsControl, nil), nil
+}
+
+// Return the authentication methods supported by the proxy.
+//
+// Every known method is offered in a separate negotiation, the connections are closed right after the negotiation reply
+func (c *Client) SupportedMethods(ctx context.Context) ([]authMethod, error) {
+	if ctx == nil {
+		panic("context must be non-nil")
+	}
+
+	var supported []authMethod
+
+	for _, method := range []authMethod{MethodNotRequired, MethodPassword, MethodChallenge} {
+		raw, err := c.dialProxy(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		selected, err := Negotiator.Request(ctx, NewConn(raw), []authMethod{method})
+		raw.Close()
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if err == nil && selected == method {
+			supported = append(supported, method)
+		}
+	}
+
+	return supported, nil
 }
 
 // Return a Dialer that will make connections through the proxy server
@@ -97,9 +201,9 @@ func (c *Client) SOCKSDialer() Dialer {
 //
 // error is returned, if the reply is not RepSucceeded
 func (c *Client) cmd(ctx context.Context, proxy *Conn, cmd cmdType, addr string) (*Request, *Reply, error) {
-	dst := ParseAddr(cmd.Network(), addr)
-	if dst == nil {
-		return nil, nil, ErrProtocol.New("unable to parse the address (%v)", addr)
+	dst, err := ParseAddrErr(cmd.Network(), addr)
+	if err != nil {
+		return nil, nil, ErrProtocol.Wrap(err, "invalid destination of the %v request", cmd)
 	}
 
 	req := &Request{
@@ -107,7 +211,7 @@ func (c *Client) cmd(ctx context.Context, proxy *Conn, cmd cmdType, addr string)
 		Dst: dst,
 	}
 
-	err := proxy.WriteMessage(ctx, req)
+	err = proxy.WriteMessage(ctx, req)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -132,29 +236,153 @@ func (c *Client) readReply(ctx context.Context, proxy *Conn, req *Request) (*Rep
 		return nil, SOCKSError(errctx.Code, errctx)
 	}
 
+	err = c.checkReplyFamily(req, rep)
+	if err != nil {
+		proxy.Close()
+		return nil, err
+	}
+
 	return rep, nil
 }
 
+// Check that the family of BND.ADDR matches the family of the CONNECT destination.
+//
+// Error is returned only if c.StrictReply is set, domain destinations are not checked
+func (c *Client) checkReplyFamily(req *Request, rep *Reply) error {
+	if req.Cmd != CmdConnect || req.Dst.Atyp == AddrDomain || rep.Bnd.Atyp == AddrDomain {
+		return nil
+	}
+
+	if req.Dst.Atyp == rep.Bnd.Atyp {
+		return nil
+	}
+
+	if c.StrictReply {
+		return ErrProtocol.New("address family of BND.ADDR (%v) does not match the destination (%v)", rep.Bnd, req.Dst)
+	}
+
+	if c.Logger != nil {
+		debugf(c.Logger, "The address family of BND.ADDR (%v) does not match the destination (%v)\n", rep.Bnd, req.Dst)
+	}
+
+	return nil
+}
+
+// Dial the destination without the proxy, cause the proxy is unreachable (proxyErr)
+func (c *Client) dialDirect(ctx context.Context, address string, proxyErr error) (net.Conn, error) {
+	if c.Logger != nil {
+		c.Logger.Infof("The proxy %v is unreachable (%v), connecting to %v directly\n", c.Proxy, proxyErr, address)
+	}
+
+	conn, err := c.Dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, ErrConn.Wrap(err, "unable to connect to %v directly", address)
+	}
+
+	return conn, nil
+}
+
 // Return the authentication SOCKS5 connection to the proxy
 func (c *Client) proxy(ctx context.Context) (*Conn, error) {
-	raw, err := c.Dialer.DialContext(ctx, "tcp", c.Proxy)
+	raw, err := c.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.handshake(ctx, raw)
+}
+
+// Dial the TCP connection to the proxy (through c.HTTPProxy, if it is set)
+func (c *Client) dialProxy(ctx context.Context) (net.Conn, error) {
+	if c.HTTPProxy != "" {
+		return c.dialHTTPTunnel(ctx)
+	}
+
+	raw, err := c.proxyDialer().DialContext(ctx, "tcp", c.Proxy)
 	if err != nil {
 		return nil, ErrProtocol.Wrap(err, "unable to establish the connection to the proxy")
 	}
+
+	if c.KeepAlive != 0 {
+		setKeepAlive(raw, c.KeepAlive)
+	}
+
+	return raw, nil
+}
+
+// Dial c.HTTPProxy and establish the tunnel to c.Proxy
+func (c *Client) dialHTTPTunnel(ctx context.Context) (net.Conn, error) {
+	raw, err := c.proxyDialer().DialContext(ctx, "tcp", c.HTTPProxy)
+	if err != nil {
+		return nil, ErrProtocol.Wrap(err, "unable to establish the connection to the HTTP proxy")
+	}
+
+	if c.KeepAlive != 0 {
+		setKeepAlive(raw, c.KeepAlive)
+	}
+
+	tunnel, err := httpConnect(ctx, raw, c.Proxy)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+
+	return tunnel, nil
+}
+
+// Negotiate and authenticate over the raw connection to the proxy
+func (c *Client) handshake(ctx context.Context, raw net.Conn) (*Conn, error) {
 	proxy := NewConn(raw)
 
-	method, err := Negotiator.Request(ctx, proxy, c.authMethods())
+	err := c.authenticate(ctx, proxy)
 	if err != nil {
+		proxy.Close()
 		return nil, err
 	}
 
+	return proxy, nil
+}
+
+// Negotiate and authenticate over the connection to the proxy
+func (c *Client) authenticate(ctx context.Context, proxy *Conn) error {
+	method, err := Negotiator.Request(ctx, proxy, c.authMethods())
+	if err != nil {
+		return err
+	}
+
 	auth := c.auth(method)
 	err = auth.Request(ctx, proxy)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	proxy.completeHandshake()
 
-	return proxy, nil
+	return nil
+}
+
+// Return the dialer that is used to connect to the proxy.
+//
+// If c.LocalAddr is set and c.Dialer is a *net.Dialer, a copy of the dialer bound to c.LocalAddr is returned
+func (c *Client) proxyDialer() Dialer {
+	d, ok := c.Dialer.(*net.Dialer)
+	if !ok || c.LocalAddr == nil {
+		return c.Dialer
+	}
+
+	bound := *d
+	bound.LocalAddr = c.LocalAddr
+
+	return &bound
+}
+
+// Return the resolver of c.Dialer, if it is a *net.Dialer with the resolver. Otherwise net.DefaultResolver is returned
+func (c *Client) resolver() *net.Resolver {
+	d, ok := c.Dialer.(*net.Dialer)
+	if !ok || d.Resolver == nil {
+		return net.DefaultResolver
+	}
+
+	return d.Resolver
 }
 
 // Return NoAuth method, if method == NoAuth. In other cases c.Auth is returned.
@@ -169,3 +397,14 @@ func (c *Client) auth(method authMethod) Auth {
 func (c *Client) authMethods() []authMethod {
 	return []authMethod{MethodNotRequired, c.Auth.Method()}
 }
+
+// Enable TCP keepalive with the period, if c is a TCP connection or wraps one (e.g. *tls.Conn)
+func setKeepAlive(c net.Conn, period time.Duration) {
+	tcp, ok := tcpConnOf(c)
+	if !ok {
+		return
+	}
+
+	tcp.SetKeepAlive(true)
+	tcp.SetKeepAlivePeriod(period)
+}
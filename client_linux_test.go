@@ -0,0 +1,97 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Return the SO_KEEPALIVE and TCP_KEEPIDLE options of the TCP connection
+func keepAliveOptions(t *testing.T, c net.Conn) (enabled bool, idle time.Duration) {
+	t.Helper()
+
+	raw, err := c.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var on, secs int
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		on, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		if serr == nil {
+			secs, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+		}
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return on != 0, time.Duration(secs) * time.Second
+}
+
+func TestClientKeepAlive(t *testing.T) {
+	echo := startEcho(t)
+	_, addr := startServer(t, nil)
+
+	client := NewClient(addr)
+	client.Dialer = &net.Dialer{KeepAlive: -1}
+	client.KeepAlive = 7 * time.Second
+
+	c, err := client.Connect(testContext(t, 5*time.Second), echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	enabled, idle := keepAliveOptions(t, c)
+	if !enabled || idle != client.KeepAlive {
+		t.Fatalf("keepalive enabled %v after %v of idle", enabled, idle)
+	}
+}
+
+func TestClientKeepAliveOff(t *testing.T) {
+	echo := startEcho(t)
+	_, addr := startServer(t, nil)
+
+	client := NewClient(addr)
+	client.Dialer = &net.Dialer{KeepAlive: -1}
+
+	c, err := client.Connect(testContext(t, 5*time.Second), echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if enabled, _ := keepAliveOptions(t, c); enabled {
+		t.Fatal("keepalive is enabled, though the dialer disables it")
+	}
+}
+
+func TestClientKeepAliveTLS(t *testing.T) {
+	echo := startEcho(t)
+	addr := startSecureTLSServer(t)
+
+	client := NewClient(addr)
+	client.Dialer = &tls.Dialer{
+		NetDialer: &net.Dialer{KeepAlive: -1},
+		Config:    &tls.Config{InsecureSkipVerify: true},
+	}
+	client.KeepAlive = 7 * time.Second
+
+	c, err := client.Connect(testContext(t, 5*time.Second), echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	enabled, idle := keepAliveOptions(t, c.(*tls.Conn).NetConn())
+	if !enabled || idle != client.KeepAlive {
+		t.Fatalf("keepalive of the TLS connection enabled %v after %v of idle", enabled, idle)
+	}
+}
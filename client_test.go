@@ -0,0 +1,437 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+func TestUDPOnKeepsCallerConnection(t *testing.T) {
+	echo, _ := startUDPEcho(t)
+	_, addr := startServer(t, nil)
+
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	proxy := NewConn(raw)
+	ctx := testContext(t, 10*time.Second)
+
+	c, err := NewClient(addr).UDPOn(ctx, proxy, "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.WriteTo([]byte("ping"), echo.LocalAddr())
+	readDatagram(t, c, "ping")
+
+	c.Close()
+
+	// the control connection is owned by the caller, so it is not closed with the association
+	raw.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = raw.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("the caller's connection is closed by UDPConn.Close: %v", err)
+	}
+}
+
+func TestUDPOnClosedByCaller(t *testing.T) {
+	_, addr := startServer(t, nil)
+
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewClient(addr).UDPOn(testContext(t, 10*time.Second), NewConn(raw), "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	raw.Close()
+
+	if !associationClosed(t, c, 5*time.Second) {
+		t.Fatal("the association is not closed with the caller's connection")
+	}
+}
+
+func TestClientConcurrentConnect(t *testing.T) {
+	echo := startEcho(t)
+	udpEcho, _ := startUDPEcho(t)
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Auth = NewPassAuth("user", "pass")
+	})
+
+	client := NewClient(addr)
+	client.Auth = NewPassAuth("user", "pass")
+
+	errs := make(chan error, 32)
+	for i := 0; i < cap(errs); i++ {
+		go func(i int) {
+			ctx := testContext(t, 10*time.Second)
+
+			if i%4 == 0 {
+				c, err := client.UDP(ctx, "0.0.0.0:0")
+				if err == nil {
+					_, err = c.WriteTo([]byte("ping"), udpEcho.LocalAddr())
+					c.Close()
+				}
+
+				errs <- err
+				return
+			}
+
+			c, err := client.Connect(ctx, echo)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer c.Close()
+
+			msg := fmt.Sprintf("ping %v", i)
+			_, err = c.Write([]byte(msg))
+			if err == nil {
+				b := make([]byte, len(msg))
+				_, err = io.ReadFull(c, b)
+			}
+
+			errs <- err
+		}(i)
+	}
+
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestClientLocalAddr(t *testing.T) {
+	echo := startEcho(t)
+
+	remotes := make(chan net.Addr, 1)
+	_, addr := startServer(t, func(srv *Server) {
+		srv.OnHandshakeComplete = func(conn *Conn, method authMethod, dur time.Duration, err error) {
+			remotes <- conn.Raw().RemoteAddr()
+		}
+	})
+
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}
+
+	client := NewClient(addr)
+	client.LocalAddr = local
+
+	c, err := client.Connect(testContext(t, 5*time.Second), echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	remote := (<-remotes).(*net.TCPAddr)
+	if !remote.IP.Equal(local.IP) {
+		t.Fatalf("the proxy connection is made from %v, expected %v", remote, local.IP)
+	}
+
+	if !c.LocalAddr().(*net.TCPAddr).IP.Equal(local.IP) {
+		t.Fatalf("the local address of the connection is %v", c.LocalAddr())
+	}
+
+	if defaultDialer.LocalAddr != nil {
+		t.Fatal("the shared default dialer is modified")
+	}
+}
+
+// udpCancelDialer dials TCP with the default dialer. The UDP dial cancels the context and waits till it is done
+type udpCancelDialer struct {
+	net.Dialer
+	cancel context.CancelFunc
+	udp    chan string
+}
+
+func (d *udpCancelDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "udp" {
+		return d.Dialer.DialContext(ctx, network, address)
+	}
+
+	d.udp <- address
+	d.cancel()
+
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestUDPCancelledDataDial(t *testing.T) {
+	_, addr := startServer(t, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dialer := &udpCancelDialer{cancel: cancel, udp: make(chan string, 1)}
+
+	client := NewClient(addr)
+	client.Dialer = dialer
+
+	c, err := client.UDP(ctx, "0.0.0.0:0")
+	if err == nil {
+		c.Close()
+		t.Fatal("the association is established with the cancelled context")
+	}
+
+	if !errors.Is(ctx.Err(), context.Canceled) {
+		t.Fatalf("the context is not cancelled by the dialer: %v", ctx.Err())
+	}
+
+	select {
+	case relay := <-dialer.udp:
+		if _, _, err := net.SplitHostPort(relay); err != nil {
+			t.Fatalf("the UDP relay address %q: %v", relay, err)
+		}
+
+	default:
+		t.Fatal("the UDP data socket is not dialed with Client.Dialer")
+	}
+}
+
+func TestClientDirectFallback(t *testing.T) {
+	echo := startEcho(t)
+	logger := &recordingLogger{}
+
+	client := NewClient(closedPort(t))
+	client.AllowDirectFallback = true
+	client.Logger = logger
+
+	c, err := client.Connect(testContext(t, 5*time.Second), echo)
+	if err != nil {
+		t.Fatalf("the direct fallback: %v", err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c, "ping")
+
+	if c.RemoteAddr().String() != echo {
+		t.Fatalf("the connection is made to %v, expected %v", c.RemoteAddr(), echo)
+	}
+
+	if lines := logger.Lines(); len(lines) != 1 || !strings.Contains(lines[0], "directly") {
+		t.Fatalf("logged lines: %q", lines)
+	}
+}
+
+func TestClientDirectFallbackOff(t *testing.T) {
+	_, err := NewClient(closedPort(t)).Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err == nil {
+		t.Fatal("the connection is made without the proxy")
+	}
+}
+
+func TestClientDirectFallbackRejectedRequest(t *testing.T) {
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Rules = denyRules{}
+	})
+
+	client := NewClient(addr)
+	client.AllowDirectFallback = true
+
+	_, err := client.Connect(testContext(t, 5*time.Second), startEcho(t))
+	if code, _ := ReplyCodeOf(err); code != RepConnNotAllowed {
+		t.Fatalf("the request rejected by the proxy: %v", err)
+	}
+}
+
+// Start the fake proxy, that completes the handshake without authentication and replies to every request with bnd
+func startFakeProxy(t *testing.T, bnd *Addr) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			raw, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer raw.Close()
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+
+				c := NewConn(raw)
+				neg := &NegotiationRequest{}
+				if c.ReadMessage(ctx, neg) != nil || c.WriteMessage(ctx, &NegotiationReply{Method: MethodNotRequired}) != nil {
+					return
+				}
+
+				req := &Request{}
+				if c.ReadMessage(ctx, req) != nil || c.WriteMessage(ctx, &Reply{Rep: RepSucceeded, Bnd: bnd}) != nil {
+					return
+				}
+
+				io.Copy(io.Discard, raw)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestClientStrictReplyFamilyMismatch(t *testing.T) {
+	proxy := startFakeProxy(t, ParseAddr("tcp", "192.0.2.1:1080"))
+
+	client := NewClient(proxy)
+	client.StrictReply = true
+
+	_, err := client.Connect(testContext(t, 5*time.Second), "[2001:db8::1]:80")
+	if err == nil {
+		t.Fatal("the IPv4 BND.ADDR is accepted for the IPv6 destination")
+	}
+
+	c, err := client.Connect(testContext(t, 5*time.Second), "192.0.2.2:80")
+	if err != nil {
+		t.Fatalf("the matching family: %v", err)
+	}
+	c.Close()
+
+	c, err = client.Connect(testContext(t, 5*time.Second), "example.com:80")
+	if err != nil {
+		t.Fatalf("the domain destination: %v", err)
+	}
+	c.Close()
+}
+
+func TestClientLenientReplyFamilyMismatch(t *testing.T) {
+	logger := &recordingLogger{}
+
+	client := NewClient(startFakeProxy(t, ParseAddr("tcp", "192.0.2.1:1080")))
+	client.Logger = logger
+
+	c, err := client.Connect(testContext(t, 5*time.Second), "[2001:db8::1]:80")
+	if err != nil {
+		t.Fatalf("the lenient client: %v", err)
+	}
+	c.Close()
+
+	if lines := logger.Lines(); len(lines) != 1 || !strings.Contains(lines[0], "does not match") {
+		t.Fatalf("logged lines: %q", lines)
+	}
+}
+
+func TestUDPConnControl(t *testing.T) {
+	echo, _ := startUDPEcho(t)
+	_, addr := startServer(t, nil)
+
+	c, err := NewClient(addr).UDP(testContext(t, 5*time.Second), "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	control := c.Control()
+	if control == nil || control.RemoteAddr().String() != addr {
+		t.Fatalf("the control connection %v is not connected to the proxy %v", control, addr)
+	}
+
+	_, err = c.WriteTo([]byte("ping"), echo.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	readDatagram(t, c, "ping")
+
+	// closing the control connection closes the association
+	control.Close()
+
+	if !associationClosed(t, c, 5*time.Second) {
+		t.Fatal("the association is not closed with the control connection")
+	}
+}
+
+func TestUDPConnControlClosedByProxy(t *testing.T) {
+	srv, addr := startServer(t, nil)
+
+	c, err := NewClient(addr).UDP(testContext(t, 5*time.Second), "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	srv.Close()
+
+	if !associationClosed(t, c, 5*time.Second) {
+		t.Fatal("the association is not closed, when the proxy closes the control connection")
+	}
+}
+
+func TestSupportedMethods(t *testing.T) {
+	tests := []struct {
+		name   string
+		auths  []Auth
+		expect []authMethod
+	}{
+		{"password required", []Auth{NewPassAuth("user", "pass")}, []authMethod{MethodPassword}},
+		{"no authentication", []Auth{NoAuth}, []authMethod{MethodNotRequired}},
+		{"all methods", []Auth{NoAuth, NewPassAuth("user", "pass"), NewChallengeAuth([]byte("secret"))}, []authMethod{MethodNotRequired, MethodPassword, MethodChallenge}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := startServer(t, func(srv *Server) {
+				srv.Auths = tt.auths
+			})
+
+			methods, err := NewClient(addr).SupportedMethods(testContext(t, 5*time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if fmt.Sprint(methods) != fmt.Sprint(tt.expect) {
+				t.Fatalf("supported methods %v, expected %v", methods, tt.expect)
+			}
+		})
+	}
+}
+
+func TestSupportedMethodsUnreachableProxy(t *testing.T) {
+	_, err := NewClient(closedPort(t)).SupportedMethods(testContext(t, 5*time.Second))
+	if err == nil {
+		t.Fatal("the methods of the unreachable proxy are reported")
+	}
+}
+
+func TestClientMalformedDestination(t *testing.T) {
+	_, addr := startServer(t, nil)
+
+	tests := []struct {
+		name, addr, reason string
+	}{
+		{"too many colons", "bad:addr:here", "too many colons"},
+		{"missing port", "example.com", "missing port"},
+		{"invalid port", "example.com:http", "invalid syntax"},
+		{"port out of range", "example.com:65536", "value out of range"},
+		{"long domain", strings.Repeat("a", 300) + ":80", "longer than 255 bytes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewClient(addr).Connect(testContext(t, 5*time.Second), tt.addr)
+			if !errorx.IsOfType(err, ErrProtocol) || !strings.Contains(err.Error(), tt.reason) {
+				t.Fatalf("Connect(%q): %v", tt.addr, err)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 	"net"
+	"sync/atomic"
 )
 
 // Message represents messages sent between the server and the client (negotiation requests, authentication requests, replies)
@@ -14,16 +15,21 @@ type Message interface {
 
 // Conn represents SOCKS5 connection
 type Conn struct {
-	alive bool     // represents if the connection is closed or not
-	raw   net.Conn // raw connection
+	closed    atomic.Bool // represents if the connection is closed or not
+	handshake bool        // represents if the negotiation and the authentication are completed
+	raw       net.Conn    // raw connection
+	user      string      // username of the authenticated client (empty, if the authentication method has no identity)
+	id        string      // unique ID of the session (empty on the client side)
+
+	trace  func(read bool, b []byte) // called with the bytes of every read and written message (nil disables tracing)
+	logger Logger                    // logger of the session (nil on the client side)
 
 	CloseOnContextDone bool // close the connection, if <-Context.Done()
 }
 
 func NewConn(raw net.Conn) *Conn {
 	return &Conn{
-		alive: true,
-		raw:   raw,
+		raw: raw,
 
 		CloseOnContextDone: true,
 	}
@@ -32,11 +38,15 @@ func NewConn(raw net.Conn) *Conn {
 // messageHandler represents a handler that is used to write or to read the message
 type messageHandler func(io.ReadWriter, chan error, Message)
 
-// Send the message to the connection.
+// Send the message to the connection and flush it (see Conn.Flush).
 // If the context is done, the connection will be closed
 func (c *Conn) WriteMessage(ctx context.Context, msg Message) error {
-	write := func(c io.ReadWriter, res chan error, msg Message) {
-		err := msg.Write(c)
+	write := func(rw io.ReadWriter, res chan error, msg Message) {
+		err := msg.Write(rw)
+		if err == nil {
+			err = c.Flush()
+		}
+
 		res <- err
 	}
 
@@ -62,8 +72,17 @@ func (c *Conn) processMessage(ctx context.Context, msg Message, handler messageH
 		panic("context must be non-nil")
 	}
 
+	// messages are read by fixed-size fields, the bytes of a field could arrive in several segments
+	var rw io.ReadWriter = fullReadWriter{c.raw}
+
+	var tracer *traceReadWriter
+	if c.trace != nil {
+		tracer = &traceReadWriter{rw: rw, trace: c.trace}
+		rw = tracer
+	}
+
 	res := make(chan error)
-	go handler(c.raw, res, msg)
+	go handler(rw, res, msg)
 
 	select {
 	case <-ctx.Done():
@@ -71,10 +90,27 @@ func (c *Conn) processMessage(ctx context.Context, msg Message, handler messageH
 		return ctx.Err()
 
 	case err := <-res:
+		if tracer != nil {
+			tracer.flush()
+		}
+
 		return err
 	}
 }
 
+// Send the bytes buffered by the raw connection, if it buffers writes (implements Flush() error).
+//
+// WriteMessage flushes every message, so the handshake messages are not delayed. Data written to Raw() directly
+// (e.g. right after the handshake, before switching to the relay) must be flushed by the caller
+func (c *Conn) Flush() error {
+	f, ok := c.raw.(interface{ Flush() error })
+	if !ok {
+		return nil
+	}
+
+	return f.Flush()
+}
+
 // Raw connection
 func (c *Conn) Raw() net.Conn {
 	return c.raw
@@ -82,11 +118,49 @@ func (c *Conn) Raw() net.Conn {
 
 // Connection is closed or not
 func (c *Conn) Alive() bool {
-	return c.alive
+	return !c.closed.Load()
+}
+
+// True, if the negotiation and the authentication are completed.
+// Subsequent negotiation requests on the connection are rejected
+func (c *Conn) HandshakeComplete() bool {
+	return c.handshake
+}
+
+// Username of the authenticated client.
+// It is empty, if the client is not authenticated or the authentication method has no identity (NoAuth)
+func (c *Conn) User() string {
+	return c.user
+}
+
+// Unique ID of the session that is assigned by the server, when the connection is accepted.
+// It is empty for the connections made by the client
+func (c *Conn) SessionID() string {
+	return c.id
+}
+
+// Return the logger of the session that prefixes every line with the session ID and the client address.
+// It is derived from Server.Logger and allows the hooks to log lines correlated with the session.
+// The lines are discarded for the connections made by the client
+func (c *Conn) Logger() Logger {
+	if c.logger == nil {
+		return nopLogger{}
+	}
+
+	return c.logger
 }
 
+func (c *Conn) completeHandshake() {
+	c.handshake = true
+}
+
+// Close the connection. It is safe to call Close several times and from multiple goroutines,
+// only the first call closes the raw connection
 func (c *Conn) Close() error {
-	c.alive = false
+	if c.closed.Swap(true) {
+		return nil
+	}
+
 	return c.raw.Close()
 }
 
@@ -95,3 +169,61 @@ func (c *Conn) onContextDone() {
 		c.Close()
 	}
 }
+
+// fullReadWriter fills the whole buffer on every read, so the messages sent in small segments are not misparsed
+type fullReadWriter struct {
+	io.ReadWriter
+}
+
+func (f fullReadWriter) Read(p []byte) (int, error) {
+	return io.ReadFull(f.ReadWriter, p)
+}
+
+// traceReadWriter passes the bytes of every Write to trace.
+// Read bytes are collected and passed to trace on flush, so a message is traced at once
+type traceReadWriter struct {
+	rw    io.ReadWriter
+	trace func(read bool, b []byte)
+	read  []byte // bytes read since the last flush
+}
+
+func (t *traceReadWriter) Read(p []byte) (int, error) {
+	n, err := t.rw.Read(p)
+	t.read = append(t.read, p[:n]...)
+
+	return n, err
+}
+
+func (t *traceReadWriter) flush() {
+	if len(t.read) > 0 {
+		t.trace(true, t.read)
+		t.read = nil
+	}
+}
+
+func (t *traceReadWriter) Write(p []byte) (int, error) {
+	t.trace(false, p)
+	return t.rw.Write(p)
+}
+
+// prefixConn returns the prefix before the data read from the connection (e.g. the bytes read ahead by the server)
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) == 0 {
+		return c.Conn.Read(b)
+	}
+
+	n := copy(b, c.prefix)
+	c.prefix = c.prefix[n:]
+
+	return n, nil
+}
+
+// Return the wrapped connection (see tcpConnOf)
+func (c *prefixConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,140 @@
+package socks5
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// bufferedRaw is the connection that buffers the writes till Flush
+type bufferedRaw struct {
+	net.Conn
+	w *bufio.Writer
+}
+
+func (c *bufferedRaw) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *bufferedRaw) Flush() error {
+	return c.w.Flush()
+}
+
+// Check, that nothing is received by c within d
+func nothingReceived(t *testing.T, c net.Conn, d time.Duration) {
+	t.Helper()
+
+	c.SetReadDeadline(time.Now().Add(d))
+	defer c.SetReadDeadline(time.Time{})
+
+	if n, _ := c.Read(make([]byte, 1)); n != 0 {
+		t.Fatal("the buffered data is sent before Flush")
+	}
+}
+
+func TestConnWriteMessageFlushes(t *testing.T) {
+	client, server := tcpPipe(t)
+	defer client.Close()
+	defer server.Close()
+
+	c := NewConn(&bufferedRaw{Conn: client, w: bufio.NewWriter(client)})
+
+	err := c.WriteMessage(testContext(t, 5*time.Second), &NegotiationReply{Method: MethodNotRequired})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	b := make([]byte, 2)
+	_, err = io.ReadFull(server, b)
+	if err != nil || b[0] != Version || b[1] != byte(MethodNotRequired) {
+		t.Fatalf("the message is received as %x: %v", b, err)
+	}
+}
+
+func TestConnFlush(t *testing.T) {
+	client, server := tcpPipe(t)
+	defer client.Close()
+	defer server.Close()
+
+	c := NewConn(&bufferedRaw{Conn: client, w: bufio.NewWriter(client)})
+
+	// data written to Raw directly is buffered till Flush
+	_, err := c.Raw().Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nothingReceived(t, server, 50*time.Millisecond)
+
+	err = c.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readExactly(t, server, "ping")
+}
+
+func TestConnFlushUnbuffered(t *testing.T) {
+	client, server := tcpPipe(t)
+	defer client.Close()
+	defer server.Close()
+
+	if err := NewConn(client).Flush(); err != nil {
+		t.Fatalf("Flush of the unbuffered connection: %v", err)
+	}
+}
+
+// closeCounter counts the closes of the raw connection
+type closeCounter struct {
+	net.Conn
+	closes int64
+}
+
+func (c *closeCounter) Close() error {
+	atomic.AddInt64(&c.closes, 1)
+	return c.Conn.Close()
+}
+
+func TestConnConcurrentClose(t *testing.T) {
+	client, server := tcpPipe(t)
+	defer server.Close()
+
+	raw := &closeCounter{Conn: client}
+	c := NewConn(raw)
+
+	if !c.Alive() {
+		t.Fatal("the new connection is not alive")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+			c.Close()
+		}()
+
+		go func() {
+			defer wg.Done()
+			c.Alive()
+		}()
+	}
+	wg.Wait()
+
+	if c.Alive() {
+		t.Error("the closed connection is alive")
+	}
+
+	if closes := atomic.LoadInt64(&raw.closes); closes != 1 {
+		t.Errorf("the raw connection is closed %v times", closes)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Errorf("the second Close: %v", err)
+	}
+}
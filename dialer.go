@@ -3,6 +3,7 @@ package socks5
 import (
 	"context"
 	"net"
+	"time"
 )
 
 type Dialer interface {
@@ -10,8 +11,16 @@ type Dialer interface {
 	DialContext(ctx context.Context, network, address string) (net.Conn, error)
 }
 
+const (
+	defaultDialTimeout = 30 * time.Second
+	defaultKeepAlive   = 30 * time.Second
+)
+
 var (
-	defaultDialer = &net.Dialer{}
+	defaultDialer = &net.Dialer{
+		Timeout:   defaultDialTimeout,
+		KeepAlive: defaultKeepAlive,
+	}
 )
 
 type SOCKSDialer struct {
@@ -33,6 +42,15 @@ func (d *SOCKSDialer) DialContext(ctx context.Context, network, address string)
 		panic("context must be non-nil")
 	}
 
+	if d.client.ResolveLocally {
+		resolved, err := resolveAddress(ctx, d.client.resolver(), address)
+		if err != nil {
+			return nil, err
+		}
+
+		address = resolved
+	}
+
 	switch network {
 	case "tcp":
 		return d.client.Connect(ctx, address)
@@ -50,3 +68,68 @@ func (d *SOCKSDialer) DialContext(ctx context.Context, network, address string)
 		return nil, ErrProtocol.Wrap(net.UnknownNetworkError(network), "unable to establish connection")
 	}
 }
+
+// Resolve the domain of the address locally with the resolver and return the address with the first IP address.
+// IP addresses are returned as is
+func resolveAddress(ctx context.Context, resolver *net.Resolver, address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", ErrProtocol.Wrap(err, "invalid address (%v)", address)
+	}
+
+	if net.ParseIP(host) != nil {
+		return address, nil
+	}
+
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", ErrProtocol.Wrap(err, "unable to resolve the domain (%v)", host)
+	}
+
+	if len(ips) == 0 {
+		return "", ErrProtocol.New("the domain (%v) has no IP addresses", host)
+	}
+
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+// LoggingDialer logs every dial made by the base dialer with the network, the address, the duration and the result
+type LoggingDialer struct {
+	base   Dialer
+	logger Logger
+}
+
+// Return the dialer logging the dials of base to logger.
+// If base is nil, the default dialer of the server is used. If logger is nil, the dials are not logged
+func NewLoggingDialer(base Dialer, logger Logger) *LoggingDialer {
+	if base == nil {
+		base = defaultDialer
+	}
+
+	if logger == nil {
+		logger = nopLogger{}
+	}
+
+	return &LoggingDialer{
+		base:   base,
+		logger: logger,
+	}
+}
+
+func (d *LoggingDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *LoggingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := d.base.DialContext(ctx, network, address)
+	elapsed := time.Since(start)
+
+	if err != nil {
+		d.logger.Infof("[DIAL] %v %v failed in %v: %v\n", network, address, elapsed, err)
+		return nil, err
+	}
+
+	d.logger.Infof("[DIAL] %v %v succeeded in %v (local %v)\n", network, address, elapsed, conn.LocalAddr())
+	return conn, nil
+}
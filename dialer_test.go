@@ -0,0 +1,137 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Dial address through the server with SOCKSDialer of the client and return the destination of the request received by the server
+func dialedDestination(t *testing.T, setup func(c *Client), address string) *Addr {
+	t.Helper()
+
+	dst := make(chan *Addr, 1)
+	_, addr := startServer(t, func(srv *Server) {
+		srv.OnRequest = func(ctx context.Context, conn *Conn, req *Request) (context.Context, error) {
+			dst <- req.Dst
+			return ctx, nil
+		}
+	})
+
+	client := NewClient(addr)
+	if setup != nil {
+		setup(client)
+	}
+
+	ctx := testContext(t, 5*time.Second)
+
+	// the destination could be unreachable at the resolved address, only the request matters
+	c, err := client.SOCKSDialer().DialContext(ctx, "tcp", address)
+	if err == nil {
+		defer c.Close()
+	}
+
+	select {
+	case d := <-dst:
+		return d
+
+	case <-ctx.Done():
+		t.Fatal("the request is not received")
+	}
+
+	return nil
+}
+
+func TestSOCKSDialerProxyDNS(t *testing.T) {
+	_, port, _ := net.SplitHostPort(startEcho(t))
+
+	dst := dialedDestination(t, nil, net.JoinHostPort("localhost", port))
+	if dst.Atyp != AddrDomain || dst.Host != "localhost" {
+		t.Fatalf("the domain is not sent to the proxy (%v)", dst)
+	}
+}
+
+func TestSOCKSDialerResolveLocally(t *testing.T) {
+	_, port, _ := net.SplitHostPort(startEcho(t))
+
+	dst := dialedDestination(t, func(c *Client) { c.ResolveLocally = true }, net.JoinHostPort("localhost", port))
+	if dst.Atyp == AddrDomain {
+		t.Fatalf("the domain is sent to the proxy (%v)", dst)
+	}
+}
+
+func TestSOCKSDialerResolveLocallyWithResolver(t *testing.T) {
+	_, port, _ := net.SplitHostPort(startEcho(t))
+
+	// the name is known only to the resolver of the dialer
+	resolver := startDNS(t, net.ParseIP("127.0.0.1"))
+
+	dst := dialedDestination(t, func(c *Client) {
+		c.Dialer = &net.Dialer{Resolver: resolver}
+		c.ResolveLocally = true
+	}, net.JoinHostPort("echo.test", port))
+
+	if dst.Atyp != AddrIPV4 || dst.Host != "127.0.0.1" {
+		t.Fatalf("the domain is not resolved by the resolver of the dialer (%v)", dst)
+	}
+}
+
+// Logger that collects the logged lines
+type recordingLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) log(format string, args ...any) {
+	l.mu.Lock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+	l.mu.Unlock()
+}
+
+func (l *recordingLogger) Debugf(format string, args ...any) { l.log(format, args...) }
+func (l *recordingLogger) Infof(format string, args ...any)  { l.log(format, args...) }
+func (l *recordingLogger) Errorf(format string, args ...any) { l.log(format, args...) }
+func (l *recordingLogger) ErrorT(err error)                  { l.log("%v", err) }
+
+// Return the logged lines
+func (l *recordingLogger) Lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]string(nil), l.lines...)
+}
+
+func TestLoggingDialer(t *testing.T) {
+	echo := startEcho(t)
+	logger := &recordingLogger{}
+
+	d := NewLoggingDialer(nil, logger)
+
+	c, err := d.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	_, err = d.DialContext(testContext(t, time.Second), "tcp", "127.0.0.1:1")
+	if err == nil {
+		t.Fatal("the dial to the closed port succeeded")
+	}
+
+	lines := logger.Lines()
+	if len(lines) != 2 || !strings.Contains(lines[0], "succeeded") || !strings.Contains(lines[1], "failed") {
+		t.Fatalf("logged lines: %q", lines)
+	}
+}
+
+func TestLoggingDialerNilLogger(t *testing.T) {
+	c, err := NewLoggingDialer(nil, nil).Dial("tcp", startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
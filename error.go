@@ -1,11 +1,26 @@
 package socks5
 
-import "github.com/joomcode/errorx"
+import (
+	"errors"
+	"syscall"
+
+	"github.com/joomcode/errorx"
+)
 
 var (
 	ErrSOCKS    = errorx.NewNamespace("socks5")
 	ErrProtocol = ErrSOCKS.NewType("protocol")
 	ErrConn     = ErrSOCKS.NewType("connection")
+
+	// ErrAssociationClosed is returned by UDPConn reads after the association is closed (e.g. the control connection is closed)
+	ErrAssociationClosed = ErrConn.NewSubtype("association_closed")
+
+	// ErrVersion is returned, if the peer does not speak SOCKS5 (e.g. an HTTP client connected to the proxy port)
+	ErrVersion = ErrProtocol.NewSubtype("version")
+
+	errInvalidHandshake = ErrProtocol.NewSubtype("invalid_handshake") // the negotiation request is not received or malformed (Server.RequireValidHandshake)
+
+	propHead = errorx.RegisterProperty("head") // first bytes of the message with the wrong version
 )
 
 // Error represents a SOCKS5 error
@@ -18,6 +33,31 @@ func (e *Error) Error() string {
 	return e.Cause.Error()
 }
 
+func (e *Error) Unwrap() error {
+	return e.Cause
+}
+
+// Return the reply code of the SOCKS error in the chain of err.
+// The causes of the errorx errors are checked too, though errors.Unwrap does not return them (errorx.Wrap).
+// false is returned, if err does not contain a SOCKS error
+func ReplyCodeOf(err error) (repType, bool) {
+	for err != nil {
+		var e *Error
+		if errors.As(err, &e) {
+			return e.Code, true
+		}
+
+		var ex *errorx.Error
+		if !errors.As(err, &ex) {
+			break
+		}
+
+		err = ex.Cause()
+	}
+
+	return RepSucceeded, false
+}
+
 func IsSOCKSError(err error) bool {
 	if err == nil {
 		return false
@@ -50,32 +90,20 @@ type errorContext struct {
 
 func (e *errorContext) Error() string {
 	var cause error
+	from, to := e.Conn.Raw().RemoteAddr(), e.Request.Dst
 
 	switch e.Code {
-	case RepServerFailure:
-		cause = ErrProtocol.New("general SOCKS server failure (%v -> %v)", e.Conn.Raw().RemoteAddr(), e.Request.Dst)
-
-	case RepConnNotAllowed:
-		cause = ErrProtocol.New("connection is not allowed by ruleset (%v -> %v)", e.Conn.Raw().RemoteAddr(), e.Request.Dst)
-
 	case RepNetworkUnreachable:
-		cause = ErrProtocol.New("network '%v' unreachable (%v - > %v)", e.Request.Dst.network, e.Conn.Raw().RemoteAddr(), e.Request.Dst)
-
-	case RepHostUnreachable:
-		cause = ErrProtocol.New("host unreachable (%v -> %v)", e.Conn.Raw().RemoteAddr(), e.Request.Dst)
-
-	case RepConnRefused:
-		cause = ErrProtocol.New("connection refused (%v -> %v)", e.Conn.Raw().RemoteAddr(), e.Request.Dst)
-
-	case RepTTLExpired:
-		cause = ErrProtocol.New("TTL Expired (%v -> %v)", e.Conn.Raw().RemoteAddr(), e.Request.Dst)
+		cause = ErrProtocol.New("network '%v' unreachable (%v -> %v)", to.network, from, to)
 
 	case RepCmdNotSupported:
-		cause = ErrProtocol.New("command '%v' is not supported (%v - > %v)", e.Request.Cmd, e.Conn.Raw().RemoteAddr(), e.Request.Dst)
+		cause = ErrProtocol.New("command '%v' is not supported (%v -> %v)", e.Request.Cmd, from, to)
 
 	case RepAddrNotSupported:
-		cause = ErrProtocol.New("address type '%v' is not supported (%v -> %v)", e.Request.Dst.Atyp, e.Conn.Raw().RemoteAddr(), e.Request.Dst)
+		cause = ErrProtocol.New("address type '%v' is not supported (%v -> %v)", to.Atyp, from, to)
 
+	default:
+		cause = ErrProtocol.New("%v (%v -> %v)", e.Code, from, to)
 	}
 
 	return cause.Error()
@@ -88,3 +116,16 @@ func makeErrorContext(conn *Conn, req *Request, code repType) *errorContext {
 		Code:    code,
 	}
 }
+
+// Choose the reply code for the error returned by the dialer
+func dialReply(err error) repType {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return RepConnRefused
+
+	case errors.Is(err, syscall.ENETUNREACH):
+		return RepNetworkUnreachable
+	}
+
+	return RepHostUnreachable
+}
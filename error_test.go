@@ -0,0 +1,76 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReplyCodeOf(t *testing.T) {
+	socksErr := SOCKSError(RepHostUnreachable, errors.New("unreachable"))
+
+	tests := []struct {
+		name string
+		err  error
+		code repType
+		ok   bool
+	}{
+		{"nil", nil, RepSucceeded, false},
+		{"plain error", errors.New("plain"), RepSucceeded, false},
+		{"SOCKS error", socksErr, RepHostUnreachable, true},
+		{"wrapped SOCKS error", fmt.Errorf("connect: %w", socksErr), RepHostUnreachable, true},
+		{"errorx wrapped SOCKS error", ErrConn.Wrap(socksErr, "connect"), RepHostUnreachable, true},
+		{"errorx wrapped twice", fmt.Errorf("dial: %w", ErrProtocol.Wrap(ErrConn.Wrap(socksErr, "connect"), "request")), RepHostUnreachable, true},
+		{"errorx wrapped plain error", ErrConn.Wrap(errors.New("plain"), "connect"), RepSucceeded, false},
+	}
+
+	for _, tt := range tests {
+		code, ok := ReplyCodeOf(tt.err)
+		if code != tt.code || ok != tt.ok {
+			t.Errorf("%v: got %v, %v", tt.name, code, ok)
+		}
+	}
+}
+
+func TestClientCommandRejectionIsSOCKSError(t *testing.T) {
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Rules = denyRules{}
+	})
+
+	client := NewClient(addr)
+
+	commands := map[string]func() error{
+		"CONNECT": func() error {
+			_, err := client.Connect(testContext(t, 5*time.Second), "192.0.2.1:80")
+			return err
+		},
+		"BIND": func() error {
+			_, err := client.Bind(testContext(t, 5*time.Second), "192.0.2.1:80", make(chan net.Addr, 1))
+			return err
+		},
+		"UDP ASSOCIATE": func() error {
+			_, err := client.UDP(testContext(t, 5*time.Second), "0.0.0.0:0")
+			return err
+		},
+		"SOCKSDialer": func() error {
+			_, err := client.SOCKSDialer().DialContext(testContext(t, 5*time.Second), "tcp", "192.0.2.1:80")
+			return err
+		},
+	}
+
+	for name, command := range commands {
+		err := command()
+
+		// the rejection is returned as *Error itself, not wrapped
+		e, ok := err.(*Error)
+		if !ok || e.Code != RepConnNotAllowed || !IsSOCKSError(err) {
+			t.Errorf("%v: %T %v", name, err, err)
+		}
+
+		if code, _ := ReplyCodeOf(err); code != RepConnNotAllowed {
+			t.Errorf("%v: the reply code is %v", name, code)
+		}
+	}
+}
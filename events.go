@@ -0,0 +1,97 @@
+package socks5
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+type eventType byte
+
+func (t eventType) String() string {
+	switch t {
+	case EventAccept:
+		return "accept"
+
+	case EventHandshake:
+		return "handshake"
+
+	case EventRequest:
+		return "request"
+
+	case EventReply:
+		return "reply"
+
+	case EventClose:
+		return "close"
+
+	case EventError:
+		return "error"
+	}
+
+	return "unknown event"
+}
+
+const (
+	EventAccept    eventType = iota + 1 // the connection is accepted
+	EventHandshake                      // the negotiation and the authentication are finished (Err is set on failure)
+	EventRequest                        // the request is read
+	EventReply                          // the reply is sent
+	EventClose                          // the connection is closed
+	EventError                          // the handshake or the transfer is failed
+
+	eventsBuffer = 256 // capacity of the events channel
+)
+
+// Event represents the server activity delivered by Server.Events
+type Event struct {
+	Type eventType
+	Time time.Time
+
+	SessionID string   // ID of the session (see Conn.SessionID)
+	Client    net.Addr // Remote address of the client
+	User      string   // Username of the authenticated client
+
+	Request *Request // Request of the session (nil, if the request is not read yet)
+	Reply   *Reply   // Reply sent to the client (EventReply only)
+	Err     error    // Error of EventError and failed EventHandshake
+}
+
+// Return the channel delivering the events of the server activity.
+//
+// The events are emitted only after the first call, all the calls return the same channel.
+// The channel is bounded, the events are dropped, if the consumer is slow (see Stats.DroppedEvents).
+// The channel is never closed
+func (srv *Server) Events() <-chan Event {
+	events := make(chan Event, eventsBuffer)
+	if srv.events.CompareAndSwap(nil, &events) {
+		return events
+	}
+
+	return *srv.events.Load()
+}
+
+// Send the event of the connection without blocking, if Server.Events is called
+func (srv *Server) emit(t eventType, c *Conn, req *Request, rep *Reply, err error) {
+	events := srv.events.Load()
+	if events == nil {
+		return
+	}
+
+	e := Event{
+		Type:      t,
+		Time:      time.Now(),
+		SessionID: c.SessionID(),
+		Client:    c.Raw().RemoteAddr(),
+		User:      c.User(),
+		Request:   req,
+		Reply:     rep,
+		Err:       err,
+	}
+
+	select {
+	case *events <- e:
+	default:
+		atomic.AddInt64(&srv.stats.droppedEvents, 1)
+	}
+}
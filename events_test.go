@@ -0,0 +1,132 @@
+package socks5
+
+import (
+	"testing"
+	"time"
+)
+
+// Return the events received till the close of the session
+func sessionEvents(t *testing.T, events <-chan Event) []Event {
+	t.Helper()
+
+	var received []Event
+	timeout := time.After(5 * time.Second)
+
+	for {
+		select {
+		case e := <-events:
+			received = append(received, e)
+			if e.Type == EventClose {
+				return received
+			}
+
+		case <-timeout:
+			t.Fatalf("the close event is not received: %v", received)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	srv, addr := startServer(t, nil)
+	events := srv.Events()
+
+	if srv.Events() != events {
+		t.Fatal("Events returned another channel")
+	}
+
+	echo := startEcho(t)
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkEcho(t, c, "ping")
+	c.Close()
+
+	received := sessionEvents(t, events)
+
+	want := []eventType{EventAccept, EventHandshake, EventRequest, EventReply, EventClose}
+	if len(received) != len(want) {
+		t.Fatalf("the events of the session: %v", received)
+	}
+
+	for i, e := range received {
+		if e.Type != want[i] {
+			t.Errorf("event %v: got %v, want %v", i, e.Type, want[i])
+		}
+
+		if e.SessionID == "" || e.SessionID != received[0].SessionID {
+			t.Errorf("the %v event has the session ID %q", e.Type, e.SessionID)
+		}
+
+		if e.Client == nil || e.Time.IsZero() || e.Err != nil {
+			t.Errorf("the %v event: %+v", e.Type, e)
+		}
+	}
+
+	if req := received[2].Request; req == nil || req.Cmd != CmdConnect || req.Dst.String() != echo {
+		t.Errorf("the request of the event: %v", req)
+	}
+
+	if rep := received[3].Reply; rep == nil || rep.Rep != RepSucceeded {
+		t.Errorf("the reply of the event: %v", rep)
+	}
+}
+
+func TestEventsError(t *testing.T) {
+	srv, addr := startServer(t, func(srv *Server) {
+		srv.Rules = denyRules{}
+	})
+	events := srv.Events()
+
+	_, err := NewClient(addr).Connect(testContext(t, 5*time.Second), "192.0.2.1:80")
+	if err == nil {
+		t.Fatal("the denied request succeeded")
+	}
+
+	var request, failure *Event
+	for _, e := range sessionEvents(t, events) {
+		e := e
+		switch e.Type {
+		case EventRequest:
+			request = &e
+
+		case EventError:
+			failure = &e
+		}
+	}
+
+	if request == nil || request.Request.Dst.String() != "192.0.2.1:80" {
+		t.Fatalf("the request event: %+v", request)
+	}
+
+	if failure == nil {
+		t.Fatal("the error event is not received")
+	}
+
+	if code, _ := ReplyCodeOf(failure.Err); code != RepConnNotAllowed {
+		t.Fatalf("the error event: %+v", failure)
+	}
+}
+
+func TestEventsDropped(t *testing.T) {
+	srv, addr := startServer(t, func(srv *Server) {
+		srv.Rules = denyRules{}
+	})
+
+	// nobody consumes the events
+	srv.Events()
+
+	for i := 0; i < eventsBuffer/4; i++ {
+		NewClient(addr).Connect(testContext(t, 5*time.Second), "192.0.2.1:80")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.Stats().DroppedEvents == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if srv.Stats().DroppedEvents == 0 {
+		t.Fatal("the dropped events are not counted")
+	}
+}
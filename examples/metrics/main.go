@@ -0,0 +1,21 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/osf4/socks5"
+	"github.com/osf4/socks5/metrics"
+)
+
+func main() {
+	srv := socks5.NewServer(":1080")
+
+	// The server activity is available at http://localhost:8080/metrics
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler(srv))
+
+	go http.ListenAndServe(":8080", mux)
+
+	log.Fatal(srv.ListenAndServe())
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"log"
+
+	"github.com/osf4/socks5"
+)
+
+func main() {
+	srv := socks5.NewServer(":1080")
+
+	// The server is closed on Ctrl+C or SIGTERM
+	err := srv.ListenAndServeWithSignals()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
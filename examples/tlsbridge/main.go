@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+
+	"github.com/osf4/socks5"
+)
+
+// Establish a TLS session to the destinations at port 443, so clients can speak plain HTTP to HTTPS servers
+func wrap(ctx context.Context, conn net.Conn, req *socks5.Request) (net.Conn, error) {
+	if req.Dst.Port != 443 {
+		return conn, nil
+	}
+
+	upstream := tls.Client(conn, &tls.Config{ServerName: req.Dst.Host})
+
+	err := upstream.HandshakeContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return upstream, nil
+}
+
+func main() {
+	srv := socks5.NewServer(":1080")
+	srv.WrapUpstream = wrap
+
+	log.Fatal(srv.ListenAndServe())
+}
@@ -34,7 +34,7 @@ func main() {
 
 	go read()
 
-	udp, err := client.UDP(context.TODO(), ":5000")
+	udp, err := client.UDP(context.TODO(), "0.0.0.0:0")
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -5,6 +5,7 @@ go 1.20
 require (
 	github.com/gookit/slog v0.5.4
 	github.com/joomcode/errorx v1.1.1
+	golang.org/x/net v0.18.0
 )
 
 require (
@@ -0,0 +1,80 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Establish the tunnel to addr through the HTTP proxy conn is connected to (HTTP CONNECT method).
+//
+// The connection is closed, if the context is done before the proxy replies
+func httpConnect(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+
+		case <-done:
+		}
+	}()
+
+	_, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	if err != nil {
+		return nil, ErrProtocol.Wrap(err, "unable to send the HTTP CONNECT request")
+	}
+
+	rd := bufio.NewReader(conn)
+
+	status, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, ErrProtocol.Wrap(err, "unable to read the HTTP CONNECT reply")
+	}
+
+	// status line: HTTP/1.1 200 Connection established
+	fields := strings.Fields(status)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/") {
+		return nil, ErrProtocol.New("malformed HTTP CONNECT reply (%q)", strings.TrimSpace(status))
+	}
+
+	if fields[1] != "200" {
+		return nil, ErrProtocol.New("HTTP proxy refused the tunnel to %v (%v)", addr, strings.TrimSpace(status))
+	}
+
+	// skip the headers
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, ErrProtocol.Wrap(err, "unable to read the HTTP CONNECT reply")
+		}
+
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	if rd.Buffered() > 0 {
+		return &bufferedConn{conn, rd}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn is a connection, whose first bytes are already read into the buffer
+type bufferedConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.rd.Read(p)
+}
@@ -0,0 +1,120 @@
+package socks5
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Start the fake HTTP CONNECT proxy replying with status. The tunnels are established only with status 200.
+// Return the address of the proxy and the channel receiving the requested tunnel targets
+func startHTTPProxy(t *testing.T, status string) (string, chan string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	targets := make(chan string, 4)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+
+				req, err := http.ReadRequest(bufio.NewReader(c))
+				if err != nil {
+					return
+				}
+
+				if req.Method != http.MethodConnect {
+					io.WriteString(c, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+					return
+				}
+				targets <- req.Host
+
+				io.WriteString(c, "HTTP/1.1 "+status+"\r\nProxy-Agent: test\r\n\r\n")
+				if status[:3] != "200" {
+					return
+				}
+
+				upstream, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+
+				go io.Copy(upstream, c)
+				io.Copy(c, upstream)
+			}()
+		}
+	}()
+
+	return l.Addr().String(), targets
+}
+
+func TestClientHTTPProxy(t *testing.T) {
+	_, addr := startServer(t, nil)
+	httpProxy, targets := startHTTPProxy(t, "200 Connection established")
+
+	client := NewClient(addr)
+	client.HTTPProxy = httpProxy
+
+	c, err := client.Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c, "ping")
+
+	if target := <-targets; target != addr {
+		t.Fatalf("the tunnel is requested to %v instead of the SOCKS server %v", target, addr)
+	}
+}
+
+func TestClientHTTPProxyRefused(t *testing.T) {
+	_, addr := startServer(t, nil)
+	httpProxy, _ := startHTTPProxy(t, "403 Forbidden")
+
+	client := NewClient(addr)
+	client.HTTPProxy = httpProxy
+
+	_, err := client.Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err == nil || !strings.Contains(err.Error(), "403 Forbidden") {
+		t.Fatalf("the refused tunnel: %v", err)
+	}
+}
+
+func TestHTTPConnectBufferedBytes(t *testing.T) {
+	client, proxy := tcpPipe(t)
+	defer client.Close()
+	defer proxy.Close()
+
+	// the proxy sends the first bytes of the tunnel with the reply
+	go func() {
+		http.ReadRequest(bufio.NewReader(proxy))
+		io.WriteString(proxy, "HTTP/1.1 200 OK\r\n\r\nhello")
+	}()
+
+	tunnel, err := httpConnect(testContext(t, 5*time.Second), client, "127.0.0.1:1080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 5)
+	_, err = io.ReadFull(tunnel, b)
+	if err != nil || string(b) != "hello" {
+		t.Fatalf("the tunnel read %q: %v", b, err)
+	}
+}
@@ -0,0 +1,137 @@
+package socks5
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// limiter represents a token bucket. Tokens are added with the rate (tokens per second) up to the burst
+type limiter struct {
+	mu sync.Mutex
+
+	rate  float64
+	burst float64
+
+	tokens float64
+	last   time.Time
+}
+
+// Return a limiter with the rate (tokens per second). The burst equals to one second of the rate (at least 1)
+func newLimiter(rate float64) *limiter {
+	burst := math.Max(1, math.Ceil(rate))
+
+	return &limiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// True, if a token is available. The token is consumed
+func (l *limiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	if l.tokens < 1 {
+		return false
+	}
+
+	l.tokens--
+	return true
+}
+
+// Wait till a token is available and consume it.
+//
+// Error is returned, if the context is done before the token is available
+func (l *limiter) Wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		l.refill(time.Now())
+
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mu.Unlock()
+
+			return nil
+		}
+
+		wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+
+		case <-timer.C:
+		}
+	}
+}
+
+// Add the tokens accumulated since the last refill
+func (l *limiter) refill(now time.Time) {
+	elapsed := now.Sub(l.last).Seconds()
+	l.last = now
+
+	l.tokens = math.Min(l.burst, l.tokens+elapsed*l.rate)
+}
+
+// keyLimiter limits the number of simultaneous users of every key (e.g. CONNECTs to the same destination).
+// Keys without users are removed, so the map does not grow with transient keys
+type keyLimiter struct {
+	mu    sync.Mutex
+	count map[string]int
+	gen   int // incremented on Reset, so the keys acquired before Reset are not released twice
+}
+
+func newKeyLimiter() *keyLimiter {
+	return &keyLimiter{
+		count: make(map[string]int),
+	}
+}
+
+// Acquire the key, if it has less than max users.
+// The returned function releases the key, it could be called several times
+func (l *keyLimiter) Acquire(key string, max int) (release func(), ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.count[key] >= max {
+		return nil, false
+	}
+	l.count[key]++
+
+	gen := l.gen
+
+	var once sync.Once
+	return func() { once.Do(func() { l.release(key, gen) }) }, true
+}
+
+func (l *keyLimiter) release(key string, gen int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if gen != l.gen {
+		return
+	}
+
+	l.count[key]--
+	if l.count[key] <= 0 {
+		delete(l.count, key)
+	}
+}
+
+// Forget all the users of the keys
+func (l *keyLimiter) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.count = make(map[string]int)
+	l.gen++
+}
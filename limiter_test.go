@@ -0,0 +1,92 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Return the number of the keys in l
+func (l *keyLimiter) size() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.count)
+}
+
+func TestKeyLimiterDropsReleasedKeys(t *testing.T) {
+	l := newKeyLimiter()
+
+	var releases []func()
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("192.0.2.%v:%v", i%256, 1000+i)
+		for j := 0; j < 2; j++ {
+			release, ok := l.Acquire(key, 2)
+			if !ok {
+				t.Fatalf("%v is not acquired", key)
+			}
+
+			releases = append(releases, release)
+		}
+	}
+
+	if l.size() != 1000 {
+		t.Fatalf("%v keys are counted, expected 1000", l.size())
+	}
+
+	for _, release := range releases {
+		release()
+		release()
+	}
+
+	if l.size() != 0 {
+		t.Fatalf("%v keys are left after all the releases", l.size())
+	}
+}
+
+func TestKeyLimiterReleaseAfterReset(t *testing.T) {
+	l := newKeyLimiter()
+
+	release, _ := l.Acquire("a", 1)
+	l.Reset()
+	release()
+
+	if l.size() != 0 {
+		t.Fatalf("%v keys are left after the release of the reset key", l.size())
+	}
+
+	_, ok := l.Acquire("a", 1)
+	if !ok {
+		t.Fatal("the key is not acquired after Reset")
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	l := newLimiter(20)
+
+	start := time.Now()
+	for i := 0; i < 30; i++ {
+		err := l.Wait(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the burst of 20 tokens and 10 tokens refilled at the rate of 20 per second
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("30 tokens are taken in %v", elapsed)
+	}
+}
+
+func TestLimiterWaitCancel(t *testing.T) {
+	l := newLimiter(1)
+	l.Wait(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := l.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("the wait with the expired context: %v", err)
+	}
+}
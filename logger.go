@@ -1,18 +1,32 @@
 package socks5
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/gookit/slog"
 )
 
-// Logger represents an interface for server loggers
+// Logger represents an interface for server loggers.
+// Debug lines are logged only by the loggers that implement Debugf(format string, args ...any) as well
 type Logger interface {
 	Infof(format string, args ...any)
 	Errorf(format string, args ...any)
 	ErrorT(err error)
 }
 
+// debugger is implemented by the loggers that support the debug level
+type debugger interface {
+	Debugf(format string, args ...any)
+}
+
+// Log the line at the debug level, if the logger supports it
+func debugf(logger Logger, format string, args ...any) {
+	if d, ok := logger.(debugger); ok {
+		d.Debugf(format, args...)
+	}
+}
+
 func defaultLogger() Logger {
 	logger := slog.NewSugaredLogger(os.Stdout, slog.DebugLevel)
 
@@ -29,6 +43,12 @@ type switchLogger struct {
 	Logger Logger
 }
 
+func (l *switchLogger) Debugf(format string, args ...any) {
+	if l.Enable {
+		debugf(l.Logger, format, args...)
+	}
+}
+
 func (l *switchLogger) Infof(format string, args ...any) {
 	if l.Enable {
 		l.Logger.Infof(format, args...)
@@ -46,3 +66,37 @@ func (l *switchLogger) ErrorT(err error) {
 		l.Logger.ErrorT(err)
 	}
 }
+
+// prefixLogger represents the logger that prefixes every line (e.g. with the session ID)
+type prefixLogger struct {
+	prefix string
+	Logger Logger
+}
+
+func newPrefixLogger(logger Logger, prefix string) *prefixLogger {
+	return &prefixLogger{prefix: prefix, Logger: logger}
+}
+
+func (l *prefixLogger) Debugf(format string, args ...any) {
+	debugf(l.Logger, l.prefix+format, args...)
+}
+
+func (l *prefixLogger) Infof(format string, args ...any) {
+	l.Logger.Infof(l.prefix+format, args...)
+}
+
+func (l *prefixLogger) Errorf(format string, args ...any) {
+	l.Logger.Errorf(l.prefix+format, args...)
+}
+
+func (l *prefixLogger) ErrorT(err error) {
+	l.Logger.ErrorT(fmt.Errorf("%s%w", l.prefix, err))
+}
+
+// nopLogger represents the logger that discards all the lines
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...any) {}
+func (nopLogger) Infof(format string, args ...any)  {}
+func (nopLogger) Errorf(format string, args ...any) {}
+func (nopLogger) ErrorT(err error)                  {}
@@ -0,0 +1,118 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPrefixLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	l := newPrefixLogger(logger, "[id 127.0.0.1:5000] ")
+
+	l.Debugf("debug %v\n", 1)
+	l.Infof("info %v\n", 2)
+	l.Errorf("error %v\n", 3)
+	l.ErrorT(errors.New("failure"))
+
+	want := []string{
+		"[id 127.0.0.1:5000] debug 1\n",
+		"[id 127.0.0.1:5000] info 2\n",
+		"[id 127.0.0.1:5000] error 3\n",
+		"[id 127.0.0.1:5000] failure",
+	}
+
+	lines := logger.Lines()
+	if len(lines) != len(want) {
+		t.Fatalf("the logged lines: %q", lines)
+	}
+
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("line %v: got %q, want %q", i, lines[i], want[i])
+		}
+	}
+}
+
+// infoLogger implements only the methods of Logger, it has no debug level
+type infoLogger struct {
+	rec *recordingLogger
+}
+
+func (l infoLogger) Infof(format string, args ...any)  { l.rec.Infof(format, args...) }
+func (l infoLogger) Errorf(format string, args ...any) { l.rec.Errorf(format, args...) }
+func (l infoLogger) ErrorT(err error)                  { l.rec.ErrorT(err) }
+
+func TestLoggerWithoutDebug(t *testing.T) {
+	logger := &recordingLogger{}
+	l := &switchLogger{Enable: true, Logger: newPrefixLogger(infoLogger{logger}, "[id] ")}
+
+	l.Debugf("debug %v\n", 1)
+	l.Infof("info %v\n", 2)
+
+	if lines := logger.Lines(); len(lines) != 1 || lines[0] != "[id] info 2\n" {
+		t.Fatalf("the logged lines: %q", lines)
+	}
+}
+
+func TestAuthMethodsNotLogged(t *testing.T) {
+	logger := &recordingLogger{}
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Logger = &switchLogger{Enable: true, Logger: logger}
+	})
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c, "ping")
+
+	if lines := linesWith(logger, "offers the authentication methods"); len(lines) != 0 {
+		t.Fatalf("the methods are logged without LogAuthMethods: %q", lines)
+	}
+}
+
+func TestConnLoggerInHooks(t *testing.T) {
+	logger := &recordingLogger{}
+	prefixes := make(chan string, 1)
+
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Logger = &switchLogger{Enable: true, Logger: logger}
+		srv.LogAuthMethods = true
+		srv.OnRequest = func(ctx context.Context, conn *Conn, req *Request) (context.Context, error) {
+			prefixes <- "[" + conn.SessionID() + " " + conn.Raw().RemoteAddr().String() + "] "
+			conn.Logger().Infof("the hook line\n")
+
+			return ctx, nil
+		}
+	})
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	prefix := <-prefixes
+	if lines := linesWith(logger, prefix+"the hook line\n"); len(lines) != 1 {
+		t.Fatalf("the hook line is not prefixed with %q: %q", prefix, logger.Lines())
+	}
+
+	// the lines of the server are prefixed as well
+	if lines := linesWith(logger, prefix+"The client offers the authentication methods"); len(lines) != 1 {
+		t.Fatalf("the server lines are not prefixed with %q: %q", prefix, logger.Lines())
+	}
+}
+
+func TestClientConnLogger(t *testing.T) {
+	c, s := tcpPipe(t)
+	defer c.Close()
+	defer s.Close()
+
+	if _, ok := NewConn(c).Logger().(nopLogger); !ok {
+		t.Fatal("the client connection logs the lines")
+	}
+}
@@ -2,6 +2,7 @@ package socks5
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 
 	"github.com/osf4/socks5/internal/errio"
@@ -38,7 +39,7 @@ func (c cmdType) Network() string {
 
 // True, if c is a valid command (CONNECT, BIND or UDP ASSOCIATE)
 func (c cmdType) Valid() bool {
-	return c < 0x04
+	return c >= CmdConnect && c <= CmdUDP
 }
 
 const (
@@ -50,6 +51,7 @@ const (
 // Request represents requests sent by the client
 type Request struct {
 	Cmd cmdType // CMD field
+	Rsv byte    // RSV field (must be 0x00)
 	Dst *Addr   // DST.ADDR field (with ATYP and PORT)
 }
 
@@ -57,7 +59,7 @@ func (r *Request) Write(wr io.Writer) error {
 	w := bufio.NewWriterSize(wr, 3+r.Dst.Len())
 
 	// VER CMD RSV fields
-	w.Write([]byte{Version, byte(r.Cmd), 0x00})
+	w.Write([]byte{Version, byte(r.Cmd), r.Rsv})
 
 	// ATYP, DST.ADDR, PORT field
 	err := r.Dst.Write(w)
@@ -84,6 +86,7 @@ func (r *Request) Read(rd io.Reader) error {
 	}
 
 	r.Cmd = cmdType(b[1])
+	r.Rsv = b[2]
 	if !r.Cmd.Valid() {
 		return SOCKSError(RepCmdNotSupported, ErrProtocol.New("unknown command (%v)", r.Cmd))
 	}
@@ -96,6 +99,39 @@ func (r *Request) Read(rd io.Reader) error {
 
 type repType byte
 
+func (r repType) String() string {
+	switch r {
+	case RepSucceeded:
+		return "succeeded"
+
+	case RepServerFailure:
+		return "general SOCKS server failure"
+
+	case RepConnNotAllowed:
+		return "connection not allowed by ruleset"
+
+	case RepNetworkUnreachable:
+		return "network unreachable"
+
+	case RepHostUnreachable:
+		return "host unreachable"
+
+	case RepConnRefused:
+		return "connection refused"
+
+	case RepTTLExpired:
+		return "TTL expired"
+
+	case RepCmdNotSupported:
+		return "command not supported"
+
+	case RepAddrNotSupported:
+		return "address type not supported"
+	}
+
+	return fmt.Sprintf("unknown reply code (%#02x)", byte(r))
+}
+
 // True, if r is a valid reply (RepSucceeded, RepServerFailure...)
 func (r repType) Valid() bool {
 	return r < 0x09
@@ -116,6 +152,7 @@ const (
 // Reply represents replies sent by the server
 type Reply struct {
 	Rep repType // REP field
+	Rsv byte    // RSV field (must be 0x00, non-zero values could be used to debug interoperability)
 	Bnd *Addr   // BND.ADDR field (with ATYP and PORT)
 }
 
@@ -123,7 +160,7 @@ func (r *Reply) Write(wr io.Writer) error {
 	w := bufio.NewWriterSize(wr, 3+r.Bnd.Len())
 
 	// VER, REP, RSV fields
-	w.Write([]byte{Version, byte(r.Rep), 0x00})
+	w.Write([]byte{Version, byte(r.Rep), r.Rsv})
 
 	// ATYP, BND.ADDR, PORT fields
 	err := r.Bnd.Write(w)
@@ -150,8 +187,9 @@ func (r *Reply) Read(rd io.Reader) error {
 	}
 
 	r.Rep = repType(b[1])
+	r.Rsv = b[2]
 	if !r.Rep.Valid() {
-		return ErrProtocol.New("unknown reply code (%v)", r.Rep)
+		return ErrProtocol.New("unknown reply code (%#02x)", byte(r.Rep))
 	}
 
 	r.Bnd = new(Addr)
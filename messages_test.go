@@ -0,0 +1,84 @@
+package socks5
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRequestReplyRSVRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+
+	req := &Request{Cmd: CmdConnect, Rsv: 0xFF, Dst: ParseAddr("tcp", "127.0.0.1:80")}
+	err := req.Write(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := &Request{}
+	err = read.Read(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if read.Rsv != 0xFF {
+		t.Fatalf("request RSV: got %#02x, want 0xff", read.Rsv)
+	}
+
+	rep := &Reply{Rep: RepSucceeded, Rsv: 0xFF, Bnd: ParseAddr("tcp", "127.0.0.1:80")}
+	err = rep.Write(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readRep := &Reply{}
+	err = readRep.Read(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if readRep.Rsv != 0xFF {
+		t.Fatalf("reply RSV: got %#02x, want 0xff", readRep.Rsv)
+	}
+}
+
+func TestRepTypeString(t *testing.T) {
+	tests := []struct {
+		rep  repType
+		text string
+	}{
+		{RepSucceeded, "succeeded"},
+		{RepServerFailure, "general SOCKS server failure"},
+		{RepConnNotAllowed, "connection not allowed by ruleset"},
+		{RepNetworkUnreachable, "network unreachable"},
+		{RepHostUnreachable, "host unreachable"},
+		{RepConnRefused, "connection refused"},
+		{RepTTLExpired, "TTL expired"},
+		{RepCmdNotSupported, "command not supported"},
+		{RepAddrNotSupported, "address type not supported"},
+		{0x09, "unknown reply code (0x09)"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.rep.String(); got != tt.text {
+			t.Errorf("%#02x: got %q, want %q", byte(tt.rep), got, tt.text)
+		}
+
+		if tt.rep.Valid() == strings.HasPrefix(tt.text, "unknown") {
+			t.Errorf("%#02x: Valid() is %v", byte(tt.rep), tt.rep.Valid())
+		}
+	}
+}
+
+func TestErrorContextUsesRepTypeString(t *testing.T) {
+	client, server := tcpPipe(t)
+	defer client.Close()
+	defer server.Close()
+
+	req := &Request{Cmd: CmdConnect, Dst: ParseAddr("tcp", "127.0.0.1:80")}
+	err := makeErrorContext(NewConn(server), req, RepConnRefused)
+
+	if !strings.Contains(err.Error(), RepConnRefused.String()) {
+		t.Fatalf("the error %q does not contain the reply code text", err.Error())
+	}
+}
@@ -0,0 +1,23 @@
+// Package metrics exposes the activity of a SOCKS5 server over HTTP
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/osf4/socks5"
+)
+
+// Return a handler that writes srv.Stats() as JSON.
+//
+// The handler could be mounted on any mux (e.g. mux.Handle("/metrics", metrics.Handler(srv)))
+func Handler(srv *socks5.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewEncoder(w).Encode(srv.Stats())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
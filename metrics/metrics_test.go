@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/osf4/socks5"
+)
+
+// Start the SOCKS5 server and the echo server. Return the server and the addresses of both
+func startServers(t *testing.T) (srv *socks5.Server, addr, echo string) {
+	t.Helper()
+
+	srv = socks5.NewServer("127.0.0.1:0")
+	srv.DisableLogger()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	<-srv.Ready()
+
+	el, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { el.Close() })
+
+	go func() {
+		for {
+			c, err := el.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	return srv, l.Addr().String(), el.Addr().String()
+}
+
+// Return the stats served by the handler
+func serveStats(t *testing.T, srv *socks5.Server) socks5.Stats {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	Handler(srv).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("the response: %v %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	var stats socks5.Stats
+	err := json.NewDecoder(rec.Body).Decode(&stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return stats
+}
+
+func TestHandler(t *testing.T) {
+	srv, addr, echo := startServers(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := socks5.NewClient(addr).Connect(ctx, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = c.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = io.ReadFull(c, make([]byte, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the bytes are counted after the echo is written to the client
+	deadline := time.Now().Add(5 * time.Second)
+	stats := serveStats(t, srv)
+	for stats.Bytes < 8 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		stats = serveStats(t, srv)
+	}
+
+	if stats.ActiveConns != 1 || stats.Bytes != 8 || stats.Commands["CONNECT"] != 1 || stats.Errors != 0 {
+		t.Fatalf("the served stats: %+v", stats)
+	}
+}
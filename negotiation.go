@@ -19,6 +19,10 @@ type negotiator struct {
 //
 // Error is returned, if the context is done or the server does not support the selected authentication methods
 func (n *negotiator) Request(ctx context.Context, c *Conn, methods []authMethod) (authMethod, error) {
+	if c.HandshakeComplete() {
+		return MethodNoAcceptable, ErrProtocol.New("duplicate negotiation on the connection (%v)", c.Raw().RemoteAddr())
+	}
+
 	req := &NegotiationRequest{
 		Methods: methods,
 	}
@@ -41,16 +45,39 @@ func (n *negotiator) Request(ctx context.Context, c *Conn, methods []authMethod)
 	return rep.Method, nil
 }
 
-// Send the negotiation reply to the client.
+// Read the negotiation request and send the negotiation reply to the client.
 //
 // Error is returned, if the context is done
 func (n *negotiator) Reply(ctx context.Context, c *Conn, method authMethod) error {
+	req, err := n.ReadRequest(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	return n.WriteReply(ctx, c, req, method)
+}
+
+// Read the negotiation request sent by the client.
+//
+// Error is returned, if the context is done or the request is malformed
+func (n *negotiator) ReadRequest(ctx context.Context, c *Conn) (*NegotiationRequest, error) {
+	if c.HandshakeComplete() {
+		return nil, ErrProtocol.New("duplicate negotiation on the connection (%v)", c.Raw().RemoteAddr())
+	}
+
 	req := &NegotiationRequest{}
 	err := c.ReadMessage(ctx, req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	return req, nil
+}
+
+// Send the negotiation reply to the client that sent req.
+//
+// Error is returned, if the context is done or the selected method is not offered by the client
+func (n *negotiator) WriteReply(ctx context.Context, c *Conn, req *NegotiationRequest, method authMethod) error {
 	rep := &NegotiationReply{}
 	if !isMethodSupported(method, req.Methods) {
 		rep.Method = MethodNoAcceptable
@@ -60,9 +87,7 @@ func (n *negotiator) Reply(ctx context.Context, c *Conn, method authMethod) erro
 	}
 
 	rep.Method = method
-	err = c.WriteMessage(ctx, rep)
-
-	return err
+	return c.WriteMessage(ctx, rep)
 }
 
 // True, if methods contains the selected authentication method
@@ -101,9 +126,12 @@ func (r *NegotiationRequest) Read(rd io.Reader) error {
 
 	b := make([]byte, 2)
 	erd.Read(b)
+	if err := erd.Error(); err != nil {
+		return ErrProtocol.Wrap(err, "unable to read the negotiation request")
+	}
 
 	if ver := b[0]; !isSOCKS5(ver) {
-		return ErrProtocol.New("invalid protocol version (%v)", ver)
+		return ErrVersion.New("invalid protocol version (%v)", ver).WithProperty(propHead, b)
 	}
 
 	nmethods := b[1]
@@ -115,6 +143,11 @@ func (r *NegotiationRequest) Read(rd io.Reader) error {
 	return erd.Wrap(ErrProtocol, "unable to read the negotiation request")
 }
 
+// True, if b is exactly one negotiation request (VER, NMETHODS and NMETHODS methods)
+func isNegotiationRequest(b []byte) bool {
+	return len(b) >= 2 && isSOCKS5(b[0]) && b[1] != 0 && len(b) == 2+int(b[1])
+}
+
 // NegotiationReply represents negotiation replies sent by the server
 type NegotiationReply struct {
 	Method authMethod
@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/subtle"
+	"fmt"
 	"io"
 
 	"github.com/osf4/socks5/internal/errio"
@@ -11,18 +13,39 @@ import (
 
 type statusType byte
 
+func (s statusType) String() string {
+	switch s {
+	case StatusOK:
+		return "success"
+
+	case StatusFailure:
+		return "failure"
+	}
+
+	return fmt.Sprintf("unknown status (%#02x)", byte(s))
+}
+
 const (
 	subnegotiationVersion = 0x01
+	maxCredentialLength   = 255 // maximum length of the username and the password (RFC 1929)
 
-	statusOK      statusType = 0x00
-	statusFailure statusType = 0x01
+	StatusOK      statusType = 0x00
+	StatusFailure statusType = 0x01
 )
 
 type PassAuth struct {
 	user, pass []byte
+	store      CredentialStore // credentials of the users (nil, if the single pair is used)
+
+	// Verify the credentials sent by the client instead of the static ones (e.g. against a database or LDAP).
+	// If false is returned, the client gets StatusFailure. If an error is returned, the client gets StatusFailure
+	// and the error is logged by the server
+	Verify func(ctx context.Context, user, pass string) (bool, error)
 }
 
-// PassAuth represents the password authentication method
+// PassAuth represents the password authentication method.
+// The username and the password must not be longer than 255 bytes, otherwise the authentication request fails
+// (NewPassAuthErr rejects them at once)
 func NewPassAuth(user, password string) *PassAuth {
 	return &PassAuth{
 		user: []byte(user),
@@ -30,6 +53,42 @@ func NewPassAuth(user, password string) *PassAuth {
 	}
 }
 
+// Return the password authentication method like NewPassAuth does.
+// Error is returned, if the username or the password is longer than 255 bytes
+func NewPassAuthErr(user, password string) (*PassAuth, error) {
+	err := checkCredentials([]byte(user), []byte(password))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewPassAuth(user, password), nil
+}
+
+// Return the password authentication method that verifies the credentials of many users with the store.
+// It is used only by the server, cause the client has no credentials to send
+func NewPassAuthStore(store CredentialStore) *PassAuth {
+	return &PassAuth{
+		store: store,
+	}
+}
+
+// CredentialStore verifies the credentials sent by the clients
+type CredentialStore interface {
+	Verify(user, pass []byte) bool // True, if the password of the user is valid
+}
+
+// CredentialMap is a CredentialStore that maps usernames to passwords
+type CredentialMap map[string]string
+
+func (m CredentialMap) Verify(user, pass []byte) bool {
+	password, ok := m[string(user)]
+	if !ok {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(password), pass) == 1
+}
+
 func (a *PassAuth) Request(ctx context.Context, c *Conn) error {
 	req := &PassRequest{
 		uname:  a.user,
@@ -47,8 +106,8 @@ func (a *PassAuth) Request(ctx context.Context, c *Conn) error {
 		return err
 	}
 
-	if rep.Status != statusOK {
-		return ErrProtocol.New("username or password is wrong")
+	if rep.Status != StatusOK {
+		return ErrProtocol.New("username or password is wrong (status: %v)", rep.Status)
 	}
 
 	return nil
@@ -63,35 +122,73 @@ func (a *PassAuth) Reply(ctx context.Context, c *Conn) error {
 	}
 
 	rep := &PassReply{}
-	if !a.validCredentials(a.user, a.pass) {
-		rep.Status = statusFailure
 
+	valid, err := a.verify(ctx, req.uname, req.passwd)
+	if err != nil || !valid {
+		rep.Status = StatusFailure
 		c.WriteMessage(ctx, rep)
+
+		if err != nil {
+			return ErrProtocol.Wrap(err, "unable to verify the credentials of %v", c.Raw().RemoteAddr())
+		}
+
+		return ErrProtocol.New("username or password is wrong (%v)", c.Raw().RemoteAddr())
 	}
 
-	rep.Status = statusOK
+	rep.Status = StatusOK
 	err = c.WriteMessage(ctx, rep)
+	if err != nil {
+		return err
+	}
+	c.user = string(req.uname)
 
-	return err
+	return nil
 }
 
 func (a *PassAuth) Method() authMethod {
 	return MethodPassword
 }
 
-// True, if uname && passwd == a.user && a.pass
+// Verify the credentials with a.Verify, if it is set. Otherwise the static credentials or a.store are used
+func (a *PassAuth) verify(ctx context.Context, uname, passwd []byte) (bool, error) {
+	if a.Verify != nil {
+		return a.Verify(ctx, string(uname), string(passwd))
+	}
+
+	return a.validCredentials(uname, passwd), nil
+}
+
+// True, if uname && passwd == a.user && a.pass or the credentials are verified by a.store
 func (a *PassAuth) validCredentials(uname, passwd []byte) bool {
+	if a.store != nil {
+		return a.store.Verify(uname, passwd)
+	}
+
 	userValid := bytes.Equal(a.user, uname)
 	passValid := bytes.Equal(a.pass, passwd)
 
 	return userValid && passValid
 }
 
+// Return the error, if the username or the password can not be sent (longer than 255 bytes)
+func checkCredentials(uname, passwd []byte) error {
+	if len(uname) > maxCredentialLength || len(passwd) > maxCredentialLength {
+		return ErrProtocol.New("username (%v bytes) or password (%v bytes) is longer than %v bytes", len(uname), len(passwd), maxCredentialLength)
+	}
+
+	return nil
+}
+
 type PassRequest struct {
 	uname, passwd []byte
 }
 
 func (r *PassRequest) Write(wr io.Writer) error {
+	err := checkCredentials(r.uname, r.passwd)
+	if err != nil {
+		return err
+	}
+
 	w := bufio.NewWriterSize(wr, 3+len(r.uname)+len(r.passwd))
 	ulen, plen := byte(len(r.uname)), byte(len(r.passwd))
 
@@ -103,7 +200,7 @@ func (r *PassRequest) Write(wr io.Writer) error {
 	w.WriteByte(plen)
 	w.Write(r.passwd)
 
-	err := w.Flush()
+	err = w.Flush()
 	if err != nil {
 		return ErrProtocol.Wrap(err, "unable to write the password authentication request")
 	}
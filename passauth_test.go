@@ -0,0 +1,378 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+// Return both ends of a loopback TCP connection
+func tcpPipe(t testing.TB) (client, server net.Conn) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err = l.Accept()
+	if err != nil {
+		client.Close()
+		t.Fatal(err)
+	}
+
+	return client, server
+}
+
+// Run the password authentication between a client with the given credentials and a server expecting user:pass.
+// Return the errors of the client and the server sides
+func passAuthExchange(t *testing.T, user, pass string) (clientErr, serverErr error) {
+	t.Helper()
+
+	clientErr, serverErr, _ = passAuthWith(t, NewPassAuth("user", "pass"), user, pass)
+	return clientErr, serverErr
+}
+
+// Run the password authentication between a client with the given credentials and the server side auth.
+// Return the errors of the client and the server sides and the username of the server connection
+func passAuthWith(t *testing.T, auth *PassAuth, user, pass string) (clientErr, serverErr error, authenticated string) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cr, sr := tcpPipe(t)
+	defer cr.Close()
+	defer sr.Close()
+
+	server := NewConn(sr)
+
+	res := make(chan error, 1)
+	go func() {
+		res <- auth.Reply(ctx, server)
+	}()
+
+	clientErr = NewPassAuth(user, pass).Request(ctx, NewConn(cr))
+	serverErr = <-res
+
+	return clientErr, serverErr, server.User()
+}
+
+func TestPassAuthValidCredentials(t *testing.T) {
+	clientErr, serverErr := passAuthExchange(t, "user", "pass")
+	if clientErr != nil {
+		t.Fatalf("client: %v", clientErr)
+	}
+
+	if serverErr != nil {
+		t.Fatalf("server: %v", serverErr)
+	}
+}
+
+func TestPassAuthRejectsWrongCredentials(t *testing.T) {
+	tests := []struct {
+		name       string
+		user, pass string
+	}{
+		{"wrong password", "user", "wrong"},
+		{"wrong username", "other", "pass"},
+		{"empty credentials", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientErr, serverErr := passAuthExchange(t, tt.user, tt.pass)
+			if clientErr == nil {
+				t.Error("client: the authentication succeeded with wrong credentials")
+			}
+
+			if serverErr == nil {
+				t.Error("server: the authentication succeeded with wrong credentials")
+			}
+		})
+	}
+}
+
+func TestPassRequestLengthLimits(t *testing.T) {
+	long := strings.Repeat("u", 256)
+	longest := strings.Repeat("u", 255)
+
+	tests := []struct {
+		name       string
+		user, pass string
+		valid      bool
+	}{
+		{"256-byte username", long, "pass", false},
+		{"256-byte password", "user", long, false},
+		{"255-byte credentials", longest, longest, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+
+			err := (&PassRequest{uname: []byte(tt.user), passwd: []byte(tt.pass)}).Write(&b)
+			if !tt.valid {
+				if !errorx.IsOfType(err, ErrProtocol) || b.Len() != 0 {
+					t.Fatalf("the request is written (%v bytes): %v", b.Len(), err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := &PassRequest{}
+			err = req.Read(&b)
+			if err != nil || string(req.uname) != tt.user || string(req.passwd) != tt.pass {
+				t.Fatalf("the request is read as %q:%q: %v", req.uname, req.passwd, err)
+			}
+		})
+	}
+}
+
+func TestPassAuthLongUsername(t *testing.T) {
+	cr, sr := tcpPipe(t)
+	defer cr.Close()
+	defer sr.Close()
+
+	err := NewPassAuth(strings.Repeat("u", 256), "pass").Request(testContext(t, 5*time.Second), NewConn(cr))
+	if !errorx.IsOfType(err, ErrProtocol) {
+		t.Fatalf("the request with the 256-byte username: %v", err)
+	}
+
+	// nothing is sent to the server
+	sr.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, _ := sr.Read(make([]byte, 1)); n != 0 {
+		t.Fatal("the malformed request is sent")
+	}
+}
+
+func TestNewPassAuthErr(t *testing.T) {
+	long := strings.Repeat("u", 256)
+	longest := strings.Repeat("u", 255)
+
+	tests := []struct {
+		name       string
+		user, pass string
+		valid      bool
+	}{
+		{"255-byte credentials", longest, longest, true},
+		{"256-byte username", long, "pass", false},
+		{"256-byte password", "user", long, false},
+	}
+
+	for _, tt := range tests {
+		auth, err := NewPassAuthErr(tt.user, tt.pass)
+		if tt.valid && (err != nil || auth == nil) {
+			t.Errorf("%v: %v", tt.name, err)
+		}
+
+		if !tt.valid && (auth != nil || !errorx.IsOfType(err, ErrProtocol)) {
+			t.Errorf("%v: the credentials are accepted: %v", tt.name, err)
+		}
+	}
+}
+
+func TestStatusTypeString(t *testing.T) {
+	tests := []struct {
+		status statusType
+		text   string
+	}{
+		{StatusOK, "success"},
+		{StatusFailure, "failure"},
+		{statusType(0x05), "unknown status (0x05)"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.status.String(); got != tt.text {
+			t.Errorf("%#02x: got %q, want %q", byte(tt.status), got, tt.text)
+		}
+	}
+}
+
+func TestPassAuthFailureStatus(t *testing.T) {
+	clientErr, _ := passAuthExchange(t, "user", "wrong")
+	if clientErr == nil || !strings.Contains(clientErr.Error(), "status: failure") {
+		t.Fatalf("the status is not in the error: %v", clientErr)
+	}
+}
+
+func TestPassAuthStore(t *testing.T) {
+	auth := NewPassAuthStore(CredentialMap{"alice": "a1", "bob": "b2"})
+	if auth.Method() != MethodPassword {
+		t.Fatalf("the method is %v", auth.Method())
+	}
+
+	tests := []struct {
+		user, pass string
+		valid      bool
+	}{
+		{"alice", "a1", true},
+		{"bob", "b2", true},
+		{"alice", "b2", false},
+		{"carol", "a1", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		clientErr, serverErr, user := passAuthWith(t, auth, tt.user, tt.pass)
+		if valid := clientErr == nil && serverErr == nil; valid != tt.valid {
+			t.Errorf("%v:%v: client %v, server %v", tt.user, tt.pass, clientErr, serverErr)
+		}
+
+		if tt.valid && user != tt.user {
+			t.Errorf("%v is authenticated as %q", tt.user, user)
+		}
+	}
+}
+
+func TestPassAuthStoreServer(t *testing.T) {
+	users := CredentialMap{"alice": "a1", "bob": "b2"}
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Auth = NewPassAuthStore(users)
+	})
+	echo := startEcho(t)
+
+	for user, pass := range users {
+		client := NewClient(addr)
+		client.Auth = NewPassAuth(user, pass)
+
+		c, err := client.Connect(testContext(t, 5*time.Second), echo)
+		if err != nil {
+			t.Fatalf("%v: %v", user, err)
+		}
+
+		checkEcho(t, c, "ping")
+		c.Close()
+	}
+
+	client := NewClient(addr)
+	client.Auth = NewPassAuth("alice", "b2")
+
+	if _, err := client.Connect(testContext(t, 5*time.Second), echo); err == nil {
+		t.Fatal("the password of the other user is accepted")
+	}
+}
+
+func TestPassAuthVerify(t *testing.T) {
+	auth := NewPassAuth("user", "pass")
+	auth.Verify = func(ctx context.Context, user, pass string) (bool, error) {
+		return user == "alice" && pass == "a1", nil
+	}
+
+	tests := []struct {
+		user, pass string
+		valid      bool
+	}{
+		{"alice", "a1", true},
+		{"alice", "wrong", false},
+		{"user", "pass", false}, // the static credentials are not used
+	}
+
+	for _, tt := range tests {
+		clientErr, serverErr, user := passAuthWith(t, auth, tt.user, tt.pass)
+		if valid := clientErr == nil && serverErr == nil; valid != tt.valid {
+			t.Errorf("%v:%v: client %v, server %v", tt.user, tt.pass, clientErr, serverErr)
+		}
+
+		if !tt.valid && (clientErr == nil || !strings.Contains(clientErr.Error(), "status: failure")) {
+			t.Errorf("%v:%v: the client does not get the failure status: %v", tt.user, tt.pass, clientErr)
+		}
+
+		if tt.valid && user != tt.user {
+			t.Errorf("%v is authenticated as %q", tt.user, user)
+		}
+	}
+}
+
+type verifyKey struct{}
+
+func TestPassAuthVerifyContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ctx = context.WithValue(ctx, verifyKey{}, "value")
+
+	got := make(chan interface{}, 1)
+	auth := NewPassAuth("", "")
+	auth.Verify = func(ctx context.Context, user, pass string) (bool, error) {
+		got <- ctx.Value(verifyKey{})
+		return true, nil
+	}
+
+	cr, sr := tcpPipe(t)
+	defer cr.Close()
+	defer sr.Close()
+
+	res := make(chan error, 1)
+	go func() {
+		res <- auth.Reply(ctx, NewConn(sr))
+	}()
+
+	err := NewPassAuth("alice", "a1").Request(ctx, NewConn(cr))
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+
+	if err := <-res; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+
+	if value := <-got; value != "value" {
+		t.Fatalf("Verify got the context without the value: %v", value)
+	}
+}
+
+func TestPassAuthVerifyError(t *testing.T) {
+	auth := NewPassAuth("user", "pass")
+	auth.Verify = func(ctx context.Context, user, pass string) (bool, error) {
+		return true, errors.New("the directory is unavailable")
+	}
+
+	clientErr, serverErr, _ := passAuthWith(t, auth, "user", "pass")
+	if clientErr == nil || !strings.Contains(clientErr.Error(), "status: failure") {
+		t.Fatalf("the client does not get the failure status: %v", clientErr)
+	}
+
+	if serverErr == nil || !strings.Contains(serverErr.Error(), "the directory is unavailable") {
+		t.Fatalf("the error of Verify is not returned: %v", serverErr)
+	}
+
+	// the server logs the error
+	logger := &recordingLogger{}
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Auth = auth
+		srv.Logger = &switchLogger{Enable: true, Logger: logger}
+	})
+
+	client := NewClient(addr)
+	client.Auth = NewPassAuth("user", "pass")
+
+	if _, err := client.Connect(testContext(t, 5*time.Second), startEcho(t)); err == nil {
+		t.Fatal("the client is authenticated, though Verify failed")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(linesWith(logger, "the directory is unavailable")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(linesWith(logger, "the directory is unavailable")) == 0 {
+		t.Fatalf("the error of Verify is not logged: %q", logger.Lines())
+	}
+}
@@ -0,0 +1,313 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Rules represents a ruleset that validates requests sent by the client
+type Rules interface {
+	// Return true, if the request is allowed.
+	// Otherwise the reply code that is sent to the client is returned.
+	// The username of the client is available with UserFromContext(ctx),
+	// the resolver the server dials the domains with is available with ResolverFromContext(ctx).
+	//
+	// CONNECT domains are checked again with every address they are resolved to.
+	// UDP ASSOCIATE is checked with DST.ADDR of the request (the address of the client) and with the destination of every datagram
+	// (DatagramFromContext(ctx) is true), the rejected datagrams are dropped
+	Allow(ctx context.Context, cmd cmdType, dst *Addr) (bool, repType)
+}
+
+type userKey struct{}
+
+type datagramKey struct{}
+
+type resolverKey struct{}
+
+const ruleLookupTimeout = 5 * time.Second // timeout of the DNS lookups made by the rules
+
+// Return the username of the client the request is sent by (see Conn.User).
+// The context is passed to Rules.Allow
+func UserFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+func contextWithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// Return the resolver the server resolves the domains of the requests with (net.DefaultResolver, if it is not set).
+// The context is passed to Rules.Allow
+func ResolverFromContext(ctx context.Context) *net.Resolver {
+	resolver, _ := ctx.Value(resolverKey{}).(*net.Resolver)
+	if resolver == nil {
+		return net.DefaultResolver
+	}
+
+	return resolver
+}
+
+func contextWithResolver(ctx context.Context, resolver *net.Resolver) context.Context {
+	return context.WithValue(ctx, resolverKey{}, resolver)
+}
+
+// True, if Rules.Allow checks the destination of a UDP datagram, not the UDP ASSOCIATE request
+func DatagramFromContext(ctx context.Context) bool {
+	datagram, _ := ctx.Value(datagramKey{}).(bool)
+	return datagram
+}
+
+// Return the context the datagrams of the association are checked with.
+// It keeps the values of ctx, but not its deadline and cancellation, cause the association outlives the request
+func contextWithDatagram(ctx context.Context) context.Context {
+	return context.WithValue(valueContext{ctx}, datagramKey{}, true)
+}
+
+// valueContext keeps the values of the parent context, but it is never done
+type valueContext struct {
+	context.Context
+}
+
+func (valueContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (valueContext) Done() <-chan struct{}       { return nil }
+func (valueContext) Err() error                  { return nil }
+
+// CommandACL maps usernames to the commands they are allowed to send ("alice" -> CONNECT; "bob" -> CONNECT, UDP ASSOCIATE).
+//
+// Requests of unknown users are rejected with RepConnNotAllowed, forbidden commands are rejected with RepCmdNotSupported.
+// Unauthenticated clients are matched by the empty username
+type CommandACL map[string][]cmdType
+
+func (acl CommandACL) Allow(ctx context.Context, cmd cmdType, dst *Addr) (bool, repType) {
+	commands, ok := acl[UserFromContext(ctx)]
+	if !ok {
+		return false, RepConnNotAllowed
+	}
+
+	for _, allowed := range commands {
+		if allowed == cmd {
+			return true, RepSucceeded
+		}
+	}
+
+	return false, RepCmdNotSupported
+}
+
+// HostMatcher rejects requests by the destination hostname (RepConnNotAllowed is sent).
+//
+// Hostnames are matched case-insensitively. The matcher must not be modified while the server is running
+type HostMatcher struct {
+	ReverseLookup bool // Resolve IP destinations to hostnames before matching
+
+	exact    map[string]struct{}
+	suffixes []string
+	patterns []*regexp.Regexp
+}
+
+func NewHostMatcher() *HostMatcher {
+	return &HostMatcher{
+		exact: make(map[string]struct{}),
+	}
+}
+
+// Reject the host ("ads.example.com")
+func (m *HostMatcher) AddExact(host string) {
+	m.exact[normalizeHost(host)] = struct{}{}
+}
+
+// Reject the domain and all its subdomains ("*.doubleclick.net", ".doubleclick.net" or "doubleclick.net")
+func (m *HostMatcher) AddSuffix(suffix string) {
+	suffix = strings.TrimPrefix(suffix, "*")
+	suffix = strings.TrimPrefix(suffix, ".")
+
+	m.suffixes = append(m.suffixes, normalizeHost(suffix))
+}
+
+// Reject the hosts matching the regular expression.
+//
+// Error is returned, if expr can not be compiled
+func (m *HostMatcher) AddRegexp(expr string) error {
+	re, err := regexp.Compile("(?i)" + expr)
+	if err != nil {
+		return err
+	}
+
+	m.patterns = append(m.patterns, re)
+	return nil
+}
+
+// True, if the host is rejected by the matcher
+func (m *HostMatcher) Match(host string) bool {
+	host = normalizeHost(host)
+
+	if _, ok := m.exact[host]; ok {
+		return true
+	}
+
+	for _, suffix := range m.suffixes {
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+
+	for _, re := range m.patterns {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *HostMatcher) Allow(ctx context.Context, cmd cmdType, dst *Addr) (bool, repType) {
+	// DST.ADDR of UDP ASSOCIATE is the address of the client, the destinations are checked per datagram
+	if cmd == CmdUDP && !DatagramFromContext(ctx) {
+		return true, RepSucceeded
+	}
+
+	if dst.Atyp == AddrDomain {
+		return m.allow(dst.Host)
+	}
+
+	if !m.ReverseLookup {
+		return true, RepSucceeded
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ruleLookupTimeout)
+	defer cancel()
+
+	names, err := ResolverFromContext(ctx).LookupAddr(ctx, dst.Host)
+	if err != nil {
+		return true, RepSucceeded
+	}
+
+	for _, name := range names {
+		if ok, code := m.allow(name); !ok {
+			return ok, code
+		}
+	}
+
+	return true, RepSucceeded
+}
+
+func (m *HostMatcher) allow(host string) (bool, repType) {
+	if m.Match(host) {
+		return false, RepConnNotAllowed
+	}
+
+	return true, RepSucceeded
+}
+
+// Lower-case the host and remove the trailing dot ("Example.COM." -> "example.com")
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// CIDRRules allows or rejects requests by the IP address of the destination.
+//
+// Destinations in the deny list are rejected with RepConnNotAllowed. If the allow list is not empty,
+// destinations out of the list are rejected too. Domains are resolved and all their addresses must be allowed.
+// UDP ASSOCIATE requests are allowed, the destinations of their datagrams are checked instead
+type CIDRRules struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// Return the rules allowing the networks of allow and rejecting the networks of deny ("10.0.0.0/8", "192.168.1.1").
+// An empty allow list allows all the destinations that are not denied.
+//
+// Error is returned, if a network can not be parsed
+func NewCIDRRules(allow, deny []string) (*CIDRRules, error) {
+	r := &CIDRRules{}
+
+	var err error
+
+	r.allow, err = parseNets(allow)
+	if err != nil {
+		return nil, err
+	}
+
+	r.deny, err = parseNets(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *CIDRRules) Allow(ctx context.Context, cmd cmdType, dst *Addr) (bool, repType) {
+	// DST.ADDR of UDP ASSOCIATE is the address of the client, not the destination
+	if cmd == CmdUDP && !DatagramFromContext(ctx) {
+		return true, RepSucceeded
+	}
+
+	if dst.Atyp != AddrDomain {
+		return r.allowIP(net.ParseIP(dst.Host))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ruleLookupTimeout)
+	defer cancel()
+
+	ips, err := ResolverFromContext(ctx).LookupIPAddr(ctx, dst.Host)
+	if err != nil || len(ips) == 0 {
+		return false, RepHostUnreachable
+	}
+
+	for _, ip := range ips {
+		if ok, code := r.allowIP(ip.IP); !ok {
+			return ok, code
+		}
+	}
+
+	return true, RepSucceeded
+}
+
+func (r *CIDRRules) allowIP(ip net.IP) (bool, repType) {
+	if containsIP(r.deny, ip) {
+		return false, RepConnNotAllowed
+	}
+
+	if len(r.allow) != 0 && !containsIP(r.allow, ip) {
+		return false, RepConnNotAllowed
+	}
+
+	return true, RepSucceeded
+}
+
+// True, if one of the networks contains ip
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Parse the networks in CIDR notation. A single IP address is parsed as the network of one address
+func parseNets(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * len(ipBytes(ip))
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, ErrProtocol.Wrap(err, "invalid network (%v)", cidr)
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
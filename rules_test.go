@@ -0,0 +1,331 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHostMatcher(t *testing.T) {
+	m := NewHostMatcher()
+	m.AddExact("ads.example.com")
+	m.AddSuffix("*.doubleclick.net")
+
+	err := m.AddRegexp(`^tracker[0-9]+\.`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host    string
+		blocked bool
+	}{
+		{"ads.example.com", true},
+		{"ADS.Example.COM.", true},
+		{"www.example.com", false},
+		{"doubleclick.net", true},
+		{"stats.g.DoubleClick.net", true},
+		{"notdoubleclick.net", false},
+		{"tracker42.example.org", true},
+		{"Tracker7.Example.org", true},
+		{"mytracker42.example.org", false},
+	}
+
+	for _, tt := range tests {
+		if got := m.Match(tt.host); got != tt.blocked {
+			t.Errorf("%v: matched %v, expected %v", tt.host, got, tt.blocked)
+		}
+
+		ok, code := m.Allow(context.Background(), CmdConnect, &Addr{Atyp: AddrDomain, Host: tt.host, Port: 443})
+		if ok == tt.blocked || (tt.blocked && code != RepConnNotAllowed) {
+			t.Errorf("%v: allowed %v with %v", tt.host, ok, code)
+		}
+	}
+}
+
+func TestHostMatcherInvalidRegexp(t *testing.T) {
+	if NewHostMatcher().AddRegexp("(") == nil {
+		t.Fatal("the invalid expression is added")
+	}
+}
+
+func TestHostMatcherIPDestination(t *testing.T) {
+	m := NewHostMatcher()
+	m.AddSuffix("localhost")
+
+	ok, _ := m.Allow(context.Background(), CmdConnect, ParseAddr("tcp", "127.0.0.1:80"))
+	if !ok {
+		t.Fatal("the IP destination is matched without ReverseLookup")
+	}
+}
+
+func TestHostMatcherServer(t *testing.T) {
+	m := NewHostMatcher()
+	m.AddSuffix("blocked.test")
+
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Rules = m
+	})
+
+	_, err := NewClient(addr).Connect(testContext(t, 5*time.Second), "www.blocked.test:80")
+	if code, _ := ReplyCodeOf(err); code != RepConnNotAllowed {
+		t.Fatalf("the blocked host: %v", err)
+	}
+}
+
+func TestCIDRRules(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow, deny []string
+		dst         string
+		allowed     bool
+	}{
+		{"no lists", nil, nil, "192.0.2.1:80", true},
+		{"denied network", nil, []string{"192.0.2.0/24"}, "192.0.2.1:80", false},
+		{"denied address", nil, []string{"192.0.2.1"}, "192.0.2.1:80", false},
+		{"other address", nil, []string{"192.0.2.1"}, "192.0.2.2:80", true},
+		{"allowed network", []string{"10.0.0.0/8"}, nil, "10.1.2.3:443", true},
+		{"out of the allow list", []string{"10.0.0.0/8"}, nil, "192.0.2.1:80", false},
+		{"denied in the allowed network", []string{"10.0.0.0/8"}, []string{"10.0.0.1"}, "10.0.0.1:80", false},
+		{"denied IPv6", nil, []string{"2001:db8::/32"}, "[2001:db8::1]:80", false},
+		{"allowed IPv6", []string{"2001:db8::/32"}, nil, "[2001:db8::1]:80", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewCIDRRules(tt.allow, tt.deny)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ok, code := r.Allow(context.Background(), CmdConnect, ParseAddr("tcp", tt.dst))
+			if ok != tt.allowed {
+				t.Fatalf("%v allowed: %v (%v)", tt.dst, ok, code)
+			}
+
+			if !ok && code != RepConnNotAllowed {
+				t.Fatalf("%v is rejected with %v", tt.dst, code)
+			}
+		})
+	}
+}
+
+func TestCIDRRulesInvalidNetwork(t *testing.T) {
+	if _, err := NewCIDRRules([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Error("the invalid allowed network is parsed")
+	}
+
+	if _, err := NewCIDRRules(nil, []string{"not a network"}); err == nil {
+		t.Error("the invalid denied network is parsed")
+	}
+}
+
+func TestCIDRRulesServer(t *testing.T) {
+	echo := startEcho(t)
+
+	allow, err := NewCIDRRules([]string{"127.0.0.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deny, err := NewCIDRRules(nil, []string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, allowAddr := startServer(t, func(srv *Server) { srv.Rules = allow })
+	_, denyAddr := startServer(t, func(srv *Server) { srv.Rules = deny })
+
+	c, err := NewClient(allowAddr).Connect(testContext(t, 5*time.Second), echo)
+	if err != nil {
+		t.Fatalf("the allowed destination: %v", err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c, "ping")
+
+	_, err = NewClient(denyAddr).Connect(testContext(t, 5*time.Second), echo)
+	if code, _ := ReplyCodeOf(err); code != RepConnNotAllowed {
+		t.Fatalf("the denied destination: %v", err)
+	}
+}
+
+// Rules that allow all the domains and check the IP destinations with CIDRRules,
+// so the domain is allowed, whatever it is resolved to at the request check
+type domainRules struct {
+	*CIDRRules
+}
+
+func (r domainRules) Allow(ctx context.Context, cmd cmdType, dst *Addr) (bool, repType) {
+	if dst.Atyp == AddrDomain {
+		return true, RepSucceeded
+	}
+
+	return r.CIDRRules.Allow(ctx, cmd, dst)
+}
+
+func TestCIDRRulesResolvedAddresses(t *testing.T) {
+	echo := startEcho(t)
+	_, port, _ := net.SplitHostPort(echo)
+
+	deny, err := NewCIDRRules(nil, []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the echo server listens at the denied address, nobody listens at the allowed one
+	resolver := startDNS(t, net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1"))
+
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Dialer = &net.Dialer{Timeout: time.Second, Resolver: resolver}
+		srv.Rules = domainRules{deny}
+	})
+
+	_, err = NewClient(addr).Connect(testContext(t, 5*time.Second), net.JoinHostPort("rebind.test", port))
+	if code, _ := ReplyCodeOf(err); code != RepConnNotAllowed {
+		t.Fatalf("the domain resolved to the denied address: %v", err)
+	}
+}
+
+func TestCIDRRulesCustomDialer(t *testing.T) {
+	echo := startEcho(t)
+	_, port, _ := net.SplitHostPort(echo)
+
+	deny, err := NewCIDRRules(nil, []string{"127.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dialer := &recordingDialer{addrs: make(chan string, 1)}
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Dialer = dialer
+		srv.Rules = domainRules{deny}
+	})
+
+	_, err = NewClient(addr).Connect(testContext(t, 5*time.Second), net.JoinHostPort("localhost", port))
+	if code, _ := ReplyCodeOf(err); code != RepConnNotAllowed {
+		t.Fatalf("the connection to the denied address: %v", err)
+	}
+
+	if dialed := <-dialer.addrs; dialed != net.JoinHostPort("localhost", port) {
+		t.Fatalf("the custom dialer got %v", dialed)
+	}
+}
+
+func TestCIDRRulesUDP(t *testing.T) {
+	echo, _ := startUDPEcho(t)
+
+	tests := []struct {
+		name        string
+		allow, deny []string
+		relayed     bool
+	}{
+		{"allow list", []string{"127.0.0.1"}, nil, true},
+		{"out of the allow list", []string{"10.0.0.0/8"}, nil, false},
+		{"deny list", nil, []string{"127.0.0.1"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := NewCIDRRules(tt.allow, tt.deny)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, addr := startServer(t, func(srv *Server) { srv.Rules = rules })
+
+			// the association is allowed, the destinations of the datagrams are checked
+			c, err := NewClient(addr).UDP(testContext(t, 5*time.Second), "0.0.0.0:0")
+			if err != nil {
+				t.Fatalf("UDP ASSOCIATE: %v", err)
+			}
+			defer c.Close()
+
+			_, err = c.WriteTo([]byte("ping"), echo.LocalAddr())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+
+			b := make([]byte, 64)
+			n, _, err := c.ReadFrom(b)
+			if relayed := err == nil && string(b[:n]) == "ping"; relayed != tt.relayed {
+				t.Fatalf("the datagram is relayed: %v (%v)", relayed, err)
+			}
+		})
+	}
+}
+
+func TestCIDRRulesDialerResolver(t *testing.T) {
+	echo := startEcho(t)
+	_, port, _ := net.SplitHostPort(echo)
+
+	allow, err := NewCIDRRules([]string{"127.0.0.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the domain is known to the resolver of the dialer only
+	resolver := startDNS(t, net.ParseIP("127.0.0.1"))
+
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Dialer = &net.Dialer{Timeout: time.Second, Resolver: resolver}
+		srv.Rules = allow
+	})
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), net.JoinHostPort("echo.test", port))
+	if err != nil {
+		t.Fatalf("the domain is not resolved with the resolver of the dialer: %v", err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c, "ping")
+}
+
+// Rules counting the checks of the datagrams
+type datagramCounter struct {
+	checks int64
+}
+
+func (r *datagramCounter) Allow(ctx context.Context, cmd cmdType, dst *Addr) (bool, repType) {
+	if DatagramFromContext(ctx) {
+		atomic.AddInt64(&r.checks, 1)
+	}
+
+	return true, RepSucceeded
+}
+
+func TestUDPRulesCachedByDestination(t *testing.T) {
+	echo, _ := startUDPEcho(t)
+	rules := &datagramCounter{}
+
+	_, addr := startServer(t, func(srv *Server) { srv.Rules = rules })
+
+	c, err := NewClient(addr).UDP(testContext(t, 5*time.Second), "0.0.0.0:0")
+	if err != nil {
+		t.Fatalf("UDP ASSOCIATE: %v", err)
+	}
+	defer c.Close()
+
+	b := make([]byte, 64)
+	for i := 0; i < 3; i++ {
+		_, err = c.WriteTo([]byte("ping"), echo.LocalAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.SetReadDeadline(time.Now().Add(time.Second))
+
+		n, _, err := c.ReadFrom(b)
+		if err != nil || string(b[:n]) != "ping" {
+			t.Fatalf("the datagram is not relayed: %q (%v)", b[:n], err)
+		}
+	}
+
+	if checks := atomic.LoadInt64(&rules.checks); checks != 1 {
+		t.Fatalf("the destination is checked %v times", checks)
+	}
+}
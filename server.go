@@ -2,11 +2,22 @@ package socks5
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"math/rand"
 	"net"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/joomcode/errorx"
 )
 
 // Server represents SOCKS5 server
@@ -14,18 +25,190 @@ type Server struct {
 	Addr      string // The addr the server is listening at
 	UDPBuffer int    // Buffer size that is used by UDP connections
 
-	Auth    Auth          // Authentication method
+	Auth    Auth          // Authentication method that is used, if Server.Auths is empty. Use Server.SetAuth to change it while the server is running
+	Auths   []Auth        // Authentication methods offered to the clients, the first one supported by the client is chosen in the client's order. Use Server.SetAuths to change them while the server is running. Including NoAuth makes the other methods optional for every client (see Server.AuthsFor)
 	Dialer  Dialer        // Dialer that is used to make new network connections
+	Rules   Rules         // Ruleset that validates requests (nil allows all the requests)
 	Timeout time.Duration // Timeout during which the server must handle the request. If the timeout is expired, the connection is closed
 	Logger  *switchLogger
 
-	listener net.Listener
+	ReadBufferSize  int  // Size of the socket receive buffer of the client and upstream TCP connections (0 leaves the OS default)
+	WriteBufferSize int  // Size of the socket send buffer of the client and upstream TCP connections (0 leaves the OS default)
+	NoDelay         bool // Disable Nagle's algorithm on the client and upstream TCP connections. Set false to batch small writes (bulk transfers)
+
+	Transferer Transferer // Copies the data of CONNECT and BIND connections in each direction (nil uses CopyTransferer)
+
+	TLSConfig *tls.Config // If TLSConfig is not nil, the clients must connect to the server over TLS (see Server.SetSecureTLS)
+
+	DialTimeout        time.Duration // Timeout for dialing the destination. The shorter of DialTimeout and Timeout is applied (0 leaves only the timeout of Dialer, the default one times out in 30 seconds)
+	MaxSessionDuration time.Duration // Maximum duration of the data transfer. If the duration is expired, the session is closed (0 disables the limit)
+
+	// Time the data in flight of a CONNECT or BIND session is relayed for, when MaxSessionDuration is expired.
+	// The client is not read anymore and the destination gets EOF, then the rest of its data is sent to the client,
+	// till the destination closes the connection or the timeout is expired (0 closes the session at once)
+	SessionFlushTimeout time.Duration
+	IdleTimeout         time.Duration // CONNECT and BIND sessions are closed, if no data is transferred in either direction during the timeout (0 or a negative value disables the timeout)
+
+	// Timeouts of the handshake phases. If a phase is not finished in time, the connection is closed.
+	// HandshakeTimeout is applied to the phases, whose own timeout is 0 (0 disables the timeout)
+	NegotiationTimeout time.Duration // Timeout for reading the negotiation request and writing the reply
+	AuthTimeout        time.Duration // Timeout for the authentication subnegotiation
+	RequestTimeout     time.Duration // Timeout for reading the request (defaultRequestTimeout is used, if neither of RequestTimeout, HandshakeTimeout and Timeout is set)
+	HandshakeTimeout   time.Duration // Default timeout of all the phases above
+
+	LogOnlyFailures bool // Log only failed requests and transfers, successful sessions are not logged
+	LogAuthMethods  bool // Log the authentication methods offered by every client at the debug level
+	TraceWire       bool // Log the hex bytes of every negotiation, request and reply message at the debug level (high overhead). Only the length of the authentication messages is logged, they carry the credentials
+
+	MaxConns                int     // Maximum number of simultaneously served connections. Excess connections are accepted and closed at once (0 or a negative value disables the limit)
+	MaxConcurrentHandshakes int     // Maximum number of connections in the handshake phase. Excess connections wait to be accepted (0 or a negative value disables the limit). The phases without a timeout time out in limitedHandshakeTimeout then
+	AcceptRateLimit         float64 // Maximum number of connections accepted per second. Excess connections wait to be accepted (0 disables the limit)
+	MaxBindListeners        int     // Maximum number of BIND listeners waiting for the connection. Excess BIND requests get RepServerFailure (0 or a negative value disables the limit)
+	MaxConnsPerDest         int     // Maximum number of simultaneous CONNECT sessions to the same destination. Excess requests get RepConnNotAllowed (0 or a negative value disables the limit)
+	Backlog                 int     // Length of the accept queue of the server listener, it is capped by SOMAXCONN. Unsupported platforms keep the default (0 keeps the default)
+
+	MaintenanceReply repType // Reply code sent to all the requests in maintenance mode (see Server.SetMaintenance). RepServerFailure is used by default
+
+	// Require the valid negotiation request within a few seconds after the connection is accepted.
+	// Silent connections and junk (e.g. port scanners) are closed with a debug log instead of an error
+	RequireValidHandshake bool
+
+	// Sent to the clients that do not speak SOCKS5 before the connection is closed (e.g. "HTTP/1.1 400 Bad Request\r\n\r\n").
+	// The first bytes sent by such clients are logged. nil sends nothing
+	VersionMismatchReply []byte
+
+	StrictRSV       bool // Reject requests with non-zero RSV field (RepServerFailure is sent)
+	ReplyRSV        byte // RSV field of the replies. It must be 0x00, non-zero values are used to test the interoperability of clients
+	MaxAuthMethods  int  // Maximum number of authentication methods the client may offer (0 disables the limit)
+	MaxDomainLength int  // Maximum length of the domain in DST.ADDR. Longer domains are rejected with RepAddrNotSupported (0 disables the limit)
+
+	DisableBind bool // Reject BIND requests with RepCmdNotSupported
+	DisableUDP  bool // Reject UDP ASSOCIATE requests with RepCmdNotSupported
+
+	// CONNECT destination the server echoes the data back for instead of dialing it (e.g. "diag.socks5.invalid:7").
+	// It allows to check the whole proxy path without an external echo server. nil disables the diagnostic
+	DiagnosticAddr *Addr
+
+	PublicIP net.IP // IP address that is sent in BND.ADDR of BIND and UDP ASSOCIATE replies instead of the local one (e.g. behind NAT)
+	IPv6Zone string // Zone that is appended to link-local IPv6 destinations before dialing (e.g. "eth0")
+
+	UDPIdleTimeout    time.Duration // UDP association is closed, if no datagram is relayed during the timeout (0 or a negative value disables the timeout)
+	UDPDrainOnClose   bool          // Relay the datagrams queued in the sockets of the association for udpDrainTimeout before closing them
+	StrictUDP         bool          // Drop UDP datagrams with non-zero RSV field
+	AllowUDPBroadcast bool          // Relay UDP datagrams to the limited and the directed broadcast addresses (such datagrams are dropped otherwise). Multicast is always relayed
+	UDPRatePerSecond  float64       // Maximum number of datagrams relayed per second in each UDP association. Excess datagrams are dropped (0 disables the limit)
+	UDPCodec          UDPCodec      // Codec of UDP headers sent between the server and the clients (DefaultUDPCodec is used, if UDPCodec is nil)
+
+	// Pool of buffers for datagrams relayed to the clients. A buffer is taken, when a datagram is received, and returned, when it is relayed,
+	// so idle and finished associations do not keep their buffers (on Windows and other platforms without MSG_PEEK
+	// a buffer is held while the association waits for a datagram). If UDPBufferPool is nil, every association allocates a buffer of UDPBuffer bytes
+	UDPBufferPool BufferPool
+
+	// Share outgoing UDP sockets between the associations that send datagrams to the same destination.
+	// It reduces the number of open sockets, when many clients talk to the same hosts (e.g. DNS servers).
+	// The trade-off: a response cannot be matched to the datagram, so it is delivered to every association
+	// that sent a datagram to the remote address of the response, and datagrams from other addresses are dropped.
+	// Concurrent clients of the same destination get each other's responses, so the option fits only
+	// request-response protocols, whose clients tolerate foreign responses (e.g. DNS matches them by the ID)
+	ShareUDPSockets bool
+
+	// Called after the request is read, before it is checked by Rules.
+	// The returned context is passed to Rules, Dialer and WrapUpstream, so the hooks may pass per-request values to each other
+	// (the context must be derived from ctx, otherwise Server.Timeout is not applied). A nil context keeps ctx.
+	// If an error is returned, the client gets the code of the SOCKS error or RepConnNotAllowed
+	OnRequest func(ctx context.Context, conn *Conn, req *Request) (context.Context, error)
+
+	// Called after the CONNECT destination is dialed. The returned connection is used to transfer data (e.g. tls.Client(conn, cfg)).
+	// If an error is returned, the client gets RepServerFailure
+	WrapUpstream func(ctx context.Context, conn net.Conn, req *Request) (net.Conn, error)
+
+	// Choose the reply code for the error that occured during handling the request (e.g. a dial error).
+	// If ErrorToReply is nil, the default mapping is used
+	ErrorToReply func(err error) repType
+
+	// Called when a connection is accepted, before the handshake. If false is returned, the connection is closed.
+	// It allows to reject clients by their address (e.g. using GeoIP or ASN databases). nil accepts all the clients
+	ClientFilter func(remote net.Addr) bool
+
+	// Choose the authentication methods offered to the client by its address (e.g. NoAuth for trusted subnets and PassAuth for the others).
+	// Server.Auths offers the same methods to every client, so including NoAuth there makes the password optional for everyone:
+	// any client skips it by offering only MethodNotRequired. If AuthsFor is nil or returns no methods, Server.Auths (Server.Auth) is offered
+	AuthsFor func(remote net.Addr) []Auth
+
+	OnSession    func(info *SessionInfo)           // Called, when the session is established and ready to transfer data
+	OnBindListen func(client, listenAddr net.Addr) // Called right after the BIND listener is bound, before the first reply is sent
+
+	// Called when the BIND listener accepts the connection, before the second reply is sent.
+	// If false is returned, the connection is closed and the client gets RepConnNotAllowed (e.g. the peer does not match req.Dst)
+	OnBindAccept func(req *Request, peer net.Addr) bool
+
+	// Called right after a success reply is written, before the data transfer is started.
+	// It is called twice for BIND (after the first and the second replies)
+	OnReplySent func(conn *Conn, req *Request, rep *Reply)
+
+	// Called, when the negotiation and the authentication are finished (err is nil on success).
+	// method is the negotiated authentication method (MethodNoAcceptable, if no method is chosen), dur is the duration of both phases (e.g. to detect slow authentication backends)
+	OnHandshakeComplete func(conn *Conn, method authMethod, dur time.Duration, err error)
+
+	// Called with data sent by the client over the control connection during UDP ASSOCIATE.
+	// b is valid only during the call. If OnControlData is nil, the data is ignored
+	OnControlData func(conn *Conn, b []byte)
+
+	listener   net.Listener
+	listenerMu sync.Mutex   // guards listener, shutdown and adding to conns
+	authMu     sync.RWMutex // guards Auth and Auths
+	stats      serverStats
+
+	bindListeners int64       // number of BIND listeners waiting for the connection
+	destConns     *keyLimiter // CONNECT sessions of every destination (see MaxConnsPerDest)
+	udpShare      *udpShare   // outgoing UDP sockets, if ShareUDPSockets is set
+
+	sessions   map[conn]struct{} // sessions that are transferring data
+	sessionsMu sync.Mutex        // guards sessions
+
+	conns    sync.WaitGroup // accepted connections that are not closed yet
+	shutdown bool           // no connections are accepted after Server.Shutdown
+
+	maintenance atomic.Bool
+
+	events atomic.Pointer[chan Event] // channel of Server.Events (nil, if it is not requested)
+
+	ready     chan struct{} // closed, when the server is ready to accept connections or failed to listen
+	readyOnce sync.Once
+	readyErr  error // error that stopped the server before it was ready (written before ready is closed)
 
 	// Base context that is used to cancel all the connections on Server.Close()
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
+const (
+	defaultUDPIdleTimeout = 30 * time.Second
+	maxAuthMethods        = 255
+	maxDomainLength       = 255
+
+	validHandshakeWindow = 3 * time.Second // time the negotiation request must be received in, if Server.RequireValidHandshake is set
+
+	versionMismatchHead = 64                     // maximum number of the logged bytes sent by non-SOCKS5 clients
+	versionMismatchWait = 100 * time.Millisecond // time to wait for the bytes sent by non-SOCKS5 clients
+
+	defaultRequestTimeout = 30 * time.Second // timeout for reading the request, if no other timeout is applied to it
+
+	// timeout of the handshake phases, if Server.MaxConcurrentHandshakes is set and no other timeout is applied to them,
+	// so silent clients do not hold the handshake slots and block the accept loop forever
+	limitedHandshakeTimeout = 5 * time.Second
+
+	minDialAttemptTimeout = 2 * time.Second // minimum time each resolved address is dialed for, if the dial timeout is split
+
+	maxCachedVerdicts = 1024 // maximum number of the destinations the results of the rules are kept for by the UDP association
+
+	udpDrainTimeout = 100 * time.Millisecond // time the queued datagrams are relayed for, if Server.UDPDrainOnClose is set
+
+	signalShutdownTimeout = 10 * time.Second // time ListenAndServeWithSignals waits for the active connections
+
+	minIdleCheckInterval = 10 * time.Millisecond // minimum period of the idle checks, so short idle timeouts do not spin the transfer loop
+)
+
 // Return a SOCKS5 server with default options that is ready to listen at addr
 func NewServer(addr string) *Server {
 	ctx, cancel := context.WithCancel(context.Background())
@@ -36,6 +219,16 @@ func NewServer(addr string) *Server {
 		Dialer:    defaultDialer,
 		Logger:    &switchLogger{true, defaultLogger()},
 		UDPBuffer: maxUDPHeaderLength,
+		NoDelay:   true,
+
+		UDPIdleTimeout:  defaultUDPIdleTimeout,
+		MaxAuthMethods:  maxAuthMethods,
+		MaxDomainLength: maxDomainLength,
+
+		ready:     make(chan struct{}),
+		udpShare:  newUDPShare(),
+		destConns: newKeyLimiter(),
+		sessions:  make(map[conn]struct{}),
 
 		ctx:    ctx,
 		cancel: cancel,
@@ -57,6 +250,7 @@ func (srv *Server) ListenAndServe() error {
 
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
+		srv.setReady(err)
 		return err
 	}
 
@@ -65,54 +259,386 @@ func (srv *Server) ListenAndServe() error {
 
 // Start the SOCKS5 server listening at l
 func (srv *Server) Serve(l net.Listener) error {
+	srv.setBacklog(l)
+
+	if srv.TLSConfig != nil {
+		l = tls.NewListener(l, srv.TLSConfig)
+	}
+
+	srv.listenerMu.Lock()
+	if srv.ctx.Err() != nil || srv.shutdown {
+		srv.listenerMu.Unlock()
+
+		l.Close()
+
+		err := ErrConn.New("the server is closed")
+		srv.setReady(err)
+		return err
+	}
+
 	srv.listener = l
-	srv.Logger.Infof("The server is listening at %v\n", srv.listener.Addr())
+	srv.listenerMu.Unlock()
+
+	srv.Logger.Infof("The server is listening at %v\n", l.Addr())
+
+	var handshakes chan struct{} // bounds the number of connections in the handshake phase
+	if srv.MaxConcurrentHandshakes > 0 {
+		handshakes = make(chan struct{}, srv.MaxConcurrentHandshakes)
+	}
+
+	var served chan struct{} // bounds the number of served connections
+	if srv.MaxConns > 0 {
+		served = make(chan struct{}, srv.MaxConns)
+	}
+
+	var rate *limiter
+	if srv.AcceptRateLimit > 0 {
+		rate = newLimiter(srv.AcceptRateLimit)
+	}
+
+	srv.setReady(nil)
 
 	for {
-		c, err := srv.listener.Accept()
+		if rate != nil && rate.Wait(srv.ctx) != nil {
+			return ErrConn.New("the server is closed")
+		}
+
+		if handshakes != nil {
+			handshakes <- struct{}{}
+		}
+
+		c, err := l.Accept()
 		if err != nil {
 			return err
 		}
 
-		go srv.serve(c)
+		handshakeDone := func() {
+			if handshakes != nil {
+				<-handshakes
+			}
+		}
+
+		if !acquireSlot(served) {
+			handshakeDone()
+			srv.Logger.Debugf("The client %v is rejected, the number of connections (%v) is exceeded\n", c.RemoteAddr(), srv.MaxConns)
+
+			c.Close()
+			continue
+		}
+
+		if !srv.addConn() {
+			handshakeDone()
+			releaseSlot(served)
+			c.Close()
+
+			return ErrConn.New("the server is shut down")
+		}
+
+		go func() {
+			defer srv.conns.Done()
+			defer releaseSlot(served)
+
+			srv.serve(c, handshakeDone)
+		}()
+	}
+}
+
+// Apply Server.Backlog to the TCP listener. Errors are logged at the debug level, the default backlog is kept
+func (srv *Server) setBacklog(l net.Listener) {
+	tl, ok := l.(*net.TCPListener)
+	if srv.Backlog == 0 || !ok {
+		return
+	}
+
+	err := setBacklog(tl, srv.Backlog)
+	if err != nil {
+		srv.Logger.Debugf("Unable to set the backlog (%v) of %v: %v\n", srv.Backlog, l.Addr(), err)
+	}
+}
+
+// Take a slot of the semaphore without waiting. A nil semaphore has unlimited slots.
+// False is returned, if there is no free slot
+func acquireSlot(sem chan struct{}) bool {
+	if sem == nil {
+		return true
+	}
+
+	select {
+	case sem <- struct{}{}:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// Free the slot taken by acquireSlot
+func releaseSlot(sem chan struct{}) {
+	if sem != nil {
+		<-sem
+	}
+}
+
+// Register the accepted connection, so Server.Shutdown waits for it.
+// False is returned, if the server is shut down
+func (srv *Server) addConn() bool {
+	srv.listenerMu.Lock()
+	defer srv.listenerMu.Unlock()
+
+	if srv.shutdown {
+		return false
+	}
+
+	srv.conns.Add(1)
+	return true
+}
+
+// Return a channel that is closed, when the server is listening and ready to accept connections.
+// It is closed as well, if the server failed to listen, Server.ReadyErr returns the error then
+func (srv *Server) Ready() <-chan struct{} {
+	return srv.ready
+}
+
+// Return the error that stopped the server before it was ready (nil, if the server is listening).
+// It is valid only after the channel of Server.Ready is closed
+func (srv *Server) ReadyErr() error {
+	select {
+	case <-srv.ready:
+		return srv.readyErr
+	default:
+		return nil
 	}
 }
 
+// Close the channel of Server.Ready and record err, only the first call takes effect
+func (srv *Server) setReady(err error) {
+	srv.readyOnce.Do(func() {
+		srv.readyErr = err
+		close(srv.ready)
+	})
+}
+
 // Close the listener and cancels all the connections
 func (srv *Server) Close() error {
 	srv.Logger.Infof("The server was closed")
 
+	srv.listenerMu.Lock()
+	defer srv.listenerMu.Unlock()
+
 	srv.cancel()
+	if srv.listener == nil {
+		return nil
+	}
+
 	return srv.listener.Close()
 }
 
-// Authenticate the client and handle the request.
-func (srv *Server) serve(c net.Conn) {
+// Stop accepting new connections and wait till the active connections are finished, then close the server.
+//
+// If the context is done before the connections are finished, the server is closed at once (see Server.Close)
+// and the error of the context is returned
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.Logger.Infof("The server is shutting down\n")
+
+	srv.listenerMu.Lock()
+	srv.shutdown = true
+	if srv.listener != nil {
+		srv.listener.Close()
+	}
+	srv.listenerMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		srv.conns.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		srv.Close()
+		return nil
+
+	case <-ctx.Done():
+		srv.Close()
+		return ctx.Err()
+	}
+}
+
+// Start the SOCKS5 server listening at srv.Addr and shut it down, when one of the signals is received (os.Interrupt and SIGTERM by default).
+// The active connections are waited for signalShutdownTimeout, then the server is closed (see Server.Shutdown).
+//
+// nil is returned, if the server is stopped by a signal
+func (srv *Server) ListenAndServeWithSignals(signals ...os.Signal) error {
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, signals...)
+	defer signal.Stop(received)
+
+	result := make(chan error, 1)
+	go func() { result <- srv.ListenAndServe() }()
+
+	select {
+	case err := <-result:
+		return err
+
+	case sig := <-received:
+		srv.Logger.Infof("The signal (%v) is received\n", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), signalShutdownTimeout)
+		defer cancel()
+
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			srv.Logger.Infof("The connections are not finished in %v, the server is closed\n", signalShutdownTimeout)
+		}
+
+		<-result
+		return nil
+	}
+}
+
+// Return the counters of the server activity
+func (srv *Server) Stats() Stats {
+	return srv.stats.snapshot()
+}
+
+// Authenticate the client, handle the request and transfer data.
+//
+// handshakeDone is called, when the request is read and validated
+func (srv *Server) serve(c net.Conn, handshakeDone func()) {
+	if srv.ClientFilter != nil && !srv.ClientFilter(c.RemoteAddr()) {
+		handshakeDone()
+		srv.Logger.Debugf("The client %v is rejected by the filter\n", c.RemoteAddr())
+
+		c.Close()
+		return
+	}
+
+	atomic.AddInt64(&srv.stats.active, 1)
+	defer atomic.AddInt64(&srv.stats.active, -1)
+
+	srv.tuneTCP(c)
 	client := NewConn(c)
+	client.id = newSessionID()
 
-	err := srv.auth(client)
+	srv.emit(EventAccept, client, nil, nil, nil)
+	defer srv.emit(EventClose, client, nil, nil, nil)
+
+	client.logger = newPrefixLogger(srv.Logger, fmt.Sprintf("[%v %v] ", client.id, c.RemoteAddr()))
+	if srv.TraceWire {
+		client.trace = srv.traceWire(client.logger)
+	}
+
+	conn, err := srv.handshake(client, handshakeDone)
 	if err != nil {
-		srv.Logger.Errorf("%v\n", err)
+		atomic.AddInt64(&srv.stats.errors, 1)
+
+		// scanners and silent connections are expected, if the valid handshake is required
+		srv.emit(EventError, client, nil, nil, err)
+
+		if errorx.IsOfType(err, errInvalidHandshake) {
+			debugf(client.logger, "%v\n", err)
+		} else {
+			client.logger.Errorf("%v\n", err)
+		}
+
+		client.Close()
 		return
 	}
 
-	conn, err := srv.handle(client)
+	cmd, from, to := conn.Request().Cmd, clientString(conn.Client()), conn.Request().Dst
+	if !srv.LogOnlyFailures {
+		client.logger.Infof("[%v] %v <-> %v\n", cmd, from, to)
+	}
+
+	if srv.OnSession != nil {
+		srv.OnSession(makeSessionInfo(conn))
+	}
+
+	ctx := contextWithSessionID(srv.ctx, client.SessionID())
+	if srv.MaxSessionDuration != 0 {
+		session, cancel := context.WithTimeout(ctx, srv.MaxSessionDuration)
+		defer cancel()
+
+		ctx = session
+	}
+
+	srv.trackSession(conn, true)
+	defer srv.trackSession(conn, false)
+
+	err = conn.Transfer(ctx)
 	if err != nil {
-		srv.Logger.Errorf("%v\n", err)
-		return
+		atomic.AddInt64(&srv.stats.errors, 1)
+		client.logger.Errorf("[%v] %v <-> %v: %v\n", cmd, from, to, err)
+		srv.emit(EventError, client, conn.Request(), nil, err)
 	}
 
-	cmd, from, to := conn.Request().Cmd, conn.Client().Raw().RemoteAddr(), conn.Request().Dst
-	srv.Logger.Infof("[%v] %v <-> %v\n", cmd, from, to)
+	if ctx.Err() == context.DeadlineExceeded {
+		client.logger.Infof("[%v] %v <-> %v: the session duration (%v) is expired\n", cmd, from, to, srv.MaxSessionDuration)
+	}
 
-	conn.Transfer(srv.ctx)
 	conn.Close()
 }
 
-// Read the request and choose the appropriate handler.
+// Add the session to the registry or remove it
+func (srv *Server) trackSession(c conn, add bool) {
+	srv.sessionsMu.Lock()
+	defer srv.sessionsMu.Unlock()
+
+	if add {
+		srv.sessions[c] = struct{}{}
+	} else {
+		delete(srv.sessions, c)
+	}
+}
+
+// Reset the counters of the CONNECT sessions of every destination (see Server.MaxConnsPerDest).
+// The active sessions are not closed, but they are not counted anymore
+func (srv *Server) ResetHostCounters() {
+	srv.destConns.Reset()
+}
+
+// Close the sessions that have not transferred data for d or longer.
+// Return the number of closed sessions
+func (srv *Server) CloseIdle(d time.Duration) int {
+	srv.sessionsMu.Lock()
+	defer srv.sessionsMu.Unlock()
+
+	closed := 0
+	for c := range srv.sessions {
+		if c.idleFor() >= d {
+			c.Close()
+			delete(srv.sessions, c)
+
+			closed++
+		}
+	}
+
+	return closed
+}
+
+// Authenticate the client and handle the request.
+// done is called, when the request is read and validated, so dialing and waiting for BIND do not hold the handshake slot
+func (srv *Server) handshake(client *Conn, done func()) (conn, error) {
+	var once sync.Once
+	finish := func() { once.Do(done) }
+	defer finish()
+
+	err := srv.auth(client)
+	if err != nil {
+		return nil, err
+	}
+
+	return srv.handle(client, finish)
+}
+
+// Read the request and choose the appropriate handler. done is called before the request is dispatched.
 //
 // In case of an error the server sends the failure reply with code of the error
-func (srv *Server) handle(client *Conn) (conn conn, err error) {
+func (srv *Server) handle(client *Conn, done func()) (conn conn, err error) {
 	ctx := context.Background()
 	if srv.timeoutEnabled() {
 		timeout, cancel := context.WithTimeout(ctx, srv.Timeout)
@@ -121,21 +647,26 @@ func (srv *Server) handle(client *Conn) (conn conn, err error) {
 		ctx = timeout
 	}
 
+	ctx = contextWithUser(ctx, client.User())
+	ctx = contextWithResolver(ctx, srv.resolver())
+	ctx = contextWithSessionID(ctx, client.SessionID())
+
 	req := &Request{}
-	err = client.ReadMessage(ctx, req)
-	if err != nil {
-		return nil, err
-	}
+	err = srv.readRequest(ctx, client, req)
+	if err == nil {
+		srv.stats.addCommand(req.Cmd)
+		srv.emit(EventRequest, client, req, nil, nil)
 
-	switch req.Cmd {
-	case CmdConnect:
-		conn, err = srv.handleCONNECT(ctx, client, req)
+		ctx, err = srv.intercept(ctx, client, req)
+	}
 
-	case CmdBind:
-		conn, err = srv.handleBIND(ctx, client, req)
+	if err == nil {
+		err = srv.validate(ctx, client, req)
+	}
 
-	case CmdUDP:
-		conn, err = srv.handleUDP(ctx, client, req)
+	if err == nil {
+		done()
+		conn, err = srv.dispatch(ctx, client, req)
 	}
 
 	if IsSOCKSError(err) {
@@ -148,123 +679,999 @@ func (srv *Server) handle(client *Conn) (conn conn, err error) {
 	return conn, err
 }
 
-// Handle the CONNECT request and return the connection that is ready to transfer data.
+// Call srv.OnRequest and return the context the request is handled with.
 //
-// Error is returned, if the server is unreachable
-func (srv *Server) handleCONNECT(ctx context.Context, client *Conn, req *Request) (conn, error) {
-	server, err := srv.Dialer.DialContext(ctx, "tcp", req.Dst.String())
-	if err != nil {
-		errctx := makeErrorContext(client, req, RepHostUnreachable)
-		return nil, SOCKSError(errctx.Code, errctx)
+// If OnRequest returns an error, ctx is returned and the request is rejected
+func (srv *Server) intercept(ctx context.Context, client *Conn, req *Request) (context.Context, error) {
+	if srv.OnRequest == nil {
+		return ctx, nil
 	}
 
-	rep := &Reply{Rep: RepSucceeded, Bnd: ParseNetAddr(server.LocalAddr())}
-	err = client.WriteMessage(ctx, rep)
+	hooked, err := srv.OnRequest(ctx, client, req)
 	if err != nil {
-		return nil, err
+		if !IsSOCKSError(err) {
+			err = SOCKSError(RepConnNotAllowed, err)
+		}
+
+		return ctx, err
+	}
+
+	if hooked == nil {
+		return ctx, nil
+	}
+
+	return hooked, nil
+}
+
+// Read the request within Server.RequestTimeout.
+//
+// defaultRequestTimeout is applied, if no timeout is set (limitedHandshakeTimeout, if the handshakes are limited), so the clients trickling the request bytes do not hold the connection forever.
+// If the client sends the negotiation request again, the SOCKS error with RepServerFailure is returned
+func (srv *Server) readRequest(ctx context.Context, client *Conn, req *Request) error {
+	timeout := srv.RequestTimeout
+	if timeout == 0 && srv.HandshakeTimeout == 0 && srv.MaxConcurrentHandshakes <= 0 && !srv.timeoutEnabled() {
+		timeout = defaultRequestTimeout
+	}
+
+	phase, cancel := srv.phaseContext(ctx, timeout)
+	defer cancel()
+
+	// the timeout is applied as the read deadline, so the connection is not closed and the failure reply could be sent
+	deadline, ok := phase.Deadline()
+	if ok {
+		client.Raw().SetReadDeadline(deadline)
+		defer client.Raw().SetReadDeadline(time.Time{})
+	}
+
+	rec := &recordedMessage{msg: req}
+	err := client.ReadMessage(ctx, rec)
+	if err != nil && isNegotiationRequest(rec.bytes()) {
+		return SOCKSError(RepServerFailure, ErrProtocol.New("duplicate negotiation request from %v after the handshake", client.Raw().RemoteAddr()))
+	}
+
+	if err != nil && (phase.Err() != nil || ok && !time.Now().Before(deadline)) {
+		return ErrConn.Wrap(err, "the request is not received from %v in time", client.Raw().RemoteAddr())
+	}
+
+	return err
+}
+
+// recordedMessage records the bytes read by the message
+type recordedMessage struct {
+	msg Message
+
+	mu   sync.Mutex
+	read []byte
+}
+
+func (m *recordedMessage) Write(wr io.Writer) error {
+	return m.msg.Write(wr)
+}
+
+func (m *recordedMessage) Read(rd io.Reader) error {
+	return m.msg.Read(readerFunc(func(b []byte) (int, error) {
+		n, err := rd.Read(b)
+
+		m.mu.Lock()
+		m.read = append(m.read, b[:n]...)
+		m.mu.Unlock()
+
+		return n, err
+	}))
+}
+
+// Return a copy of the bytes read so far
+func (m *recordedMessage) bytes() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]byte(nil), m.read...)
+}
+
+// readerFunc is an io.Reader that calls the function
+type readerFunc func(b []byte) (int, error)
+
+func (f readerFunc) Read(b []byte) (int, error) {
+	return f(b)
+}
+
+// Return the context of the handshake phase with the timeout (Server.HandshakeTimeout is used, if timeout is 0).
+// limitedHandshakeTimeout is used, if neither of them is set and the number of concurrent handshakes is limited
+func (srv *Server) phaseContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		timeout = srv.HandshakeTimeout
+	}
+
+	if timeout == 0 && srv.MaxConcurrentHandshakes > 0 {
+		timeout = limitedHandshakeTimeout
+	}
+
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// Check the request before it is handled.
+//
+// SOCKS error is returned, if the request must be rejected
+func (srv *Server) validate(ctx context.Context, client *Conn, req *Request) error {
+	if srv.Maintenance() {
+		code := srv.MaintenanceReply
+		if code == RepSucceeded {
+			code = RepServerFailure
+		}
+
+		return SOCKSError(code, ErrProtocol.New("the server is in maintenance mode (%v -> %v)", client.Raw().RemoteAddr(), req.Dst))
+	}
+
+	if srv.StrictRSV && req.Rsv != 0x00 {
+		return SOCKSError(RepServerFailure, ErrProtocol.New("non-zero RSV field (%v) in the request from %v", req.Rsv, client.Raw().RemoteAddr()))
+	}
+
+	if srv.commandDisabled(req.Cmd) {
+		return SOCKSError(RepCmdNotSupported, ErrProtocol.New("the command (%v) is disabled, the request from %v is rejected", req.Cmd, client.Raw().RemoteAddr()))
+	}
+
+	if srv.MaxDomainLength != 0 && req.Dst.Atyp == AddrDomain && len(req.Dst.Host) > srv.MaxDomainLength {
+		return SOCKSError(RepAddrNotSupported, ErrProtocol.New("the domain is too long (%v bytes) in the request from %v", len(req.Dst.Host), client.Raw().RemoteAddr()))
+	}
+
+	if srv.Rules != nil {
+		ok, code := srv.Rules.Allow(ctx, req.Cmd, req.Dst)
+		if !ok {
+			if code == RepSucceeded {
+				code = RepConnNotAllowed
+			}
+
+			errctx := makeErrorContext(client, req, code)
+			return SOCKSError(errctx.Code, errctx)
+		}
+	}
+
+	return nil
+}
+
+// True, if the command is disabled by Server.DisableBind or Server.DisableUDP
+func (srv *Server) commandDisabled(cmd cmdType) bool {
+	switch cmd {
+	case CmdBind:
+		return srv.DisableBind
+
+	case CmdUDP:
+		return srv.DisableUDP
+	}
+
+	return false
+}
+
+// Choose the appropriate handler for the request
+func (srv *Server) dispatch(ctx context.Context, client *Conn, req *Request) (conn, error) {
+	switch req.Cmd {
+	case CmdConnect:
+		return srv.handleCONNECT(ctx, client, req)
+
+	case CmdBind:
+		return srv.handleBIND(ctx, client, req)
+
+	case CmdUDP:
+		return srv.handleUDP(ctx, client, req)
+	}
+
+	errctx := makeErrorContext(client, req, RepCmdNotSupported)
+	return nil, SOCKSError(errctx.Code, errctx)
+}
+
+// Handle the CONNECT request and return the connection that is ready to transfer data.
+//
+// Error is returned, if the server is unreachable
+func (srv *Server) handleCONNECT(ctx context.Context, client *Conn, req *Request) (c conn, err error) {
+	if srv.DiagnosticAddr != nil && req.Dst.Equal(srv.DiagnosticAddr) {
+		return srv.handleDiagnostic(ctx, client, req)
+	}
+
+	release := func() {}
+	if srv.MaxConnsPerDest > 0 {
+		var ok bool
+
+		release, ok = srv.destConns.Acquire(strings.ToLower(req.Dst.String()), srv.MaxConnsPerDest)
+		if !ok {
+			errctx := makeErrorContext(client, req, RepConnNotAllowed)
+			return nil, SOCKSError(errctx.Code, ErrProtocol.Wrap(errctx, "too many connections to the destination (%v)", srv.MaxConnsPerDest))
+		}
+
+		defer func() {
+			if err != nil {
+				release()
+			}
+		}()
+	}
+
+	server, err := srv.dial(ctx, "tcp", req)
+	if IsSOCKSError(err) {
+		return nil, err
+	}
+
+	if err != nil {
+		errctx := makeErrorContext(client, req, srv.replyCode(err, dialReply(err)))
+		return nil, SOCKSError(errctx.Code, errctx)
+	}
+	srv.tuneTCP(server)
+
+	if srv.WrapUpstream != nil {
+		wrapped, err := srv.WrapUpstream(ctx, server, req)
+		if err != nil {
+			server.Close()
+
+			errctx := makeErrorContext(client, req, srv.replyCode(err, RepServerFailure))
+			return nil, SOCKSError(errctx.Code, errctx)
+		}
+
+		server = wrapped
+	}
+
+	rep := &Reply{Rep: RepSucceeded, Bnd: ParseNetAddr(server.LocalAddr())}
+	err = srv.writeReply(ctx, client, req, rep)
+	if err != nil {
+		return nil, err
+	}
+
+	tcp := srv.newTCPConn(client, server, req)
+	tcp.onClose = release
+
+	return tcp, nil
+}
+
+// Echo the data sent by the client instead of dialing the destination (see Server.DiagnosticAddr)
+func (srv *Server) handleDiagnostic(ctx context.Context, client *Conn, req *Request) (conn, error) {
+	server, echo := net.Pipe()
+	go func() {
+		io.Copy(echo, echo)
+		echo.Close()
+	}()
+
+	rep := &Reply{Rep: RepSucceeded, Bnd: NilAddr.Clone()}
+	err := srv.writeReply(ctx, client, req, rep)
+	if err != nil {
+		server.Close()
+		return nil, err
+	}
+
+	return srv.newTCPConn(client, server, req), nil
+}
+
+// Make the connection that transfers data between the client and server with Server.Transferer
+func (srv *Server) newTCPConn(client *Conn, server net.Conn, req *Request) *tcpConn {
+	transferer := srv.Transferer
+	if transferer == nil {
+		transferer = CopyTransferer
+	}
+
+	return &tcpConn{
+		client:     client,
+		server:     server,
+		req:        req,
+		stats:      &srv.stats,
+		transferer: transferer,
+
+		idleTimeout:  srv.IdleTimeout,
+		flushTimeout: srv.SessionFlushTimeout,
+	}
+}
+
+// Dial the destination. If the destination is a domain and srv.Dialer is a *net.Dialer, all the resolved addresses are tried in turn.
+// Custom dialers get the domain unchanged, so they resolve it themselves (e.g. through another proxy).
+//
+// The addresses the domain is resolved to are checked by srv.Rules before they are dialed, so the domain could not be resolved
+// to a denied address after the request is allowed (DNS rebinding). The connections of custom dialers are checked by the remote address.
+// Error of the last attempt is returned, if neither of the addresses is reachable or allowed (the SOCKS error, if the address is rejected)
+func (srv *Server) dial(ctx context.Context, network string, req *Request) (net.Conn, error) {
+	if srv.DialTimeout != 0 {
+		timeout, cancel := context.WithTimeout(ctx, srv.DialTimeout)
+		defer cancel()
+
+		ctx = timeout
+	}
+
+	dst := req.Dst
+
+	dialer, ok := srv.Dialer.(*net.Dialer)
+	if dst.Atyp != AddrDomain || !ok {
+		c, err := srv.Dialer.DialContext(ctx, network, srv.dialAddress(dst))
+		if err != nil || dst.Atyp != AddrDomain {
+			return c, err
+		}
+
+		err = srv.allowResolved(ctx, req, ParseNetAddr(c.RemoteAddr()))
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		return c, nil
+	}
+
+	ips, err := srv.resolver().LookupIPAddr(ctx, dst.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	port := strconv.FormatUint(uint64(dst.Port), 10)
+	addrs := make([]string, 0, len(ips))
+
+	var denied error // error of the address rejected by srv.Rules, it is returned if no allowed address is reachable
+
+	for _, ip := range ips {
+		address := net.JoinHostPort(ip.String(), port)
+
+		err = srv.allowResolved(ctx, req, ParseAddr(network, address))
+		if err != nil {
+			denied = err
+			continue
+		}
+
+		addrs = append(addrs, address)
+	}
+
+	if len(addrs) == 0 {
+		if denied == nil {
+			denied = &net.DNSError{Err: "no such host", Name: dst.Host, IsNotFound: true}
+		}
+
+		return nil, denied
+	}
+
+	// the timeout of the dialer is applied to all the addresses, not to each of them
+	if dialer.Timeout != 0 {
+		timeout, cancel := context.WithTimeout(ctx, dialer.Timeout)
+		defer cancel()
+
+		ctx = timeout
+	}
+
+	for i, address := range addrs {
+		var c net.Conn
+
+		c, err = dialPartial(ctx, dialer, network, address, len(addrs)-i)
+		if err == nil {
+			return c, nil
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if denied != nil {
+		return nil, denied
+	}
+
+	return nil, err
+}
+
+// Dial the address with the share of the time remaining till the deadline of ctx,
+// so the unreachable address does not consume the timeout of the addresses remaining (like net.Dialer does)
+func dialPartial(ctx context.Context, dialer *net.Dialer, network, address string, remaining int) (net.Conn, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok || remaining <= 1 {
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	timeout := time.Until(deadline) / time.Duration(remaining)
+	if timeout < minDialAttemptTimeout {
+		timeout = minDialAttemptTimeout
+	}
+
+	partial, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return dialer.DialContext(partial, network, address)
+}
+
+// Return the resolver of srv.Dialer, if it is a *net.Dialer with the resolver. Otherwise net.DefaultResolver is returned
+func (srv *Server) resolver() *net.Resolver {
+	d, ok := srv.Dialer.(*net.Dialer)
+	if !ok || d.Resolver == nil {
+		return net.DefaultResolver
+	}
+
+	return d.Resolver
+}
+
+// Check the address the domain of the request is resolved to with srv.Rules.
+// The SOCKS error is returned, if the address is rejected. Addresses that are not IP addresses are not checked
+func (srv *Server) allowResolved(ctx context.Context, req *Request, addr *Addr) error {
+	if srv.Rules == nil || addr == nil || addr.Atyp == AddrDomain {
+		return nil
+	}
+
+	ok, code := srv.Rules.Allow(ctx, req.Cmd, addr)
+	if ok {
+		return nil
+	}
+
+	if code == RepSucceeded {
+		code = RepConnNotAllowed
+	}
+
+	return SOCKSError(code, ErrProtocol.New("%v is resolved to the address that is not allowed (%v)", req.Dst, addr))
+}
+
+// Return the reply code for the error that occured during handling the request.
+//
+// def is returned, if srv.ErrorToReply is nil or it returns RepSucceeded
+func (srv *Server) replyCode(err error, def repType) repType {
+	if srv.ErrorToReply == nil {
+		return def
+	}
+
+	code := srv.ErrorToReply(err)
+	if code == RepSucceeded {
+		return def
+	}
+
+	return code
+}
+
+// Return the address that is used to dial dst.
+//
+// If srv.IPv6Zone is set and dst is a link-local IPv6 address, the zone is appended to the host
+func (srv *Server) dialAddress(dst *Addr) string {
+	if srv.IPv6Zone == "" || dst.Atyp != AddrIPv6 || dst.Zone != "" {
+		return dst.String()
+	}
+
+	ip := net.ParseIP(dst.Host)
+	if !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() {
+		return dst.String()
+	}
+
+	port := strconv.FormatUint(uint64(dst.Port), 10)
+	return net.JoinHostPort(dst.Host+"%"+srv.IPv6Zone, port)
+}
+
+// Handle the BIND request and return the connection that is ready to transfer data.
+//
+// Error is returned, if the incoming connection can not be accepted
+func (srv *Server) handleBIND(ctx context.Context, client *Conn, req *Request) (conn, error) {
+	if srv.MaxBindListeners > 0 {
+		listeners := atomic.AddInt64(&srv.bindListeners, 1)
+		defer atomic.AddInt64(&srv.bindListeners, -1)
+
+		if listeners > int64(srv.MaxBindListeners) {
+			errctx := makeErrorContext(client, req, RepServerFailure)
+			return nil, SOCKSError(errctx.Code, ErrProtocol.Wrap(errctx, "too many BIND listeners (%v)", srv.MaxBindListeners))
+		}
+	}
+
+	bind, err := srv.listen(ctx, "tcp", extractPort(req.Dst.String()), true)
+	if err != nil {
+		errctx := makeErrorContext(client, req, srv.replyCode(err, RepServerFailure))
+		return nil, SOCKSError(errctx.Code, errctx)
+	}
+
+	listener := bind.(net.Listener)
+	defer listener.Close()
+
+	if srv.OnBindListen != nil {
+		srv.OnBindListen(client.Raw().RemoteAddr(), listener.Addr())
+	}
+
+	// first reply that contains the address that the server is listening at
+	rep := &Reply{Rep: RepSucceeded, Bnd: srv.publicAddr(listener.Addr())}
+	err = srv.writeReply(ctx, client, req, rep)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := srv.watchBind(ctx, client, listener)
+	server, err := listener.Accept()
+	stop()
+
+	if err != nil {
+		errctx := makeErrorContext(client, req, srv.replyCode(err, RepServerFailure))
+		return nil, SOCKSError(errctx.Code, errctx)
+	}
+	srv.tuneTCP(server)
+
+	if srv.OnBindAccept != nil && !srv.OnBindAccept(req, server.RemoteAddr()) {
+		server.Close()
+
+		errctx := makeErrorContext(client, req, RepConnNotAllowed)
+		return nil, SOCKSError(errctx.Code, errctx)
+	}
+
+	// second reply that contains the server remote address
+	rep.Bnd = ParseNetAddr(server.RemoteAddr())
+	err = srv.writeReply(ctx, client, req, rep)
+
+	return srv.newTCPConn(client, server, req), err
+}
+
+// Close the BIND listener, when ctx or the server context is done or the client closes the control connection,
+// so the abandoned BIND does not keep the listener (and the slot of Server.MaxBindListeners) forever.
+// The deadline of ctx is applied to the listener as well.
+//
+// Return the function that stops watching. Data sent by the client meanwhile is kept for the transfer
+func (srv *Server) watchBind(ctx context.Context, client *Conn, listener net.Listener) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		if tl, ok := listener.(*net.TCPListener); ok {
+			tl.SetDeadline(deadline)
+		}
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-srv.ctx.Done():
+		case <-stopped:
+			return
+		}
+
+		listener.Close()
+	}()
+
+	// the client sends nothing till the second reply, so EOF or an error means the client hung up
+	b := make([]byte, 1)
+	n := 0
+	read := make(chan struct{})
+
+	go func() {
+		defer close(read)
+
+		var err error
+		n, err = client.Raw().Read(b)
+		if err != nil {
+			listener.Close()
+		}
+	}()
+
+	return func() {
+		close(stopped)
+
+		client.Raw().SetReadDeadline(time.Unix(1, 0))
+		<-read
+		client.Raw().SetReadDeadline(time.Time{})
+
+		if n > 0 {
+			client.raw = &prefixConn{Conn: client.raw, prefix: b[:n]}
+		}
+	}
+}
+
+// Handle the UDP ASSOCIATE request and return the connection that is ready to transfer data.
+// It binds two UDP connections for incoming and outgoing data.
+//
+// Error is returned, if the UDP connections can not be binded
+func (srv *Server) handleUDP(ctx context.Context, client *Conn, req *Request) (conn, error) {
+	bind, err := srv.listen(ctx, "udp", req.Dst.String(), true)
+	if err != nil {
+		errctx := makeErrorContext(client, req, srv.replyCode(err, RepServerFailure))
+		return nil, SOCKSError(errctx.Code, errctx)
+	}
+
+	outcome := bind.(*net.UDPConn)
+
+	// the outgoing sockets are acquired per destination during the transfer
+	if srv.ShareUDPSockets {
+		return srv.makeUDPConn(ctx, client, req, outcome, nil)
+	}
+
+	bind, err = srv.listen(ctx, "udp", randomAddress(), false)
+	if err != nil {
+		outcome.Close()
+
+		errctx := makeErrorContext(client, req, srv.replyCode(err, RepServerFailure))
+		return nil, SOCKSError(errctx.Code, errctx)
+	}
+
+	income := bind.(*net.UDPConn)
+
+	if srv.AllowUDPBroadcast {
+		err = setBroadcast(income)
+		if err != nil {
+			outcome.Close()
+			income.Close()
+
+			errctx := makeErrorContext(client, req, srv.replyCode(err, RepServerFailure))
+			return nil, SOCKSError(errctx.Code, errctx)
+		}
+	}
+
+	return srv.makeUDPConn(ctx, client, req, outcome, income)
+}
+
+// Send the success reply and return the association relaying datagrams between outcome and income.
+// If income is nil, the outgoing sockets are shared with other associations
+func (srv *Server) makeUDPConn(ctx context.Context, client *Conn, req *Request, outcome, income *net.UDPConn) (conn, error) {
+	rep := &Reply{Rep: RepSucceeded, Bnd: srv.relayAddr(client, outcome)}
+	err := srv.writeReply(ctx, client, req, rep)
+	if err != nil {
+		return nil, err
+	}
+
+	var onControl func([]byte)
+	if srv.OnControlData != nil {
+		onControl = func(b []byte) { srv.OnControlData(client, b) }
+	}
+
+	var drain time.Duration
+	if srv.UDPDrainOnClose {
+		drain = udpDrainTimeout
+	}
+
+	headers := newUDPConn(client.Raw(), outcome, srv.UDPBuffer, drain, true, onControl)
+	headers.Codec = srv.UDPCodec
+	headers.accept = udpSourceFilter(client.Raw().RemoteAddr(), req.Dst)
+
+	var rate *limiter
+	if srv.UDPRatePerSecond > 0 {
+		rate = newLimiter(srv.UDPRatePerSecond)
+	}
+
+	var share *udpShare
+	if income == nil {
+		share = srv.udpShare
+	}
+
+	return &udpConn{
+		Buffer:      srv.UDPBuffer,
+		Pool:        srv.UDPBufferPool,
+		IdleTimeout: srv.UDPIdleTimeout,
+		Strict:      srv.StrictUDP,
+		Broadcast:   srv.AllowUDPBroadcast,
+		Drain:       srv.UDPDrainOnClose,
+
+		client:  client,
+		income:  income,
+		outcome: headers,
+		req:     req,
+		stats:   &srv.stats,
+		rate:    rate,
+		share:   share,
+
+		rules:    srv.Rules,
+		rulesCtx: contextWithDatagram(ctx),
+	}, nil
+}
+
+// Return the function logging the message bytes exchanged with the client to the session logger
+func (srv *Server) traceWire(logger Logger) func(read bool, b []byte) {
+	return func(read bool, b []byte) {
+		direction := "->"
+		if read {
+			direction = "<-"
+		}
+
+		debugf(logger, "%v % x\n", direction, b)
+	}
+}
+
+// Return the trace function of Server.TraceWire that logs only the length of the messages (e.g. the authentication ones)
+func redactTrace(logger Logger) func(read bool, b []byte) {
+	return func(read bool, b []byte) {
+		direction := "->"
+		if read {
+			direction = "<-"
+		}
+
+		debugf(logger, "%v [%v bytes of the authentication are redacted]\n", direction, len(b))
+	}
+}
+
+// Return the address that the clients could reach addr at.
+//
+// If srv.PublicIP is set, it replaces the host of addr, the port is kept
+func (srv *Server) publicAddr(addr net.Addr) *Addr {
+	a := ParseNetAddr(addr)
+	if srv.PublicIP == nil {
+		return a
+	}
+
+	a.Host = srv.PublicIP.String()
+	a.Atyp = parseAtyp(a.Host)
+
+	return a
+}
+
+// Return the address of the UDP relay that is sent to the client.
+//
+// If the relay is bound to the unspecified address, the IP the client reached the server at is sent,
+// so the datagrams are sent from the same IP as the control connection (see udpSourceFilter)
+func (srv *Server) relayAddr(client *Conn, relay *net.UDPConn) *Addr {
+	addr := srv.publicAddr(relay.LocalAddr())
+	if srv.PublicIP != nil || !net.ParseIP(addr.Host).IsUnspecified() {
+		return addr
+	}
+
+	local := ParseNetAddr(client.Raw().LocalAddr())
+	if local == nil || local.Atyp == AddrDomain {
+		return addr
+	}
+
+	addr.Host, addr.Atyp, addr.Zone = local.Host, local.Atyp, local.Zone
+	return addr
+}
+
+// Return the filter of the datagrams sent to the association relay.
+//
+// Only the datagrams sent from the IP address of the control connection are accepted.
+// If DST.ADDR or DST.PORT of the UDP ASSOCIATE request is not zero, the datagrams must be sent from that address or port as well
+func udpSourceFilter(control net.Addr, dst *Addr) func(addr net.Addr) bool {
+	var clientIP net.IP
+	if client := ParseNetAddr(control); client != nil {
+		clientIP = net.ParseIP(client.Host)
+	}
+
+	var dstIP net.IP
+	if dst.Atyp != AddrDomain {
+		dstIP = net.ParseIP(dst.Host)
+	}
+
+	if dstIP != nil && dstIP.IsUnspecified() {
+		dstIP = nil
+	}
+
+	return func(addr net.Addr) bool {
+		udp, ok := addr.(*net.UDPAddr)
+		if !ok || !udp.IP.Equal(clientIP) {
+			return false
+		}
+
+		if dstIP != nil && !udp.IP.Equal(dstIP) {
+			return false
+		}
+
+		return dst.Port == 0 || udp.Port == int(dst.Port)
+	}
+}
+
+// Apply the socket options of the server to the TCP connection
+func (srv *Server) tuneTCP(c net.Conn) {
+	tcp, ok := tcpConnOf(c)
+	if !ok {
+		return
+	}
+
+	if srv.ReadBufferSize != 0 {
+		tcp.SetReadBuffer(srv.ReadBufferSize)
+	}
+
+	if srv.WriteBufferSize != 0 {
+		tcp.SetWriteBuffer(srv.WriteBufferSize)
+	}
+
+	tcp.SetNoDelay(srv.NoDelay)
+}
+
+func (srv *Server) EnableLogger() {
+	srv.Logger.Enable = true
+}
+
+func (srv *Server) DisableLogger() {
+	srv.Logger.Enable = false
+}
+
+// Send the success reply to the client and call srv.OnReplySent
+func (srv *Server) writeReply(ctx context.Context, client *Conn, req *Request, rep *Reply) error {
+	rep.Rsv = srv.ReplyRSV
+
+	err := client.WriteMessage(ctx, rep)
+	if err != nil {
+		return err
+	}
+	srv.emit(EventReply, client, req, rep, nil)
+
+	if srv.OnReplySent != nil {
+		srv.OnReplySent(client, req, rep)
+	}
+
+	return nil
+}
+
+// Send the reply, where r is REP and the BND.ADDR is 0.0.0.0:0.
+// Write errors are logged at the debug level, the caller closes the connection after the reply
+func (srv *Server) sendFailReply(ctx context.Context, c *Conn, r repType) {
+	rep := &Reply{Rep: r, Rsv: srv.ReplyRSV, Bnd: NilAddr.Clone()}
+
+	err := c.WriteMessage(ctx, rep)
+	if err != nil {
+		debugf(c.Logger(), "Unable to send the failure reply (%v): %v\n", r, err)
+		return
+	}
+	srv.emit(EventReply, c, nil, rep, nil)
+}
+
+// Enable or disable maintenance mode.
+//
+// In maintenance mode the server completes handshakes, but replies with Server.MaintenanceReply to all the requests.
+// It is safe to call SetMaintenance while the server is running
+func (srv *Server) SetMaintenance(on bool) {
+	srv.maintenance.Store(on)
+}
+
+// True, if the server is in maintenance mode
+func (srv *Server) Maintenance() bool {
+	return srv.maintenance.Load()
+}
+
+// Set the authentication method.
+//
+// It is safe to call SetAuth while the server is serving connections. Established connections are not affected
+func (srv *Server) SetAuth(auth Auth) {
+	srv.authMu.Lock()
+	defer srv.authMu.Unlock()
+
+	srv.Auth = auth
+}
+
+// Set the authentication methods offered to the clients.
+//
+// It is safe to call SetAuths while the server is serving connections. Established connections are not affected
+func (srv *Server) SetAuths(auths ...Auth) {
+	srv.authMu.Lock()
+	defer srv.authMu.Unlock()
+
+	srv.Auths = auths
+}
+
+// Return the authentication methods offered to the clients (Server.Auths or Server.Auth, if Server.Auths is empty)
+func (srv *Server) currentAuths() []Auth {
+	srv.authMu.RLock()
+	defer srv.authMu.RUnlock()
+
+	if len(srv.Auths) != 0 {
+		return srv.Auths
+	}
+
+	return []Auth{srv.Auth}
+}
+
+// Return the authentication methods offered to the client at remote (Server.AuthsFor or the current methods, if it returns no methods)
+func (srv *Server) authsFor(remote net.Addr) []Auth {
+	if srv.AuthsFor != nil {
+		if auths := srv.AuthsFor(remote); len(auths) != 0 {
+			return auths
+		}
 	}
 
-	return &tcpConn{client, server, req}, nil
+	return srv.currentAuths()
 }
 
-// Handle the BIND request and return the connection that is ready to transfer data.
+// Authenticate the client using the appropriate authentication method.
 //
-// Error is returned, if the incoming connection can not be accepted
-func (srv *Server) handleBIND(ctx context.Context, client *Conn, req *Request) (conn, error) {
-	bind, err := srv.listen(ctx, "tcp", extractPort(req.Dst.String()), true)
+// err is returned, if the client does not support the selected authentication method or credentials are wrong
+func (srv *Server) auth(client *Conn) (err error) {
+	var auth Auth
+
+	if srv.OnHandshakeComplete != nil {
+		start := time.Now()
+		defer func() {
+			method := MethodNoAcceptable
+			if auth != nil {
+				method = auth.Method()
+			}
+
+			srv.OnHandshakeComplete(client, method, time.Since(start), err)
+		}()
+	}
+	defer func() { srv.emit(EventHandshake, client, nil, nil, err) }()
+
+	auth, err = srv.negotiate(client, srv.authsFor(client.Raw().RemoteAddr()))
 	if err != nil {
-		errctx := makeErrorContext(client, req, RepServerFailure)
-		return nil, SOCKSError(errctx.Code, errctx)
+		return err
 	}
 
-	listener := bind.(net.Listener)
-	defer listener.Close()
+	ctx, cancel := srv.phaseContext(srv.ctx, srv.AuthTimeout)
+	defer cancel()
 
-	// first reply that contains the address that the server is listening at
-	rep := &Reply{Rep: RepSucceeded, Bnd: ParseNetAddr(listener.Addr())}
-	err = client.WriteMessage(ctx, rep)
-	if err != nil {
-		return nil, err
+	if client.trace != nil {
+		trace := client.trace
+		client.trace = redactTrace(client.logger)
+
+		defer func() { client.trace = trace }()
 	}
 
-	server, err := listener.Accept()
+	err = auth.Reply(ctx, client)
 	if err != nil {
-		errctx := makeErrorContext(client, req, RepServerFailure)
-		return nil, SOCKSError(errctx.Code, errctx)
+		return err
 	}
+	client.completeHandshake()
 
-	// second reply that contains the server remote address
-	rep.Bnd = ParseNetAddr(server.RemoteAddr())
-	err = client.WriteMessage(ctx, rep)
-
-	return &tcpConn{client, server, req}, err
+	return nil
 }
 
-// Handle the UDP ASSOCIATE request and return the connection that is ready to transfer data.
-// It binds two UDP connections for incoming and outgoing data.
+// Read the negotiation request and choose the authentication method within Server.NegotiationTimeout.
 //
-// Error is returned, if the UDP connections can not be binded
-func (srv *Server) handleUDP(ctx context.Context, client *Conn, req *Request) (conn, error) {
-	bind, err := srv.listen(ctx, "udp", req.Dst.String(), true)
+// The first method offered by the client that is supported by the server is chosen
+func (srv *Server) negotiate(client *Conn, auths []Auth) (Auth, error) {
+	ctx, cancel := srv.phaseContext(srv.ctx, srv.NegotiationTimeout)
+	defer cancel()
+
+	req, err := srv.readNegotiation(ctx, client)
 	if err != nil {
-		errctx := makeErrorContext(client, req, RepServerFailure)
-		return nil, SOCKSError(errctx.Code, errctx)
+		return nil, err
+	}
+	if srv.LogAuthMethods {
+		debugf(client.Logger(), "The client offers the authentication methods %v\n", req.Methods)
 	}
 
-	outcome := bind.(*net.UDPConn)
+	if srv.MaxAuthMethods != 0 && len(req.Methods) > srv.MaxAuthMethods {
+		return nil, ErrProtocol.New("too many authentication methods (%v) are offered by %v", len(req.Methods), client.Raw().RemoteAddr())
+	}
 
-	bind, err = srv.listen(ctx, "udp", randomAddress(), false)
-	if err != nil {
-		errctx := makeErrorContext(client, req, RepServerFailure)
-		return nil, SOCKSError(errctx.Code, errctx)
+	auth := selectAuth(req.Methods, auths)
+	if auth == nil {
+		client.WriteMessage(ctx, &NegotiationReply{Method: MethodNoAcceptable})
+		return nil, ErrProtocol.New("neither of the authentication methods %v offered by %v are supported", req.Methods, client.Raw().RemoteAddr())
 	}
 
-	income := bind.(*net.UDPConn)
+	return auth, Negotiator.WriteReply(ctx, client, req, auth.Method())
+}
 
-	rep := &Reply{Rep: RepSucceeded, Bnd: ParseNetAddr(outcome.LocalAddr())}
-	err = client.WriteMessage(ctx, rep)
-	if err != nil {
-		return nil, err
+// Return the authenticator of the first method in methods that is supported by one of auths.
+// Return nil, if neither of the methods is supported
+func selectAuth(methods []authMethod, auths []Auth) Auth {
+	for _, method := range methods {
+		for _, auth := range auths {
+			if auth != nil && auth.Method() == method {
+				return auth
+			}
+		}
 	}
 
-	return &udpConn{
-		Buffer:  srv.UDPBuffer,
-		client:  client,
-		income:  income,
-		outcome: NewUDPConnSize(client.Raw(), outcome, srv.UDPBuffer),
-		req:     req,
-	}, nil
+	return nil
 }
 
-func (srv *Server) EnableLogger() {
-	srv.Logger.Enable = true
-}
+// Read the negotiation request.
+//
+// If Server.RequireValidHandshake is set, the request must be received within validHandshakeWindow
+// and errInvalidHandshake is returned, if the request is not received or malformed
+func (srv *Server) readNegotiation(ctx context.Context, client *Conn) (*NegotiationRequest, error) {
+	if srv.RequireValidHandshake {
+		window, cancel := context.WithTimeout(ctx, validHandshakeWindow)
+		defer cancel()
 
-func (srv *Server) DisableLogger() {
-	srv.Logger.Enable = false
-}
+		ctx = window
+	}
 
-// Send the reply, where r is REP and the BND.ADDR is 0.0.0.0:0
-func (srv *Server) sendFailReply(ctx context.Context, c *Conn, r repType) {
-	rep := &Reply{r, NilAddr}
-	c.WriteMessage(ctx, rep)
+	req, err := Negotiator.ReadRequest(ctx, client)
+	if errorx.IsOfType(err, ErrVersion) {
+		err = srv.versionMismatch(client, err)
+	}
+
+	if err != nil && srv.RequireValidHandshake {
+		return nil, errInvalidHandshake.Wrap(err, "%v did not send a valid negotiation request", client.Raw().RemoteAddr())
+	}
+
+	return req, err
 }
 
-// Authenticate the client using the appropriate authentication method.
+// Collect the first bytes sent by the client that does not speak SOCKS5 and send Server.VersionMismatchReply.
 //
-// err is returned, if the client does not support the selected authentication method or credentials are wrong
-func (srv *Server) auth(client *Conn) error {
-	err := Negotiator.Reply(srv.ctx, client, srv.Auth.Method())
-	if err != nil {
-		return err
+// The returned error contains the first bytes to identify the misdirected traffic
+func (srv *Server) versionMismatch(client *Conn, err error) error {
+	var head []byte
+	if prop, ok := errorx.ExtractProperty(err, propHead); ok {
+		head = prop.([]byte)
 	}
 
-	err = srv.Auth.Reply(srv.ctx, client)
-	if err != nil {
-		return err
+	raw := client.Raw()
+
+	b := make([]byte, versionMismatchHead)
+	raw.SetReadDeadline(time.Now().Add(versionMismatchWait))
+
+	n, _ := raw.Read(b)
+	head = append(head, b[:n]...)
+
+	if srv.VersionMismatchReply != nil {
+		raw.SetWriteDeadline(time.Now().Add(versionMismatchWait))
+		raw.Write(srv.VersionMismatchReply)
 	}
 
-	return nil
+	return ErrVersion.Wrap(err, "%v does not speak SOCKS5, the first bytes are %q", raw.RemoteAddr(), head)
 }
 
 func (srv *Server) timeoutEnabled() bool {
@@ -277,7 +1684,10 @@ func (srv *Server) listen(ctx context.Context, network, addr string, tryRandomPo
 	if err != nil {
 		// second try to bind the port. If it fails, the error is returned
 		if tryRandomPort {
-			return srv.listen(ctx, network, randomAddress(), false)
+			random := randomAddress()
+			srv.Logger.Debugf("Unable to listen at %v (%v), trying the random address %v\n", addr, err, random)
+
+			return srv.listen(ctx, network, random, false)
 		}
 
 		return nil, err
@@ -304,13 +1714,15 @@ func (srv *Server) makeListener(ctx context.Context, network, addr string) (any,
 
 // conn represents the server side of SOCKS5 connection
 type conn interface {
-	Transfer(ctx context.Context) // Start transfering data between the client and the server
-	Close()                       // Close the client and the server connections
+	Transfer(ctx context.Context) error // Transfer data between the client and the server. Error is returned, if the transfer is failed
+	Close()                             // Close the client and the server connections
 
 	Client() *Conn
 	Server() net.Conn
 
 	Request() *Request
+
+	idleFor() time.Duration // Duration since the last transferred data
 }
 
 // tcpConn represents the server side of connections made by CONNECT and BIND methods
@@ -318,29 +1730,88 @@ type tcpConn struct {
 	client *Conn
 	server net.Conn
 
-	req *Request
+	req   *Request
+	stats *serverStats
+
+	transferer   Transferer    // copies the data in each direction
+	onClose      func()        // called on Close (nil, if there is nothing to release)
+	idleTimeout  time.Duration // the transfer is finished, if no data is transferred during the timeout
+	flushTimeout time.Duration // time the data in flight is relayed for, when the session duration is expired
+
+	activity
 }
 
-func (c *tcpConn) Transfer(ctx context.Context) {
-	result := make(chan struct{})
+func (c *tcpConn) Transfer(ctx context.Context) error {
+	result := make(chan error, 2)
+	c.touch()
 
 	go c.transferTo(result, c.server, c.client.Raw())
 	go c.transferTo(result, c.client.Raw(), c.server)
 
-	select {
-	case <-ctx.Done():
-	case <-result:
+	idle, stop := idleTicker(c.idleTimeout)
+	defer stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if c.flushTimeout > 0 && ctx.Err() == context.DeadlineExceeded {
+				c.flush(result)
+			}
+
+			return nil
+
+		case err := <-result:
+			return err
+
+		case <-idle:
+			if c.idleFor() >= c.idleTimeout {
+				return nil
+			}
+		}
+	}
+}
+
+// Stop reading the client and half-close the destination, so it gets EOF,
+// then relay the data in flight till both directions are finished or c.flushTimeout is expired.
+// Nothing is flushed, if one of the connections is not a TCP connection
+func (c *tcpConn) flush(result chan error) {
+	client, ok := tcpConnOf(c.client.Raw())
+	if !ok {
+		return
+	}
+
+	server, ok := tcpConnOf(c.server)
+	if !ok {
+		return
+	}
+
+	client.CloseRead()
+	server.CloseWrite()
+
+	timer := time.NewTimer(c.flushTimeout)
+	defer timer.Stop()
+
+	for finished := 0; finished < 2; finished++ {
+		select {
+		case <-result:
+		case <-timer.C:
+			return
+		}
 	}
 }
 
-func (c *tcpConn) transferTo(result chan struct{}, to io.Writer, from io.Reader) {
-	io.Copy(to, from)
-	result <- struct{}{}
+func (c *tcpConn) transferTo(result chan error, to io.Writer, from io.Reader) {
+	_, err := c.transferer.Transfer(&countWriter{w: to, stats: c.stats, activity: &c.activity}, from)
+	result <- transferError(err)
 }
 
 func (c *tcpConn) Close() {
 	c.client.Close()
 	c.server.Close()
+
+	if c.onClose != nil {
+		c.onClose()
+	}
 }
 
 func (c *tcpConn) Client() *Conn {
@@ -357,65 +1828,365 @@ func (c *tcpConn) Request() *Request {
 
 // udpConn represents the server side of connections made by UDP ASSOCIATE
 type udpConn struct {
-	Buffer int
+	Buffer      int
+	Pool        BufferPool    // buffers for datagrams relayed to the client (Buffer is used, if Pool is nil)
+	IdleTimeout time.Duration // the connection is closed, if no datagram is relayed during the timeout
+	Strict      bool          // drop datagrams with non-zero RSV field
+	Broadcast   bool          // relay datagrams to broadcast destinations
+	Drain       bool          // relay the queued datagrams for udpDrainTimeout before closing the sockets
 
 	client *Conn
 
 	outcome *UDPConn     // outgoing UDP headers from the client
-	income  *net.UDPConn // incoming UDP packets to the client
+	income  *net.UDPConn // incoming UDP packets to the client (nil, if the sockets are shared)
+	income6 *net.UDPConn // incoming UDP packets from IPv6 destinations, if income is bound to IPv4 only
+
+	result    chan error     // results of the transfer goroutines
+	transfers sync.WaitGroup // running transfer goroutines
+
+	share     *udpShare                // shared outgoing sockets (nil, if income is used)
+	sockets   map[string]*sharedSocket // shared sockets acquired by the association
+	socketsMu sync.Mutex               // guards sockets, income6 and closed
+	closed    bool                     // no sockets may be acquired after Close
+
+	req   *Request
+	stats *serverStats
 
-	req *Request
+	rate *limiter // limits the number of relayed datagrams (nil, if there is no limit)
+
+	rules      Rules           // checks the destinations of the datagrams (nil allows all the destinations)
+	rulesCtx   context.Context // context the destinations are checked with
+	verdicts   map[string]bool // results of the checks by the destination, so the rules are not run (and do not resolve) per datagram
+	verdictsMu sync.Mutex
+
+	activity
 }
 
-func (c *udpConn) Transfer(ctx context.Context) {
-	result := make(chan struct{})
+func (c *udpConn) Transfer(ctx context.Context) error {
+	result := make(chan error, 3)
+	c.result = result
+	c.touch()
 
+	c.transfers.Add(1)
 	go c.transferIncome(result)
-	go c.transferOutcome(result)
 
-	select {
-	case <-ctx.Done():
-	case <-result:
+	if c.share == nil {
+		c.transfers.Add(1)
+		go c.transferOutcome(result, c.income)
+	}
+
+	idle, stop := idleTicker(c.IdleTimeout)
+	defer stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case err := <-result:
+			return err
+
+		case <-idle:
+			if c.idleFor() >= c.IdleTimeout {
+				return nil
+			}
+		}
+	}
+}
+
+// Return the channel of the idle checks for the timeout (every timeout/2, but not more often than minIdleCheckInterval)
+// and the function that stops the checks. The channel is nil, if timeout <= 0, so the checks are disabled
+func idleTicker(timeout time.Duration) (<-chan time.Time, func()) {
+	if timeout <= 0 {
+		return nil, func() {}
+	}
+
+	interval := timeout / 2
+	if interval < minIdleCheckInterval {
+		interval = minIdleCheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	return ticker.C, ticker.Stop
+}
+
+// True, if the datagram could be sent to dst according to c.rules
+func (c *udpConn) allowDst(dst *Addr) bool {
+	if c.rules == nil {
+		return true
+	}
+
+	key := dst.String()
+
+	c.verdictsMu.Lock()
+	ok, cached := c.verdicts[key]
+	c.verdictsMu.Unlock()
+
+	if cached {
+		return ok
+	}
+
+	ok, _ = c.rules.Allow(c.rulesCtx, CmdUDP, dst)
+
+	c.verdictsMu.Lock()
+	defer c.verdictsMu.Unlock()
+
+	// the destinations are not limited, so the cache is reset instead of growing forever
+	if c.verdicts == nil || len(c.verdicts) >= maxCachedVerdicts {
+		c.verdicts = make(map[string]bool)
 	}
+	c.verdicts[key] = ok
+
+	return ok
+}
+
+// True, if the datagram could be relayed within the rate limit
+func (c *udpConn) allow() bool {
+	return c.rate == nil || c.rate.Allow()
 }
 
-func (c *udpConn) transferIncome(result chan struct{}) {
+func (c *udpConn) transferIncome(result chan error) {
+	defer c.transfers.Done()
+
+	var err error
+
 	for {
-		header, err := c.outcome.ReadHeader()
+		var header *UDPHeader
+
+		header, err = c.outcome.ReadHeaderInto(c.outcome.income)
 		if err != nil {
 			break
 		}
 
-		_, err = c.income.WriteTo(header.Data, header.Dst.UDP())
+		if c.Strict && header.Rsv != 0x0000 {
+			continue
+		}
+
+		if !c.Broadcast && isBroadcast(header.Dst) {
+			continue
+		}
+
+		if !c.allowDst(header.Dst) {
+			continue
+		}
+
+		if !c.allow() {
+			continue
+		}
+
+		var n int
+
+		n, err = c.writeTo(header.Data, header.Dst)
 		if err != nil {
 			break
 		}
+		c.stats.addBytes(n)
+		c.touch()
 	}
 
-	result <- struct{}{}
+	result <- transferError(err)
 }
 
-func (c *udpConn) transferOutcome(result chan struct{}) {
-	b := make([]byte, c.Buffer)
+// Relay the datagrams received by the socket to the client
+func (c *udpConn) transferOutcome(result chan error, socket *net.UDPConn) {
+	defer c.transfers.Done()
+
+	var b []byte
+	if c.Pool == nil {
+		b = make([]byte, c.Buffer)
+	}
+
+	var err error
 
 	for {
-		n, addr, err := c.income.ReadFrom(b)
+		err = c.relayOutcome(socket, b)
 		if err != nil {
 			break
 		}
+	}
 
-		_, err = c.outcome.WriteTo(b[:n], addr)
+	result <- transferError(err)
+}
+
+// Relay a datagram received by the socket to the client.
+// If b is nil, the buffer is taken from c.Pool, when the datagram is received, so idle associations do not hold buffers
+func (c *udpConn) relayOutcome(socket *net.UDPConn, b []byte) error {
+	if b == nil {
+		err := waitReadable(socket)
 		if err != nil {
-			break
+			return err
+		}
+
+		b = c.Pool.Get()
+		defer c.Pool.Put(b)
+	}
+
+	n, addr, err := socket.ReadFrom(b)
+	if err != nil {
+		return err
+	}
+
+	if !c.allow() {
+		return nil
+	}
+
+	n, err = c.outcome.WriteTo(b[:n], addr)
+	if err != nil {
+		return err
+	}
+	c.stats.addBytes(n)
+	c.touch()
+
+	return nil
+}
+
+// Send the datagram to the destination through the own or the shared socket
+func (c *udpConn) writeTo(b []byte, dst *Addr) (int, error) {
+	addr := dst.UDP()
+
+	if c.share == nil {
+		income, err := c.incomeFor(addr.(*net.UDPAddr).IP)
+		if err != nil {
+			return 0, err
 		}
+
+		return income.WriteTo(b, addr)
+	}
+
+	socket, err := c.sharedSocket(dst.String(), addr.(*net.UDPAddr).IP)
+	if err != nil {
+		return 0, err
+	}
+
+	return socket.send(c, b, addr)
+}
+
+// Return the own socket that is able to send datagrams to ip.
+//
+// If c.income is bound to IPv4 only (the host does not support dual-stack sockets),
+// an IPv6 socket is bound for IPv6 destinations on the first use
+func (c *udpConn) incomeFor(ip net.IP) (*net.UDPConn, error) {
+	if ip == nil || ip.To4() != nil || !isIPv4Only(c.income) {
+		return c.income, nil
+	}
+
+	c.socketsMu.Lock()
+	defer c.socketsMu.Unlock()
+
+	if c.closed {
+		return nil, net.ErrClosed
+	}
+
+	if c.income6 != nil {
+		return c.income6, nil
+	}
+
+	pc, err := net.ListenPacket("udp6", randomAddress())
+	if err != nil {
+		return nil, err
+	}
+	c.income6 = pc.(*net.UDPConn)
+
+	c.transfers.Add(1)
+	go c.transferOutcome(c.result, c.income6)
+
+	return c.income6, nil
+}
+
+// Return the shared socket for the destination, acquiring it on the first use
+func (c *udpConn) sharedSocket(dst string, ip net.IP) (*sharedSocket, error) {
+	c.socketsMu.Lock()
+	defer c.socketsMu.Unlock()
+
+	if c.closed {
+		return nil, net.ErrClosed
+	}
+
+	if c.sockets == nil {
+		c.sockets = make(map[string]*sharedSocket)
+	}
+
+	socket, ok := c.sockets[dst]
+	if ok {
+		return socket, nil
+	}
+
+	socket, err := c.share.acquire(dst, udpNetwork(ip), c.Buffer, c.Broadcast)
+	if err != nil {
+		return nil, err
+	}
+	c.sockets[dst] = socket
+
+	return socket, nil
+}
+
+// Relay the response received by a shared socket to the client
+func (c *udpConn) deliver(b []byte, addr net.Addr) {
+	if !c.allow() {
+		return
 	}
 
-	result <- struct{}{}
+	n, err := c.outcome.WriteTo(b, addr)
+	if err != nil {
+		return
+	}
+	c.stats.addBytes(n)
+	c.touch()
 }
 
 func (c *udpConn) Close() {
-	c.income.Close()
+	if c.Drain {
+		c.drain()
+	}
+
+	if c.income != nil {
+		c.income.Close()
+	}
 	c.outcome.Close()
+
+	c.socketsMu.Lock()
+	if c.income6 != nil {
+		c.income6.Close()
+	}
+
+	for dst, socket := range c.sockets {
+		c.share.release(dst, socket, c)
+	}
+	c.sockets = nil
+	c.closed = true
+	c.socketsMu.Unlock()
+}
+
+// Let the transfer goroutines relay the queued datagrams till udpDrainTimeout is expired.
+// The datagrams queued in the shared sockets are not drained, cause the sockets are used by other associations
+func (c *udpConn) drain() {
+	deadline := time.Now().Add(udpDrainTimeout)
+
+	c.outcome.SetReadDeadline(deadline)
+	if c.income != nil {
+		c.income.SetReadDeadline(deadline)
+	}
+
+	c.socketsMu.Lock()
+	if c.income6 != nil {
+		c.income6.SetReadDeadline(deadline)
+	}
+	c.socketsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.transfers.Wait()
+		close(done)
+	}()
+
+	// a socket could be opened after the deadline is set, it is closed after the timeout anyway
+	timer := time.NewTimer(2 * udpDrainTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+	case <-timer.C:
+	}
 }
 
 func (c *udpConn) Client() *Conn {
@@ -430,6 +2201,44 @@ func (c *udpConn) Request() *Request {
 	return c.req
 }
 
+// Return the underlying *net.TCPConn of c (c could be wrapped, e.g. in TLS)
+func tcpConnOf(c net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch conn := c.(type) {
+		case *net.TCPConn:
+			return conn, true
+
+		case interface{ NetConn() net.Conn }:
+			c = conn.NetConn()
+
+		default:
+			return nil, false
+		}
+	}
+}
+
+// Return the error that caused the transfer to stop.
+//
+// nil is returned, if the transfer was stopped, cause one of the connections is closed
+func transferError(err error) error {
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) || errorx.IsOfType(err, ErrAssociationClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// True, if addr is the limited broadcast address (255.255.255.255) or the directed broadcast address of a local IPv4 network.
+// Multicast addresses are not broadcast ones, datagrams to them do not need SO_BROADCAST
+func isBroadcast(addr *Addr) bool {
+	ip := net.ParseIP(addr.Host).To4()
+	if ip == nil {
+		return false
+	}
+
+	return ip.Equal(net.IPv4bcast) || localBroadcasts.contains(ip)
+}
+
 // Return an address in format ":port" with random port. Port interval is [2500, 65535]
 func randomAddress() string {
 	p := rand.Intn(63035) + 2500
@@ -438,6 +2247,26 @@ func randomAddress() string {
 	return net.JoinHostPort("", s)
 }
 
+// True, if the socket is bound to an IPv4 address and can not send datagrams to IPv6 destinations
+func isIPv4Only(c *net.UDPConn) bool {
+	addr, ok := c.LocalAddr().(*net.UDPAddr)
+	return ok && addr.IP.To4() != nil
+}
+
+// Return the network of the socket that sends datagrams to ip ("udp4" or "udp6").
+// "udp" is returned, if ip is not an IP address
+func udpNetwork(ip net.IP) string {
+	switch {
+	case ip.To4() != nil:
+		return "udp4"
+
+	case ip != nil:
+		return "udp6"
+	}
+
+	return "udp"
+}
+
 // Split the addr to host/port and return the port
 func extractPort(addr string) string {
 	_, port, _ := net.SplitHostPort(addr)
@@ -0,0 +1,155 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// Return the integer socket option of the TCP connection
+func sockoptInt(t *testing.T, c net.Conn, level, opt int) int {
+	t.Helper()
+
+	raw, err := c.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var value int
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		value, serr = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return value
+}
+
+// Return the client and the upstream connections of the CONNECT session made through the server configured by setup
+func sessionConns(t *testing.T, setup func(srv *Server)) (client, upstream net.Conn) {
+	t.Helper()
+
+	clients := make(chan net.Conn, 1)
+	upstreams := make(chan net.Conn, 1)
+	_, addr := startServer(t, func(srv *Server) {
+		setup(srv)
+
+		srv.OnHandshakeComplete = func(conn *Conn, method authMethod, dur time.Duration, err error) {
+			clients <- conn.Raw()
+		}
+		srv.WrapUpstream = func(ctx context.Context, conn net.Conn, req *Request) (net.Conn, error) {
+			upstreams <- conn
+			return conn, nil
+		}
+	})
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return <-clients, <-upstreams
+}
+
+func TestSocketBufferSizes(t *testing.T) {
+	const size = 256 << 10
+
+	client, upstream := sessionConns(t, func(srv *Server) {
+		srv.ReadBufferSize = size
+		srv.WriteBufferSize = size
+	})
+
+	for name, c := range map[string]net.Conn{"client": client, "upstream": upstream} {
+		// Linux doubles the requested size for the bookkeeping overhead
+		if rcv := sockoptInt(t, c, syscall.SOL_SOCKET, syscall.SO_RCVBUF); rcv < size {
+			t.Errorf("%v: the receive buffer is %v bytes", name, rcv)
+		}
+
+		if snd := sockoptInt(t, c, syscall.SOL_SOCKET, syscall.SO_SNDBUF); snd < size {
+			t.Errorf("%v: the send buffer is %v bytes", name, snd)
+		}
+	}
+}
+
+func TestNoDelay(t *testing.T) {
+	for _, noDelay := range []bool{true, false} {
+		client, upstream := sessionConns(t, func(srv *Server) {
+			srv.NoDelay = noDelay
+		})
+
+		for name, c := range map[string]net.Conn{"client": client, "upstream": upstream} {
+			if got := sockoptInt(t, c, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0; got != noDelay {
+				t.Errorf("NoDelay %v, %v: TCP_NODELAY is %v", noDelay, name, got)
+			}
+		}
+	}
+}
+
+// Return the accept backlog of the listener. TCP_INFO of the listening socket reports it in tcpi_sacked
+func listenBacklog(t *testing.T, l net.Listener) int {
+	t.Helper()
+
+	raw, err := l.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var info syscall.TCPInfo
+	var errno syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(info))
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err == nil && errno != 0 {
+		err = errno
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return int(info.Sacked)
+}
+
+// Return the listener of the running server
+func serverListener(srv *Server) net.Listener {
+	srv.listenerMu.Lock()
+	defer srv.listenerMu.Unlock()
+
+	return srv.listener
+}
+
+func TestServerBacklog(t *testing.T) {
+	srv, addr := startServer(t, func(srv *Server) {
+		srv.Backlog = 7
+	})
+
+	if backlog := listenBacklog(t, serverListener(srv)); backlog != 7 {
+		t.Fatalf("the listen backlog is %v", backlog)
+	}
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c, "ping")
+}
+
+func TestServerDefaultBacklog(t *testing.T) {
+	srv, _ := startServer(t, nil)
+
+	if backlog := listenBacklog(t, serverListener(srv)); backlog == 7 || backlog == 0 {
+		t.Fatalf("the default listen backlog is %v", backlog)
+	}
+}
@@ -0,0 +1,3216 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Start the server listening at a random loopback port. setup is called before the server starts (nil keeps the defaults).
+// The server is closed, when the test is finished
+func startServer(t *testing.T, setup func(srv *Server)) (*Server, string) {
+	t.Helper()
+
+	srv := NewServer("127.0.0.1:0")
+	srv.DisableLogger()
+
+	if setup != nil {
+		setup(srv)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	<-srv.Ready()
+	return srv, l.Addr().String()
+}
+
+// Start the TCP server that echoes everything it reads. It is closed, when the test is finished
+func startEcho(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// Return the context that is cancelled after d or when the test is finished
+func testContext(t *testing.T, d time.Duration) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	t.Cleanup(cancel)
+
+	return ctx
+}
+
+// Write msg to c and check, that the same bytes are read back
+func checkEcho(t *testing.T, c net.Conn, msg string) {
+	t.Helper()
+
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	defer c.SetDeadline(time.Time{})
+
+	_, err := c.Write([]byte(msg))
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	b := make([]byte, len(msg))
+	_, err = io.ReadFull(c, b)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	if string(b) != msg {
+		t.Fatalf("echo: got %q, want %q", b, msg)
+	}
+}
+
+func TestMaxConcurrentHandshakesSlowClientBlocks(t *testing.T) {
+	_, addr := startServer(t, func(srv *Server) {
+		srv.MaxConcurrentHandshakes = 1
+	})
+	echo := startEcho(t)
+
+	// the slow client holds the only handshake slot without sending the negotiation
+	slow, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	_, err = NewClient(addr).Connect(ctx, echo)
+	if err == nil {
+		t.Fatal("the handshake is completed, while the slot is held by the slow client")
+	}
+
+	slow.Close()
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), echo)
+	if err != nil {
+		t.Fatalf("the slot is not released by the closed client: %v", err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c, "ping")
+}
+
+func TestMaxConcurrentHandshakesSilentClientTimesOut(t *testing.T) {
+	_, addr := startServer(t, func(srv *Server) {
+		srv.MaxConcurrentHandshakes = 1
+	})
+	echo := startEcho(t)
+
+	// the silent client holds the only slot till limitedHandshakeTimeout is expired, no timeout is set
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	time.Sleep(50 * time.Millisecond)
+
+	c, err := NewClient(addr).Connect(testContext(t, 2*limitedHandshakeTimeout), echo)
+	if err != nil {
+		t.Fatalf("the slot is not released after the handshake timeout: %v", err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c, "ping")
+}
+
+func TestMaxConcurrentHandshakesNegative(t *testing.T) {
+	_, addr := startServer(t, func(srv *Server) {
+		srv.MaxConcurrentHandshakes = -1
+	})
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatalf("the negative limit: %v", err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c, "ping")
+}
+
+func TestMaxConcurrentHandshakesParkedBind(t *testing.T) {
+	_, addr := startServer(t, func(srv *Server) {
+		srv.MaxConcurrentHandshakes = 1
+	})
+	echo := startEcho(t)
+
+	bindAddr := make(chan net.Addr, 1)
+	bindErr := make(chan error, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		_, err := NewClient(addr).Bind(ctx, "127.0.0.1:0", bindAddr)
+		bindErr <- err
+	}()
+
+	select {
+	case <-bindAddr:
+	case err := <-bindErr:
+		t.Fatalf("bind: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first BIND reply is not received")
+	}
+
+	// the BIND request waits for the incoming connection, but the handshake is finished
+	c, err := NewClient(addr).Connect(testContext(t, 2*time.Second), echo)
+	if err != nil {
+		t.Fatalf("the handshake slot is held by the parked BIND: %v", err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c, "ping")
+}
+
+// Start the DNS server that answers the A queries of any name with ips and the other queries with no records.
+// Return the resolver that queries the server
+func startDNS(t *testing.T, ips ...net.IP) *net.Resolver {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+
+			pc.WriteTo(dnsAnswer(b[:n], ips), addr)
+		}
+	}()
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", pc.LocalAddr().String())
+		},
+	}
+}
+
+// Return the answer to the DNS query q
+func dnsAnswer(q []byte, ips []net.IP) []byte {
+	// the question follows the header: name, type (2 bytes), class (2 bytes).
+	// The additional records of the query (EDNS) are dropped
+	end := 12
+	for q[end] != 0 {
+		end += int(q[end]) + 1
+	}
+	end += 5
+
+	qtype := uint16(q[end-4])<<8 | uint16(q[end-3])
+
+	answers := 0
+	if qtype == 1 {
+		answers = len(ips)
+	}
+
+	rep := append([]byte{}, q[:2]...)                              // ID
+	rep = append(rep, 0x81, 0x80, 0x00, 0x01, 0x00, byte(answers)) // flags, QDCOUNT, ANCOUNT
+	rep = append(rep, 0x00, 0x00, 0x00, 0x00)                      // NSCOUNT, ARCOUNT
+	rep = append(rep, q[12:end]...)                                // question
+
+	for _, ip := range ips[:answers] {
+		rep = append(rep, 0xc0, 0x0c)             // pointer to the name of the question
+		rep = append(rep, 0x00, 0x01, 0x00, 0x01) // type A, class IN
+		rep = append(rep, 0x00, 0x00, 0x00, 0x3c) // TTL
+		rep = append(rep, 0x00, 0x04)
+		rep = append(rep, ip.To4()...)
+	}
+
+	return rep
+}
+
+// Dialer that records the addresses it is asked to dial
+type recordingDialer struct {
+	net.Dialer
+	addrs chan string
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.addrs <- address
+	return d.Dialer.DialContext(ctx, network, address)
+}
+
+func TestConnectTriesAllResolvedAddresses(t *testing.T) {
+	echo := startEcho(t)
+	_, port, _ := net.SplitHostPort(echo)
+
+	// nobody listens at 127.0.0.2, so the first address is refused
+	resolver := startDNS(t, net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1"))
+
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Dialer = &net.Dialer{Timeout: time.Second, Resolver: resolver}
+	})
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), net.JoinHostPort("echo.test", port))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c, "ping")
+}
+
+func TestConnectSplitsDialTimeout(t *testing.T) {
+	echo := startEcho(t)
+	_, port, _ := net.SplitHostPort(echo)
+
+	resolver := startDNS(t, net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1"))
+
+	_, addr := startServer(t, func(srv *Server) {
+		srv.DialTimeout = 4 * time.Second
+		srv.Dialer = &net.Dialer{
+			Resolver: resolver,
+			// 127.0.0.2 is blackholed: the connection attempt hangs till its deadline
+			ControlContext: func(ctx context.Context, network, address string, c syscall.RawConn) error {
+				if strings.HasPrefix(address, "127.0.0.2:") {
+					<-ctx.Done()
+					return ctx.Err()
+				}
+
+				return nil
+			},
+		}
+	})
+
+	start := time.Now()
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), net.JoinHostPort("echo.test", port))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer c.Close()
+
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("the blackholed address takes %v", elapsed)
+	}
+
+	checkEcho(t, c, "ping")
+}
+
+func TestConnectUnreachableResolvedAddresses(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	resolver := startDNS(t, net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1"))
+
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Dialer = &net.Dialer{Timeout: time.Second, Resolver: resolver}
+	})
+
+	_, err = NewClient(addr).Connect(testContext(t, 5*time.Second), net.JoinHostPort("dead.test", port))
+	if code, _ := ReplyCodeOf(err); code != RepConnRefused {
+		t.Fatalf("reply code: got %v, want %v (%v)", code, RepConnRefused, err)
+	}
+}
+
+func TestConnectCustomDialerGetsDomain(t *testing.T) {
+	echo := startEcho(t)
+	_, port, _ := net.SplitHostPort(echo)
+
+	dialer := &recordingDialer{addrs: make(chan string, 1)}
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Dialer = dialer
+	})
+
+	target := net.JoinHostPort("localhost", port)
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), target)
+	if err == nil {
+		c.Close()
+	}
+
+	select {
+	case got := <-dialer.addrs:
+		if got != target {
+			t.Fatalf("custom dialer: got %q, want %q", got, target)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("the custom dialer is not called")
+	}
+}
+
+// Complete the negotiation with NoAuth on the raw connection to the server
+func rawHandshake(t *testing.T, addr string) net.Conn {
+	t.Helper()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = c.Write([]byte{Version, 0x01, byte(MethodNotRequired)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rep := make([]byte, 2)
+	_, err = io.ReadFull(c, rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rep[1] != byte(MethodNotRequired) {
+		t.Fatalf("negotiation: the method is %v", rep[1])
+	}
+
+	return c
+}
+
+func TestDuplicateNegotiationRejected(t *testing.T) {
+	tests := []struct {
+		name        string
+		negotiation []byte
+	}{
+		{"two methods", []byte{Version, 0x02, byte(MethodNotRequired), byte(MethodPassword)}},
+		{"one method", []byte{Version, 0x01, byte(MethodNotRequired)}},
+	}
+
+	_, addr := startServer(t, func(srv *Server) {
+		srv.RequestTimeout = 200 * time.Millisecond
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := rawHandshake(t, addr)
+
+			_, err := c.Write(tt.negotiation)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rep := &Reply{}
+			err = rep.Read(c)
+			if err != nil {
+				t.Fatalf("the failure reply is not received: %v", err)
+			}
+
+			if rep.Rep != RepServerFailure {
+				t.Fatalf("reply: got %v, want %v", rep.Rep, RepServerFailure)
+			}
+		})
+	}
+}
+
+func TestUDPNetwork(t *testing.T) {
+	tests := []struct {
+		ip   net.IP
+		want string
+	}{
+		{net.ParseIP("127.0.0.1"), "udp4"},
+		{net.ParseIP("::1"), "udp6"},
+		{nil, "udp"},
+	}
+
+	for _, tt := range tests {
+		if got := udpNetwork(tt.ip); got != tt.want {
+			t.Errorf("udpNetwork(%v) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestUDPRelayIPv6Destination(t *testing.T) {
+	pc, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	defer pc.Close()
+
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+
+			pc.WriteTo(b[:n], addr)
+		}
+	}()
+
+	_, addr := startServer(t, nil)
+
+	c, err := NewClient(addr).UDP(testContext(t, 10*time.Second), "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = c.WriteTo([]byte("ping6"), pc.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readDatagram(t, c, "ping6")
+}
+
+// Return true, if the UDP association is closed within d
+func associationClosed(t *testing.T, c *UDPConn, d time.Duration) bool {
+	t.Helper()
+
+	select {
+	case <-c.done:
+		return true
+
+	case <-time.After(d):
+		return false
+	}
+}
+
+func TestUDPIdleTimeoutSilentAssociation(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		closed  bool
+	}{
+		{"short", 100 * time.Millisecond, true},
+		{"nanosecond", time.Nanosecond, true},
+		{"negative", -time.Second, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := startServer(t, func(srv *Server) {
+				srv.UDPIdleTimeout = tt.timeout
+			})
+
+			c, err := NewClient(addr).UDP(testContext(t, 10*time.Second), "0.0.0.0:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			if closed := associationClosed(t, c, time.Second); closed != tt.closed {
+				t.Fatalf("the silent association is closed: %v, want %v", closed, tt.closed)
+			}
+		})
+	}
+}
+
+// Start the TCP server that accepts connections and never writes to them
+func startStalled(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestIdleTimeoutStalledPeer(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		closed  bool
+	}{
+		{"short", 100 * time.Millisecond, true},
+		{"nanosecond", time.Nanosecond, true},
+		{"negative", -time.Second, false},
+	}
+
+	stalled := startStalled(t)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := startServer(t, func(srv *Server) {
+				srv.IdleTimeout = tt.timeout
+			})
+
+			c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), stalled)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			c.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = c.Read(make([]byte, 1))
+
+			closed := err != nil && !errors.Is(err, os.ErrDeadlineExceeded)
+			if closed != tt.closed {
+				t.Fatalf("the idle session is closed: %v, want %v (%v)", closed, tt.closed, err)
+			}
+		})
+	}
+}
+
+func TestIdleTimeoutActiveSession(t *testing.T) {
+	_, addr := startServer(t, func(srv *Server) {
+		srv.IdleTimeout = 200 * time.Millisecond
+	})
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the session transfers data more often than the timeout, so it is kept
+	for i := 0; i < 6; i++ {
+		checkEcho(t, c, "ping")
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Start the TCP server that reads the connection till EOF, then writes reply and waits for linger before closing it
+func startFarewell(t *testing.T, reply string, linger time.Duration) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+
+				io.Copy(io.Discard, c)
+				c.Write([]byte(reply))
+
+				time.Sleep(linger)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// Read c till EOF or an error and return the read data and the time it took
+func readAll(c net.Conn) (string, time.Duration) {
+	start := time.Now()
+
+	c.SetReadDeadline(start.Add(5 * time.Second))
+	b, _ := io.ReadAll(c)
+
+	return string(b), time.Since(start)
+}
+
+func TestMaxSessionDurationClosesSession(t *testing.T) {
+	_, addr := startServer(t, func(srv *Server) {
+		srv.MaxSessionDuration = 200 * time.Millisecond
+	})
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), startStalled(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, d := readAll(c)
+	if d < 150*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("the session is closed after %v, want 200ms", d)
+	}
+}
+
+func TestSessionFlushTimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		flush  time.Duration
+		linger time.Duration
+		want   string
+	}{
+		{"hard close", 0, 0, ""},
+		{"flushed", time.Second, 0, "bye"},
+		{"lingering destination", 300 * time.Millisecond, 10 * time.Second, "bye"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := startServer(t, func(srv *Server) {
+				srv.MaxSessionDuration = 200 * time.Millisecond
+				srv.SessionFlushTimeout = tt.flush
+			})
+
+			c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), startFarewell(t, "bye", tt.linger))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			got, d := readAll(c)
+			if got != tt.want {
+				t.Fatalf("got %q after the session duration is expired, want %q", got, tt.want)
+			}
+
+			if d > 200*time.Millisecond+tt.flush+time.Second {
+				t.Fatalf("the session is closed after %v, the flush timeout (%v) is not applied", d, tt.flush)
+			}
+		})
+	}
+}
+
+// Send the CONNECT request with the RSV field to the server and return the reply
+func connectWithRSV(t *testing.T, addr, dst string, rsv byte) *Reply {
+	t.Helper()
+
+	c := rawHandshake(t, addr)
+
+	req := &Request{Cmd: CmdConnect, Rsv: rsv, Dst: ParseAddr("tcp", dst)}
+	err := req.Write(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rep := &Reply{}
+	err = rep.Read(c)
+	if err != nil {
+		t.Fatalf("the reply is not received: %v", err)
+	}
+
+	return rep
+}
+
+func TestStrictRSV(t *testing.T) {
+	echo := startEcho(t)
+
+	_, lenient := startServer(t, nil)
+	if rep := connectWithRSV(t, lenient, echo, 0xFF); rep.Rep != RepSucceeded {
+		t.Errorf("lenient server: got %v, want %v", rep.Rep, RepSucceeded)
+	}
+
+	_, strict := startServer(t, func(srv *Server) { srv.StrictRSV = true })
+	if rep := connectWithRSV(t, strict, echo, 0xFF); rep.Rep != RepServerFailure {
+		t.Errorf("strict server: got %v, want %v", rep.Rep, RepServerFailure)
+	}
+
+	if rep := connectWithRSV(t, strict, echo, 0x00); rep.Rep != RepSucceeded {
+		t.Errorf("strict server, zero RSV: got %v, want %v", rep.Rep, RepSucceeded)
+	}
+}
+
+func TestReplyRSV(t *testing.T) {
+	echo := startEcho(t)
+	_, addr := startServer(t, func(srv *Server) { srv.ReplyRSV = 0xFF })
+
+	if rep := connectWithRSV(t, addr, echo, 0x00); rep.Rsv != 0xFF {
+		t.Errorf("success reply RSV: got %#02x, want 0xff", rep.Rsv)
+	}
+
+	_, refused := startServer(t, func(srv *Server) {
+		srv.ReplyRSV = 0xFF
+		srv.StrictRSV = true
+	})
+
+	if rep := connectWithRSV(t, refused, echo, 0x01); rep.Rep != RepServerFailure || rep.Rsv != 0xFF {
+		t.Errorf("failure reply: got %v with RSV %#02x, want %v with RSV 0xff", rep.Rep, rep.Rsv, RepServerFailure)
+	}
+}
+
+// Dialer that blocks till the context is done (an unresponsive destination)
+type blockingDialer struct {
+	net.Dialer
+}
+
+func (d *blockingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// Send the CONNECT request to dst and return the time it took to get the error
+func connectDuration(t *testing.T, addr, dst string) time.Duration {
+	t.Helper()
+
+	start := time.Now()
+
+	c, err := NewClient(addr).Connect(testContext(t, 10*time.Second), dst)
+	if err == nil {
+		c.Close()
+		t.Fatalf("the destination (%v) is reachable", dst)
+	}
+
+	return time.Since(start)
+}
+
+func TestDialTimeout(t *testing.T) {
+	tests := []struct {
+		name         string
+		dialTimeout  time.Duration
+		timeout      time.Duration
+		want, margin time.Duration
+	}{
+		{"dial timeout", 200 * time.Millisecond, 0, 200 * time.Millisecond, time.Second},
+		{"shorter request timeout", 5 * time.Second, 200 * time.Millisecond, 200 * time.Millisecond, time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := startServer(t, func(srv *Server) {
+				srv.Dialer = &blockingDialer{}
+				srv.DialTimeout = tt.dialTimeout
+				srv.Timeout = tt.timeout
+			})
+
+			d := connectDuration(t, addr, "192.0.2.1:80")
+			if d < tt.want || d > tt.want+tt.margin {
+				t.Fatalf("the dial is finished after %v, want %v", d, tt.want)
+			}
+		})
+	}
+}
+
+func TestTraceWireRedactsAuthentication(t *testing.T) {
+	logger := &recordingLogger{}
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Logger = &switchLogger{Enable: true, Logger: logger}
+		srv.TraceWire = true
+		srv.Auth = NewPassAuth("user", "secret-password")
+	})
+
+	client := NewClient(addr)
+	client.Auth = NewPassAuth("user", "secret-password")
+
+	c, err := client.Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c, "ping")
+
+	lines := strings.Join(logger.Lines(), "")
+	if !strings.Contains(lines, "<- 05 02 00 02") {
+		t.Errorf("the negotiation request is not traced: %q", lines)
+	}
+
+	if !strings.Contains(lines, "bytes of the authentication are redacted") {
+		t.Errorf("the authentication is not traced: %q", lines)
+	}
+
+	if strings.Contains(lines, fmt.Sprintf("% x", "secret-password")) {
+		t.Errorf("the password is traced: %q", lines)
+	}
+}
+
+func TestReadyListenFailure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	srv := NewServer(l.Addr().String())
+	srv.DisableLogger()
+	defer srv.Close()
+
+	res := make(chan error, 1)
+	go func() { res <- srv.ListenAndServe() }()
+
+	select {
+	case <-srv.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Ready is not closed after the listen failure")
+	}
+
+	err = <-res
+	if err == nil {
+		t.Fatal("ListenAndServe succeeded at the busy address")
+	}
+
+	if srv.ReadyErr() != err {
+		t.Fatalf("ReadyErr returned %v, expected %v", srv.ReadyErr(), err)
+	}
+}
+
+func TestReadyListening(t *testing.T) {
+	srv, addr := startServer(t, nil)
+	if srv.ReadyErr() != nil {
+		t.Fatalf("ReadyErr of the listening server: %v", srv.ReadyErr())
+	}
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+// slowAuth delays the authentication reply of Auth
+type slowAuth struct {
+	Auth
+	delay time.Duration
+}
+
+func (a *slowAuth) Reply(ctx context.Context, conn *Conn) error {
+	time.Sleep(a.delay)
+	return a.Auth.Reply(ctx, conn)
+}
+
+// Result of Server.OnHandshakeComplete
+type handshakeResult struct {
+	method authMethod
+	dur    time.Duration
+	err    error
+}
+
+func TestOnHandshakeComplete(t *testing.T) {
+	const delay = 100 * time.Millisecond
+
+	res := make(chan handshakeResult, 2)
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Auth = &slowAuth{NewPassAuth("user", "pass"), delay}
+		srv.OnHandshakeComplete = func(conn *Conn, method authMethod, dur time.Duration, err error) {
+			res <- handshakeResult{method, dur, err}
+		}
+	})
+
+	client := NewClient(addr)
+	client.Auth = NewPassAuth("user", "pass")
+
+	c, err := client.Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	r := <-res
+	if r.err != nil || r.method != MethodPassword || r.dur < delay {
+		t.Fatalf("handshake: method %v, duration %v, error %v", r.method, r.dur, r.err)
+	}
+
+	// The client offers only the method that is not supported by the server
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	_, err = raw.Write([]byte{Version, 0x01, byte(MethodNotRequired)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r = <-res
+	if r.err == nil || r.method != MethodNoAcceptable {
+		t.Fatalf("rejected handshake: method %v, error %v", r.method, r.err)
+	}
+}
+
+func TestMaxConnsPerDest(t *testing.T) {
+	const limit = 3
+
+	_, addr := startServer(t, func(srv *Server) {
+		srv.MaxConnsPerDest = limit
+	})
+	echo := startEcho(t)
+
+	var conns []net.Conn
+	for i := 0; i < limit; i++ {
+		c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		checkEcho(t, c, "ping")
+		conns = append(conns, c)
+	}
+
+	_, err := NewClient(addr).Connect(testContext(t, 5*time.Second), echo)
+	if code, _ := ReplyCodeOf(err); code != RepConnNotAllowed {
+		t.Fatalf("the connection over the limit: %v", err)
+	}
+
+	// other destinations are not limited
+	other, err := NewClient(addr).Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatalf("the connection to the other destination: %v", err)
+	}
+	defer other.Close()
+
+	// the closed session releases the slot
+	conns[0].Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), echo)
+		if err == nil {
+			defer c.Close()
+
+			checkEcho(t, c, "ping")
+			return
+		}
+
+		if code, _ := ReplyCodeOf(err); code != RepConnNotAllowed || time.Now().After(deadline) {
+			t.Fatalf("the connection after the release: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxConnsPerDestForgetsClosedSessions(t *testing.T) {
+	srv, addr := startServer(t, func(srv *Server) {
+		srv.MaxConnsPerDest = 1
+	})
+
+	var conns []net.Conn
+	for i := 0; i < 10; i++ {
+		c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), startEcho(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		checkEcho(t, c, "ping")
+		conns = append(conns, c)
+	}
+
+	if srv.destConns.size() != len(conns) {
+		t.Fatalf("%v destinations are counted, expected %v", srv.destConns.size(), len(conns))
+	}
+
+	for _, c := range conns {
+		c.Close()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.destConns.size() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v destinations are left after all the sessions are closed", srv.destConns.size())
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOnBindListen(t *testing.T) {
+	type bindListen struct {
+		client, listenAddr net.Addr
+	}
+
+	listened := make(chan bindListen, 1)
+	_, addr := startServer(t, func(srv *Server) {
+		srv.OnBindListen = func(client, listenAddr net.Addr) {
+			listened <- bindListen{client, listenAddr}
+		}
+	})
+
+	res := make(chan error, 1)
+	go func() {
+		l := <-listened
+		if l.client == nil {
+			res <- errors.New("the client address is nil")
+			return
+		}
+
+		// the listener is bound before the first reply, so the inbound connection could be dialed at once
+		_, port, _ := net.SplitHostPort(l.listenAddr.String())
+		c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+		if err != nil {
+			res <- err
+			return
+		}
+		defer c.Close()
+
+		_, err = c.Write([]byte("inbound"))
+		res <- err
+	}()
+
+	c, err := NewClient(addr).Bind(testContext(t, 5*time.Second), "127.0.0.1:0", make(chan net.Addr, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = <-res
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	b := make([]byte, len("inbound"))
+	_, err = io.ReadFull(c, b)
+	if err != nil || string(b) != "inbound" {
+		t.Fatalf("read %q, %v", b, err)
+	}
+}
+
+func TestIPv6ZoneDialAddress(t *testing.T) {
+	srv := NewServer("")
+	srv.IPv6Zone = "eth0"
+
+	tests := []struct {
+		dst, dial string
+	}{
+		{"[fe80::1]:80", "[fe80::1%eth0]:80"},
+		{"[ff02::1]:80", "[ff02::1%eth0]:80"},
+		{"[fe80::1%lo]:80", "[fe80::1%lo]:80"},
+		{"[2001:db8::1]:80", "[2001:db8::1]:80"},
+		{"192.0.2.1:80", "192.0.2.1:80"},
+		{"example.com:80", "example.com:80"},
+	}
+
+	for _, tt := range tests {
+		got := srv.dialAddress(ParseAddr("tcp", tt.dst))
+		if got != tt.dial {
+			t.Errorf("%v: dialed %v, expected %v", tt.dst, got, tt.dial)
+		}
+	}
+
+	srv.IPv6Zone = ""
+	if got := srv.dialAddress(ParseAddr("tcp", "[fe80::1]:80")); got != "[fe80::1]:80" {
+		t.Errorf("the zone is appended without Server.IPv6Zone: %v", got)
+	}
+}
+
+func TestIPv6ZoneConnect(t *testing.T) {
+	dialer := &recordingDialer{Dialer: net.Dialer{Timeout: 100 * time.Millisecond}, addrs: make(chan string, 1)}
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Dialer = dialer
+		srv.IPv6Zone = "lo"
+	})
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), "[fe80::1]:80")
+	if err == nil {
+		c.Close()
+	}
+
+	select {
+	case got := <-dialer.addrs:
+		if got != "[fe80::1%lo]:80" {
+			t.Fatalf("dialed %v", got)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("the dialer is not called")
+	}
+}
+
+// Connect to echo through the proxy at addr with the password authentication
+func connectWithPassword(ctx context.Context, addr, echo, pass string) (net.Conn, error) {
+	client := NewClient(addr)
+	client.Auth = NewPassAuth("user", pass)
+
+	return client.Connect(ctx, echo)
+}
+
+// Connect to echo through the proxy at addr offering only the given authentication method
+func connectWithAuth(t *testing.T, addr, echo string, auth Auth) error {
+	client := NewClient(addr)
+	client.Auth = auth
+
+	c, err := client.Connect(testContext(t, 5*time.Second), echo)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	checkEcho(t, c, "ping")
+	return nil
+}
+
+func TestAuthsNoAuthMakesPasswordOptional(t *testing.T) {
+	echo := startEcho(t)
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Auths = []Auth{NoAuth, NewPassAuth("user", "pass")}
+	})
+
+	// the client offering only MethodNotRequired skips the password
+	if err := connectWithAuth(t, addr, echo, NoAuth); err != nil {
+		t.Fatalf("NoAuth: %v", err)
+	}
+
+	if err := connectWithAuth(t, addr, echo, NewPassAuth("user", "pass")); err != nil {
+		t.Fatalf("PassAuth: %v", err)
+	}
+}
+
+func TestAuthsFor(t *testing.T) {
+	echo := startEcho(t)
+
+	tests := []struct {
+		name    string
+		trusted string // network of the clients that are not asked for the password
+		noAuth  bool   // NoAuth client is served
+	}{
+		{"trusted client", "127.0.0.0/8", true},
+		{"untrusted client", "10.0.0.0/8", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, trusted, _ := net.ParseCIDR(tt.trusted)
+
+			_, addr := startServer(t, func(srv *Server) {
+				srv.Auths = []Auth{NoAuth}
+				srv.AuthsFor = func(remote net.Addr) []Auth {
+					if trusted.Contains(remote.(*net.TCPAddr).IP) {
+						return []Auth{NoAuth}
+					}
+
+					return []Auth{NewPassAuth("user", "pass")}
+				}
+			})
+
+			err := connectWithAuth(t, addr, echo, NoAuth)
+			if served := err == nil; served != tt.noAuth {
+				t.Fatalf("the NoAuth client is served: %v (%v)", served, err)
+			}
+
+			err = connectWithAuth(t, addr, echo, NewPassAuth("user", "pass"))
+			if err != nil {
+				t.Fatalf("the password client: %v", err)
+			}
+		})
+	}
+}
+
+func TestAuthsForNoMethods(t *testing.T) {
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Auth = NewPassAuth("user", "pass")
+		srv.AuthsFor = func(remote net.Addr) []Auth { return nil }
+	})
+
+	// Server.Auth is offered, if AuthsFor returns no methods
+	if err := connectWithAuth(t, addr, startEcho(t), NewPassAuth("user", "pass")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetAuthWhileServing(t *testing.T) {
+	echo := startEcho(t)
+	srv, addr := startServer(t, func(srv *Server) {
+		srv.Auth = NewPassAuth("user", "old")
+	})
+
+	established, err := connectWithPassword(testContext(t, 5*time.Second), addr, echo, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer established.Close()
+
+	stop := make(chan struct{})
+	rotated := make(chan struct{})
+	go func() {
+		defer close(rotated)
+
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			srv.SetAuth(NewPassAuth("user", fmt.Sprint(i)))
+			srv.SetAuths()
+		}
+	}()
+
+	done := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+
+			for j := 0; j < 10; j++ {
+				c, err := connectWithPassword(testContext(t, 5*time.Second), addr, echo, "0")
+				if err == nil {
+					c.Close()
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+	close(stop)
+	<-rotated
+
+	srv.SetAuth(NewPassAuth("user", "new"))
+
+	_, err = connectWithPassword(testContext(t, 5*time.Second), addr, echo, "old")
+	if err == nil {
+		t.Fatal("the old password is accepted after SetAuth")
+	}
+
+	c, err := connectWithPassword(testContext(t, 5*time.Second), addr, echo, "new")
+	if err != nil {
+		t.Fatalf("the new password: %v", err)
+	}
+	c.Close()
+
+	// the established connection is not affected
+	checkEcho(t, established, "ping")
+}
+
+// Send the negotiation request offering methods to the server at addr and return the raw connection
+func rawNegotiation(t *testing.T, addr string, methods ...authMethod) net.Conn {
+	t.Helper()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	msg := []byte{Version, byte(len(methods))}
+	for _, method := range methods {
+		msg = append(msg, byte(method))
+	}
+
+	_, err = c.Write(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestMaxAuthMethods(t *testing.T) {
+	if NewServer("").MaxAuthMethods != maxAuthMethods {
+		t.Fatalf("the default MaxAuthMethods is %v", NewServer("").MaxAuthMethods)
+	}
+
+	logger := &recordingLogger{}
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Logger = &switchLogger{Enable: true, Logger: logger}
+		srv.MaxAuthMethods = 2
+		srv.LogAuthMethods = true
+	})
+
+	c := rawNegotiation(t, addr, MethodPassword, MethodNotRequired)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	b := make([]byte, 2)
+	_, err := io.ReadFull(c, b)
+	if err != nil || b[1] != byte(MethodNotRequired) {
+		t.Fatalf("the negotiation with 2 methods: reply %x, %v", b, err)
+	}
+
+	c = rawNegotiation(t, addr, MethodChallenge, MethodPassword, MethodNotRequired)
+	rep, _ := readAll(c)
+	if rep != "" {
+		t.Fatalf("the negotiation with 3 methods: reply %x", rep)
+	}
+
+	lines := strings.Join(logger.Lines(), "")
+	if !strings.Contains(lines, "offers the authentication methods") || !strings.Contains(lines, "too many authentication methods") {
+		t.Fatalf("logged lines: %q", lines)
+	}
+}
+
+// rsvCodec encodes the headers with the given RSV field
+type rsvCodec struct {
+	socksCodec
+	rsv uint16
+}
+
+func (c *rsvCodec) Encode(wr io.Writer, h *UDPHeader) error {
+	h.Rsv = c.rsv
+	return h.Write(wr)
+}
+
+// Send the datagram with the given RSV field to the UDP echo through the server.
+// Return true, if the datagram is echoed
+func relayWithRSV(t *testing.T, strict bool, rsv uint16) bool {
+	t.Helper()
+
+	echo, _ := startUDPEcho(t)
+	_, addr := startServer(t, func(srv *Server) {
+		srv.StrictUDP = strict
+	})
+
+	c, err := NewClient(addr).UDP(testContext(t, 10*time.Second), "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Codec = &rsvCodec{rsv: rsv}
+
+	_, err = c.WriteTo([]byte("rsv"), echo.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+
+	b := make([]byte, 64)
+	n, _, err := c.ReadFrom(b)
+
+	return err == nil && string(b[:n]) == "rsv"
+}
+
+func TestStrictUDP(t *testing.T) {
+	if relayWithRSV(t, true, 0x0100) {
+		t.Error("the datagram with non-zero RSV is relayed with StrictUDP")
+	}
+
+	if !relayWithRSV(t, true, 0x0000) {
+		t.Error("the datagram with zero RSV is not relayed with StrictUDP")
+	}
+
+	if !relayWithRSV(t, false, 0x0100) {
+		t.Error("the datagram with non-zero RSV is not relayed without StrictUDP")
+	}
+}
+
+func TestOnControlData(t *testing.T) {
+	echo, _ := startUDPEcho(t)
+
+	received := make(chan string, 8)
+	_, addr := startServer(t, func(srv *Server) {
+		srv.OnControlData = func(conn *Conn, b []byte) {
+			received <- string(b)
+		}
+	})
+
+	c, err := NewClient(addr).UDP(testContext(t, 10*time.Second), "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = c.Control().Write([]byte("control"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-received:
+		if got != "control" {
+			t.Fatalf("OnControlData got %q", got)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnControlData is not called")
+	}
+
+	// the association is not closed by the control data
+	_, err = c.WriteTo([]byte("after control"), echo.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	readDatagram(t, c, "after control")
+}
+
+func TestControlDataIgnored(t *testing.T) {
+	echo, _ := startUDPEcho(t)
+	_, addr := startServer(t, nil)
+
+	c, err := NewClient(addr).UDP(testContext(t, 10*time.Second), "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = c.Control().Write([]byte("control"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.WriteTo([]byte("after control"), echo.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	readDatagram(t, c, "after control")
+}
+
+// Send the datagram to dst through the relay from the socket bound to laddr (the test is skipped, if laddr can not be bound).
+// Return true, if the echo of the datagram is received back
+func relayFrom(t *testing.T, laddr string, relay, dst net.Addr, msg string) bool {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp4", laddr)
+	if err != nil {
+		t.Skipf("unable to bind %v: %v", laddr, err)
+	}
+	defer pc.Close()
+
+	return relayOn(t, pc, relay, dst, msg)
+}
+
+// Send the datagram to dst through the relay from pc.
+// Return true, if the echo of the datagram is received back
+func relayOn(t *testing.T, pc net.PacketConn, relay, dst net.Addr, msg string) bool {
+	t.Helper()
+
+	header := &UDPHeader{Dst: ParseNetAddr(dst), Data: []byte(msg)}
+	err := header.Write(&packetWriter{pc, relay})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pc.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+
+	b := make([]byte, 1500)
+	_, _, err = pc.ReadFrom(b)
+
+	return err == nil
+}
+
+func TestUDPRelayIgnoresOtherHosts(t *testing.T) {
+	echo, sources := startUDPEcho(t)
+	_, addr := startServer(t, nil)
+
+	c, err := NewClient(addr).UDP(testContext(t, 10*time.Second), "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the control connection is made from 127.0.0.1, so the datagrams of 127.0.0.2 are not relayed
+	if relayFrom(t, "127.0.0.2:0", c.data.RemoteAddr(), echo.LocalAddr(), "stranger") {
+		t.Fatal("the datagram of the third host is relayed back to it")
+	}
+
+	select {
+	case src := <-sources:
+		t.Fatalf("the datagram of the third host is relayed from %v", src)
+
+	default:
+	}
+
+	// the client is still the peer of the relay
+	c.Dst = ParseNetAddr(echo.LocalAddr())
+
+	_, err = c.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readDatagram(t, c, "ping")
+}
+
+func TestUDPRelayRequestedSource(t *testing.T) {
+	echo, _ := startUDPEcho(t)
+	_, addr := startServer(t, nil)
+
+	// the client announces the address its datagrams are sent from
+	source, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	c, err := NewClient(addr).UDP(testContext(t, 10*time.Second), source.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	relay := c.data.RemoteAddr()
+
+	if relayFrom(t, "127.0.0.1:0", relay, echo.LocalAddr(), "other port") {
+		t.Fatal("the datagram sent from another port is relayed")
+	}
+
+	if !relayOn(t, source, relay, echo.LocalAddr(), "requested port") {
+		t.Fatal("the datagram sent from the requested address is not relayed")
+	}
+}
+
+func TestPublicIPUDPReply(t *testing.T) {
+	echo, _ := startUDPEcho(t)
+	public := net.ParseIP("203.0.113.7")
+
+	_, addr := startServer(t, func(srv *Server) {
+		srv.PublicIP = public
+	})
+
+	c := rawHandshake(t, addr)
+
+	req := &Request{Cmd: CmdUDP, Dst: ParseAddr("udp", "0.0.0.0:0")}
+	err := req.Write(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rep := &Reply{}
+	err = rep.Read(c)
+	if err != nil || rep.Rep != RepSucceeded {
+		t.Fatalf("the reply: %v, %v", rep.Rep, err)
+	}
+
+	if rep.Bnd.Host != public.String() || rep.Bnd.Port == 0 {
+		t.Fatalf("BND.ADDR is %v, expected the public IP %v", rep.Bnd, public)
+	}
+
+	// the relay listens at the real port, so the local clients could reach it
+	relay := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(rep.Bnd.Port)))
+	data, err := net.Dial("udp", relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := NewUDPConn(c, data)
+	defer u.Close()
+
+	_, err = u.WriteTo([]byte("public"), echo.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	readDatagram(t, u, "public")
+}
+
+// Return the address of the loopback port nobody listens at
+func closedPort(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+func TestErrorToReply(t *testing.T) {
+	dst := closedPort(t)
+
+	_, def := startServer(t, nil)
+	if rep := connectWithRSV(t, def, dst, 0x00); rep.Rep != RepConnRefused {
+		t.Errorf("the default mapping: got %v, want %v", rep.Rep, RepConnRefused)
+	}
+
+	mapped := make(chan error, 1)
+	_, uniform := startServer(t, func(srv *Server) {
+		srv.ErrorToReply = func(err error) repType {
+			mapped <- err
+			return RepServerFailure
+		}
+	})
+
+	if rep := connectWithRSV(t, uniform, dst, 0x00); rep.Rep != RepServerFailure {
+		t.Errorf("the custom mapping: got %v, want %v", rep.Rep, RepServerFailure)
+	}
+
+	if err := <-mapped; err == nil {
+		t.Error("ErrorToReply is called with nil error")
+	}
+}
+
+// quietLogger records the lines above the debug level
+type quietLogger struct {
+	*recordingLogger
+}
+
+func (l quietLogger) Debugf(format string, args ...any) {}
+
+// Return the recorded lines, that mention s
+func linesWith(l *recordingLogger, s string) []string {
+	var lines []string
+	for _, line := range l.Lines() {
+		if strings.Contains(line, s) {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+func TestLogOnlyFailures(t *testing.T) {
+	// the lines of every level are recorded, so the successful session is not logged even at the debug level
+	logger := &recordingLogger{}
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Logger = &switchLogger{Enable: true, Logger: logger}
+		srv.LogOnlyFailures = true
+	})
+
+	echo := startEcho(t)
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, c, "ping")
+	c.Close()
+
+	failed := closedPort(t)
+	_, err = NewClient(addr).Connect(testContext(t, 5*time.Second), failed)
+	if err == nil {
+		t.Fatal("the connection to the closed port succeeded")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(linesWith(logger, failed)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if lines := linesWith(logger, failed); len(lines) == 0 {
+		t.Errorf("the failed request is not logged: %q", logger.Lines())
+	}
+
+	if lines := linesWith(logger, echo); len(lines) != 0 {
+		t.Errorf("the successful session is logged: %q", lines)
+	}
+}
+
+func TestLogAllSessions(t *testing.T) {
+	logger := &recordingLogger{}
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Logger = &switchLogger{Enable: true, Logger: quietLogger{logger}}
+	})
+
+	echo := startEcho(t)
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c, "ping")
+
+	if lines := linesWith(logger, echo); len(lines) == 0 {
+		t.Errorf("the successful session is not logged without LogOnlyFailures: %q", logger.Lines())
+	}
+}
+
+// denyRules rejects all the requests with RepConnNotAllowed
+type denyRules struct{}
+
+func (denyRules) Allow(ctx context.Context, cmd cmdType, dst *Addr) (bool, repType) {
+	return false, RepConnNotAllowed
+}
+
+func TestConcurrentFailRepliesDoNotShareNilAddr(t *testing.T) {
+	srv, addr := startServer(t, func(srv *Server) {
+		srv.Rules = denyRules{}
+	})
+
+	// the consumer modifies the addresses of the sent replies
+	events := srv.Events()
+	go func() {
+		for ev := range events {
+			if ev.Type == EventReply && ev.Reply != nil {
+				ev.Reply.Bnd.Port++
+				ev.Reply.Bnd.network = "udp"
+			}
+		}
+	}()
+
+	errs := make(chan error, 16)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := NewClient(addr).Connect(testContext(t, 5*time.Second), "192.0.2.1:80")
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < cap(errs); i++ {
+		if code, _ := ReplyCodeOf(<-errs); code != RepConnNotAllowed {
+			t.Errorf("the reply code is %v", code)
+		}
+	}
+
+	if NilAddr.String() != "0.0.0.0:0" || NilAddr.network != "tcp" {
+		t.Fatalf("NilAddr is modified: %v (%q)", NilAddr, NilAddr.network)
+	}
+}
+
+func TestClientFilter(t *testing.T) {
+	rejected := net.IPv4(127, 0, 0, 2)
+
+	handshakes := make(chan net.Addr, 2)
+	_, addr := startServer(t, func(srv *Server) {
+		srv.ClientFilter = func(remote net.Addr) bool {
+			return !remote.(*net.TCPAddr).IP.Equal(rejected)
+		}
+		srv.OnHandshakeComplete = func(conn *Conn, method authMethod, dur time.Duration, err error) {
+			handshakes <- conn.Raw().RemoteAddr()
+		}
+	})
+
+	d := &net.Dialer{LocalAddr: &net.TCPAddr{IP: rejected}}
+	c, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the connection is closed without the negotiation reply
+	c.Write([]byte{Version, 0x01, byte(MethodNotRequired)})
+	if rep, dur := readAll(c); rep != "" || dur > time.Second {
+		t.Fatalf("the rejected client got %x in %v", rep, dur)
+	}
+
+	accepted, err := NewClient(addr).Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+
+	checkEcho(t, accepted, "ping")
+
+	if remote := (<-handshakes).(*net.TCPAddr); remote.IP.Equal(rejected) {
+		t.Fatal("the rejected client is handshaked")
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	echo := startEcho(t)
+
+	dialer := &recordingDialer{addrs: make(chan string, 8)}
+	srv, addr := startServer(t, func(srv *Server) {
+		srv.Dialer = dialer
+	})
+
+	srv.SetMaintenance(true)
+	if !srv.Maintenance() {
+		t.Fatal("the maintenance mode is not enabled")
+	}
+
+	if rep := connectWithRSV(t, addr, echo, 0x00); rep.Rep != RepServerFailure {
+		t.Errorf("CONNECT in maintenance mode: got %v, want %v", rep.Rep, RepServerFailure)
+	}
+
+	_, err := NewClient(addr).UDP(testContext(t, 5*time.Second), "0.0.0.0:0")
+	if code, _ := ReplyCodeOf(err); code != RepServerFailure {
+		t.Errorf("UDP ASSOCIATE in maintenance mode: %v", err)
+	}
+
+	select {
+	case dst := <-dialer.addrs:
+		t.Fatalf("%v is dialed in maintenance mode", dst)
+	default:
+	}
+
+	srv.SetMaintenance(false)
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), echo)
+	if err != nil {
+		t.Fatalf("CONNECT after the maintenance mode: %v", err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c, "ping")
+}
+
+func TestMaintenanceReply(t *testing.T) {
+	srv, addr := startServer(t, func(srv *Server) {
+		srv.MaintenanceReply = RepConnNotAllowed
+	})
+	srv.SetMaintenance(true)
+
+	if rep := connectWithRSV(t, addr, startEcho(t), 0x00); rep.Rep != RepConnNotAllowed {
+		t.Fatalf("the custom maintenance reply: got %v, want %v", rep.Rep, RepConnNotAllowed)
+	}
+}
+
+func TestOnReplySent(t *testing.T) {
+	sent := make(chan cmdType, 8)
+	_, addr := startServer(t, func(srv *Server) {
+		srv.OnReplySent = func(conn *Conn, req *Request, rep *Reply) {
+			if rep.Rep == RepSucceeded {
+				sent <- req.Cmd
+			}
+		}
+	})
+
+	// Check, that OnReplySent is called n times for cmd
+	expect := func(cmd cmdType, n int) {
+		t.Helper()
+
+		for i := 0; i < n; i++ {
+			select {
+			case got := <-sent:
+				if got != cmd {
+					t.Fatalf("OnReplySent is called for %v, expected %v", got, cmd)
+				}
+
+			case <-time.After(5 * time.Second):
+				t.Fatalf("OnReplySent is not called for %v", cmd)
+			}
+		}
+	}
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	expect(CmdConnect, 1)
+
+	u, err := NewClient(addr).UDP(testContext(t, 5*time.Second), "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	expect(CmdUDP, 1)
+
+	bindAddr := make(chan net.Addr, 1)
+	go func() {
+		_, port, _ := net.SplitHostPort((<-bindAddr).String())
+
+		inbound, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+		if err == nil {
+			inbound.Close()
+		}
+	}()
+
+	b, err := NewClient(addr).Bind(testContext(t, 5*time.Second), "127.0.0.1:0", bindAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// after the listener is bound and after the inbound connection is accepted
+	expect(CmdBind, 2)
+}
+
+// Return the number of the datagrams received from sources within d
+func countDatagrams(sources chan net.Addr, d time.Duration) int {
+	n := 0
+	timeout := time.After(d)
+
+	for {
+		select {
+		case <-sources:
+			n++
+
+		case <-timeout:
+			return n
+		}
+	}
+}
+
+func TestUDPRatePerSecond(t *testing.T) {
+	echo, sources := startUDPEcho(t)
+	_, addr := startServer(t, func(srv *Server) {
+		srv.UDPRatePerSecond = 5
+	})
+
+	flood := func() *UDPConn {
+		c, err := NewClient(addr).UDP(testContext(t, 10*time.Second), "0.0.0.0:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+
+		for i := 0; i < 50; i++ {
+			_, err = c.WriteTo([]byte("flood"), echo.LocalAddr())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return c
+	}
+
+	flood()
+
+	// the burst is one second of the rate
+	if n := countDatagrams(sources, 300*time.Millisecond); n == 0 || n > 7 {
+		t.Fatalf("%v of 50 datagrams are relayed with the rate of 5 datagrams per second", n)
+	}
+
+	// the limit is applied to every association separately
+	flood()
+
+	if n := countDatagrams(sources, 300*time.Millisecond); n == 0 {
+		t.Fatal("the datagrams of the second association are throttled by the first one")
+	}
+}
+
+// Return the time the server at addr takes to close the connection stalled by stall
+func stalledPhase(t *testing.T, addr string, stall func(t *testing.T, addr string) net.Conn) time.Duration {
+	t.Helper()
+
+	c := stall(t, addr)
+	_, dur := readAll(c)
+
+	return dur
+}
+
+// Stall the negotiation
+func stallNegotiation(t *testing.T, addr string) net.Conn {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+// Negotiate the password authentication and stall the subnegotiation
+func stallAuth(t *testing.T, addr string) net.Conn {
+	c := rawNegotiation(t, addr, MethodPassword)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	b := make([]byte, 2)
+	_, err := io.ReadFull(c, b)
+	if err != nil || b[1] != byte(MethodPassword) {
+		t.Fatalf("the negotiation reply %x, %v", b, err)
+	}
+
+	return c
+}
+
+// Complete the handshake and stall the request
+func stallRequest(t *testing.T, addr string) net.Conn {
+	return rawHandshake(t, addr)
+}
+
+func TestPhaseTimeouts(t *testing.T) {
+	const short, long = 200 * time.Millisecond, 10 * time.Second
+
+	tests := []struct {
+		name  string
+		setup func(srv *Server)
+		stall func(t *testing.T, addr string) net.Conn
+	}{
+		{"negotiation", func(srv *Server) { srv.NegotiationTimeout = short }, stallNegotiation},
+		{"authentication", func(srv *Server) { srv.AuthTimeout = short }, stallAuth},
+		{"request", func(srv *Server) { srv.RequestTimeout = short }, stallRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := startServer(t, func(srv *Server) {
+				srv.NegotiationTimeout = long
+				srv.AuthTimeout = long
+				srv.RequestTimeout = long
+				srv.Auths = []Auth{NoAuth, NewPassAuth("user", "pass")}
+
+				tt.setup(srv)
+			})
+
+			// the stalled phase times out
+			if dur := stalledPhase(t, addr, tt.stall); dur > 2*time.Second {
+				t.Fatalf("the stalled %v is closed in %v", tt.name, dur)
+			}
+
+			// the other phases are not affected by the short timeout
+			for _, other := range tests {
+				if other.name == tt.name {
+					continue
+				}
+
+				c := other.stall(t, addr)
+				c.SetReadDeadline(time.Now().Add(3 * short))
+
+				_, err := c.Read(make([]byte, 1))
+				if err == nil || !os.IsTimeout(err) {
+					t.Fatalf("the stalled %v is closed with the short %v timeout: %v", other.name, tt.name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestHandshakeTimeoutShorthand(t *testing.T) {
+	_, addr := startServer(t, func(srv *Server) {
+		srv.HandshakeTimeout = 200 * time.Millisecond
+		srv.Auths = []Auth{NoAuth, NewPassAuth("user", "pass")}
+	})
+
+	for name, stall := range map[string]func(t *testing.T, addr string) net.Conn{
+		"negotiation": stallNegotiation, "authentication": stallAuth, "request": stallRequest,
+	} {
+		if dur := stalledPhase(t, addr, stall); dur > 2*time.Second {
+			t.Errorf("the stalled %v is closed in %v", name, dur)
+		}
+	}
+}
+
+func TestCloseIdle(t *testing.T) {
+	echo := startEcho(t)
+	srv, addr := startServer(t, nil)
+
+	idle, err := NewClient(addr).Connect(testContext(t, 5*time.Second), echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+
+	active, err := NewClient(addr).Connect(testContext(t, 5*time.Second), echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer active.Close()
+
+	checkEcho(t, idle, "ping")
+	time.Sleep(300 * time.Millisecond)
+	checkEcho(t, active, "ping")
+
+	if n := srv.CloseIdle(200 * time.Millisecond); n != 1 {
+		t.Fatalf("%v sessions are closed, expected 1", n)
+	}
+
+	if _, dur := readAll(idle); dur > time.Second {
+		t.Fatal("the idle session is not closed")
+	}
+
+	checkEcho(t, active, "pong")
+
+	if n := srv.CloseIdle(time.Hour); n != 0 {
+		t.Fatalf("%v sessions are closed, though no session is idle for an hour", n)
+	}
+}
+
+type hookKey struct{}
+
+// valueRules records the value of hookKey passed to Rules
+type valueRules struct {
+	values chan any
+}
+
+func (r *valueRules) Allow(ctx context.Context, cmd cmdType, dst *Addr) (bool, repType) {
+	r.values <- ctx.Value(hookKey{})
+	return true, RepSucceeded
+}
+
+// valueDialer records the value of hookKey passed to the dialer
+type valueDialer struct {
+	net.Dialer
+	values chan any
+}
+
+func (d *valueDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.values <- ctx.Value(hookKey{})
+	return d.Dialer.DialContext(ctx, network, address)
+}
+
+func TestOnRequestContextValues(t *testing.T) {
+	values := make(chan any, 8)
+	sessions := make(chan string, 1)
+
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Auth = NewPassAuth("alice", "pass")
+		srv.OnRequest = func(ctx context.Context, conn *Conn, req *Request) (context.Context, error) {
+			sessions <- SessionIDFromContext(ctx)
+			return context.WithValue(ctx, hookKey{}, "identity of "+UserFromContext(ctx)), nil
+		}
+		srv.Rules = &valueRules{values}
+		srv.Dialer = &valueDialer{values: values}
+		srv.WrapUpstream = func(ctx context.Context, conn net.Conn, req *Request) (net.Conn, error) {
+			values <- ctx.Value(hookKey{})
+			return conn, nil
+		}
+	})
+
+	client := NewClient(addr)
+	client.Auth = NewPassAuth("alice", "pass")
+
+	c, err := client.Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, hook := range []string{"Rules", "Dialer", "WrapUpstream"} {
+		if got := <-values; got != "identity of alice" {
+			t.Errorf("%v got %v", hook, got)
+		}
+	}
+
+	if id := <-sessions; id == "" {
+		t.Error("the session ID is not in the context of OnRequest")
+	}
+}
+
+func TestOnRequestNilContext(t *testing.T) {
+	values := make(chan any, 1)
+	_, addr := startServer(t, func(srv *Server) {
+		srv.OnRequest = func(ctx context.Context, conn *Conn, req *Request) (context.Context, error) {
+			return nil, nil
+		}
+		srv.Dialer = &valueDialer{values: values}
+	})
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if got := <-values; got != nil {
+		t.Fatalf("the dialer got %v", got)
+	}
+}
+
+func TestMaxDomainLength(t *testing.T) {
+	if NewServer("").MaxDomainLength != maxDomainLength {
+		t.Fatalf("the default MaxDomainLength is %v", NewServer("").MaxDomainLength)
+	}
+
+	dialer := &recordingDialer{Dialer: net.Dialer{Timeout: 100 * time.Millisecond}, addrs: make(chan string, 2)}
+	_, addr := startServer(t, func(srv *Server) {
+		srv.MaxDomainLength = 32
+		srv.Dialer = dialer
+	})
+
+	long := strings.Repeat("a", 60) + ".test:80" // longer than the limit, but shorter than 255 bytes
+	if rep := connectWithRSV(t, addr, long, 0x00); rep.Rep != RepAddrNotSupported {
+		t.Fatalf("the long domain: got %v, want %v", rep.Rep, RepAddrNotSupported)
+	}
+
+	select {
+	case dst := <-dialer.addrs:
+		t.Fatalf("the long domain %v is dialed", dst)
+	default:
+	}
+
+	connectWithRSV(t, addr, "short.test:80", 0x00)
+	if dst := <-dialer.addrs; dst != "short.test:80" {
+		t.Fatalf("the short domain: dialed %v", dst)
+	}
+}
+
+func TestDiagnosticAddr(t *testing.T) {
+	diag := "diag.socks5.invalid:7"
+
+	dialer := &recordingDialer{Dialer: net.Dialer{Timeout: 100 * time.Millisecond}, addrs: make(chan string, 1)}
+	_, addr := startServer(t, func(srv *Server) {
+		srv.DiagnosticAddr = ParseAddr("tcp", diag)
+		srv.Dialer = dialer
+	})
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), "DIAG.socks5.invalid:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c, "ping")
+	checkEcho(t, c, strings.Repeat("diagnostic ", 1000))
+
+	select {
+	case dst := <-dialer.addrs:
+		t.Fatalf("the diagnostic address is dialed (%v)", dst)
+	default:
+	}
+
+	// the other destinations are dialed
+	c, err = NewClient(addr).Connect(testContext(t, 5*time.Second), "diag.socks5.invalid:8")
+	if err == nil {
+		c.Close()
+	}
+
+	if dst := <-dialer.addrs; dst != "diag.socks5.invalid:8" {
+		t.Fatalf("dialed %v", dst)
+	}
+}
+
+func TestDiagnosticAddrDisabled(t *testing.T) {
+	dialer := &recordingDialer{Dialer: net.Dialer{Timeout: 100 * time.Millisecond}, addrs: make(chan string, 1)}
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Dialer = dialer
+	})
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), "diag.socks5.invalid:7")
+	if err == nil {
+		c.Close()
+	}
+
+	if dst := <-dialer.addrs; dst != "diag.socks5.invalid:7" {
+		t.Fatalf("dialed %v", dst)
+	}
+}
+
+func TestNoDelayDefault(t *testing.T) {
+	if !NewServer("").NoDelay {
+		t.Fatal("NoDelay is disabled by default")
+	}
+}
+
+// Send the BIND request expecting the peer at 127.0.0.1 and dial the listener from the local address from.
+// Return the error of Client.Bind
+func bindFrom(t *testing.T, from net.IP) error {
+	t.Helper()
+
+	_, addr := startServer(t, func(srv *Server) {
+		srv.OnBindAccept = func(req *Request, peer net.Addr) bool {
+			return peer.(*net.TCPAddr).IP.Equal(net.ParseIP(req.Dst.Host))
+		}
+		srv.OnBindListen = func(client, listenAddr net.Addr) {
+			_, port, _ := net.SplitHostPort(listenAddr.String())
+
+			go func() {
+				d := &net.Dialer{LocalAddr: &net.TCPAddr{IP: from}}
+				c, err := d.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+				if err == nil {
+					defer c.Close()
+					c.Read(make([]byte, 1))
+				}
+			}()
+		}
+	})
+
+	c, err := NewClient(addr).Bind(testContext(t, 5*time.Second), "127.0.0.1:0", make(chan net.Addr, 1))
+	if err == nil {
+		c.Close()
+	}
+
+	return err
+}
+
+func TestOnBindAccept(t *testing.T) {
+	err := bindFrom(t, net.IPv4(127, 0, 0, 2))
+	if code, _ := ReplyCodeOf(err); code != RepConnNotAllowed {
+		t.Fatalf("the unexpected peer: %v", err)
+	}
+
+	err = bindFrom(t, net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Fatalf("the expected peer: %v", err)
+	}
+}
+
+// gateRules rejects the requests after release is closed
+type gateRules struct {
+	release chan struct{}
+}
+
+func (r *gateRules) Allow(ctx context.Context, cmd cmdType, dst *Addr) (bool, repType) {
+	<-r.release
+	return false, RepConnNotAllowed
+}
+
+func TestFailReplyToDisconnectedClient(t *testing.T) {
+	logger := &recordingLogger{}
+	rules := &gateRules{release: make(chan struct{})}
+
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Logger = &switchLogger{Enable: true, Logger: logger}
+		srv.Rules = rules
+	})
+
+	c := rawHandshake(t, addr)
+
+	req := &Request{Cmd: CmdConnect, Dst: ParseAddr("tcp", "192.0.2.1:80")}
+	err := req.Write(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client resets the connection before the fail reply is sent
+	c.(*net.TCPConn).SetLinger(0)
+	c.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	close(rules.release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(linesWith(logger, "Unable to send the failure reply")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the failed write of the fail reply is not logged: %q", logger.Lines())
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the server keeps serving
+	conn, err := NewClient(addr).Connect(testContext(t, 5*time.Second), "192.0.2.1:80")
+	if code, _ := ReplyCodeOf(err); code != RepConnNotAllowed {
+		t.Fatalf("the next request: %v", err)
+	}
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// Send the HTTP request to the SOCKS port at addr and return the response of the server
+func sendHTTP(t *testing.T, addr string) string {
+	t.Helper()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: proxy.test\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rep, _ := readAll(c)
+	return rep
+}
+
+func TestVersionMismatchLogged(t *testing.T) {
+	logger := &recordingLogger{}
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Logger = &switchLogger{Enable: true, Logger: logger}
+	})
+
+	if rep := sendHTTP(t, addr); rep != "" {
+		t.Fatalf("the server replied %q without VersionMismatchReply", rep)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(linesWith(logger, "does not speak SOCKS5")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	lines := linesWith(logger, "does not speak SOCKS5")
+	if len(lines) != 1 || !strings.Contains(lines[0], `GET / HTTP/1.1`) {
+		t.Fatalf("logged lines: %q", logger.Lines())
+	}
+}
+
+func TestVersionMismatchReply(t *testing.T) {
+	reply := "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n"
+	_, addr := startServer(t, func(srv *Server) {
+		srv.VersionMismatchReply = []byte(reply)
+	})
+
+	if rep := sendHTTP(t, addr); rep != reply {
+		t.Fatalf("the server replied %q", rep)
+	}
+}
+
+func TestAcceptRateLimit(t *testing.T) {
+	echo := startEcho(t)
+	_, addr := startServer(t, func(srv *Server) {
+		srv.AcceptRateLimit = 10
+	})
+
+	// the burst of 10 connections is accepted at once, the next 10 wait for a second
+	const conns = 20
+
+	start := time.Now()
+	errs := make(chan error, conns)
+	for i := 0; i < conns; i++ {
+		go func() {
+			c, err := NewClient(addr).Connect(testContext(t, 10*time.Second), echo)
+			if err == nil {
+				c.Close()
+			}
+
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < conns; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("the delayed connection is rejected: %v", err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 700*time.Millisecond {
+		t.Fatalf("%v connections are accepted in %v with the limit of 10 per second", conns, elapsed)
+	}
+}
+
+// debugLogger records the lines and marks the debug ones
+type debugLogger struct {
+	*recordingLogger
+}
+
+func (l debugLogger) Debugf(format string, args ...any) { l.log("debug: "+format, args...) }
+
+func TestRequireValidHandshake(t *testing.T) {
+	logger := &recordingLogger{}
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Logger = &switchLogger{Enable: true, Logger: debugLogger{logger}}
+		srv.RequireValidHandshake = true
+	})
+
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	// junk is rejected at once
+	if rep := sendHTTP(t, addr); rep != "" {
+		t.Fatalf("the server replied %q to the junk", rep)
+	}
+
+	start := time.Now()
+	silent.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	_, err = silent.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); err == nil || ok && netErr.Timeout() {
+		t.Fatalf("the silent connection is not closed: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > validHandshakeWindow+time.Second {
+		t.Fatalf("the silent connection is closed in %v", elapsed)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(linesWith(logger, "did not send a valid negotiation request")) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	lines := linesWith(logger, "did not send a valid negotiation request")
+	if len(lines) != 2 {
+		t.Fatalf("the rejected connections are logged as %q", logger.Lines())
+	}
+
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "debug: ") {
+			t.Errorf("the rejected connection is logged above the debug level: %q", line)
+		}
+	}
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c, "ping")
+}
+
+func TestRandomPortFallbackLogged(t *testing.T) {
+	logger := &recordingLogger{}
+	_, addr := startServer(t, func(srv *Server) {
+		srv.Logger = &switchLogger{Enable: true, Logger: debugLogger{logger}}
+	})
+
+	// the requested address is taken, so the server binds the random one
+	taken, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	requested := taken.LocalAddr().String()
+
+	c, err := NewClient(addr).UDP(testContext(t, 5*time.Second), requested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	lines := linesWith(logger, "Unable to listen at "+requested)
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "debug: ") {
+		t.Fatalf("the fallback is logged as %q", logger.Lines())
+	}
+
+	_, port, _ := net.SplitHostPort(requested)
+	random := regexp.MustCompile(`trying the random address :(\d+)`).FindStringSubmatch(lines[0])
+	if random == nil || random[1] == port {
+		t.Fatalf("the random address is not logged: %q", lines[0])
+	}
+
+	// the relay accepts only the datagrams sent from the requested address, so it is freed and dialed from
+	taken.Close()
+
+	data, err := net.DialUDP("udp4", taken.LocalAddr().(*net.UDPAddr), c.data.RemoteAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relayed := NewUDPConn(c.Control(), data)
+	defer relayed.Close()
+
+	echo, _ := startUDPEcho(t)
+	relayed.Dst = ParseAddr("udp", echo.LocalAddr().String())
+
+	_, err = relayed.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readDatagram(t, relayed, "ping")
+}
+
+func TestMaxBindListeners(t *testing.T) {
+	logger := &recordingLogger{}
+	_, addr := startServer(t, func(srv *Server) {
+		srv.MaxBindListeners = 2
+		srv.Logger = &switchLogger{Enable: true, Logger: logger}
+	})
+
+	type bindResult struct {
+		conn net.Conn
+		err  error
+	}
+
+	// Start the BIND. Return the port of its listener and the channel receiving the second reply or the rejection error
+	tryBind := func() (string, chan bindResult, error) {
+		bindAddr := make(chan net.Addr, 1)
+		res := make(chan bindResult, 1)
+
+		go func() {
+			c, err := NewClient(addr).Bind(testContext(t, 5*time.Second), "127.0.0.1:0", bindAddr)
+			res <- bindResult{c, err}
+		}()
+
+		select {
+		case bnd := <-bindAddr:
+			_, port, _ := net.SplitHostPort(bnd.String())
+			return port, res, nil
+
+		case r := <-res:
+			return "", nil, r.err
+
+		case <-time.After(5 * time.Second):
+			t.Fatal("the first BIND reply is not received")
+		}
+
+		return "", nil, nil
+	}
+
+	// Start the BIND retrying, till it is accepted or the deadline expires.
+	// The server binds the random port, that may be taken
+	bind := func() (string, chan bindResult) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			port, res, err := tryBind()
+			if err == nil {
+				return port, res
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("the BIND is rejected: %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	first, firstRes := bind()
+	bind()
+
+	_, _, err := tryBind()
+	if code, _ := ReplyCodeOf(err); code != RepServerFailure {
+		t.Fatalf("the BIND over the limit: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(linesWith(logger, "too many BIND listeners (2)")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(linesWith(logger, "too many BIND listeners (2)")) != 1 {
+		t.Fatalf("the BIND over the limit is not logged: %q", logger.Lines())
+	}
+
+	// the completed BIND releases its listener
+	peer, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	r := <-firstRes
+	if r.err != nil {
+		t.Fatalf("the first BIND: %v", r.err)
+	}
+	defer r.conn.Close()
+
+	bind()
+}
+
+func TestAbandonedBindReleasesListener(t *testing.T) {
+	_, addr := startServer(t, func(srv *Server) {
+		srv.MaxBindListeners = 1
+	})
+
+	// Start the BIND and return the cancel function of its context, once the first reply is received
+	bind := func() (context.CancelFunc, error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		bindAddr := make(chan net.Addr, 1)
+		res := make(chan error, 1)
+
+		go func() {
+			_, err := NewClient(addr).Bind(ctx, "127.0.0.1:0", bindAddr)
+			res <- err
+		}()
+
+		select {
+		case <-bindAddr:
+			return cancel, nil
+
+		case err := <-res:
+			cancel()
+			return nil, err
+
+		case <-time.After(5 * time.Second):
+			cancel()
+			t.Fatal("the first BIND reply is not received")
+		}
+
+		return nil, nil
+	}
+
+	abandon, err := bind()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client hangs up without waiting for the peer
+	abandon()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cancel, err := bind()
+		if err == nil {
+			cancel()
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("the abandoned BIND keeps its listener: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnUser(t *testing.T) {
+	tests := []struct {
+		name string
+		auth func() Auth
+		user string
+	}{
+		{"password", func() Auth { return NewPassAuth("alice", "pass") }, "alice"},
+		{"no authentication", func() Auth { return nil }, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &recordingLogger{}
+			users := make(chan string, 2)
+
+			_, addr := startServer(t, func(srv *Server) {
+				if auth := tt.auth(); auth != nil {
+					srv.Auth = auth
+				}
+				srv.Logger = &switchLogger{Enable: true, Logger: logger}
+				srv.OnRequest = func(ctx context.Context, conn *Conn, req *Request) (context.Context, error) {
+					users <- conn.User()
+					return ctx, nil
+				}
+				srv.OnSession = func(info *SessionInfo) { users <- info.User }
+			})
+
+			client := NewClient(addr)
+			if auth := tt.auth(); auth != nil {
+				client.Auth = auth
+			}
+
+			c, err := client.Connect(testContext(t, 5*time.Second), startEcho(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			if user := <-users; user != tt.user {
+				t.Errorf("Conn.User: got %q, want %q", user, tt.user)
+			}
+
+			if user := <-users; user != tt.user {
+				t.Errorf("SessionInfo.User: got %q, want %q", user, tt.user)
+			}
+
+			// the session is logged after the reply is sent
+			deadline := time.Now().Add(5 * time.Second)
+			for len(linesWith(logger, "[CONNECT]")) == 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			want := "] [CONNECT] " + c.LocalAddr().String()
+			if tt.user != "" {
+				want = "] [CONNECT] " + tt.user + "@" + c.LocalAddr().String()
+			}
+
+			if lines := linesWith(logger, "[CONNECT]"); len(lines) != 1 || !strings.Contains(lines[0], want) {
+				t.Errorf("the session is logged as %q, want %q", lines, want)
+			}
+		})
+	}
+}
+
+// Start the UDP server counting the received datagrams
+func startUDPSink(t *testing.T) (string, *int64) {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	var received int64
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			_, _, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+
+			atomic.AddInt64(&received, 1)
+		}
+	}()
+
+	return pc.LocalAddr().String(), &received
+}
+
+func TestUDPDrainOnClose(t *testing.T) {
+	const queued = 50
+
+	sink, received := startUDPSink(t)
+	_, addr := startServer(t, func(srv *Server) {
+		srv.UDPDrainOnClose = true
+	})
+
+	c, err := NewClient(addr).UDP(testContext(t, 5*time.Second), "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Dst = ParseAddr("udp", sink)
+
+	// the datagrams are queued in the relay socket, when the association is closed
+	b := make([]byte, 64)
+	for i := 0; i < queued; i++ {
+		_, err = c.Write(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(received) < queued && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt64(received); n != queued {
+		t.Fatalf("%v of %v queued datagrams are relayed", n, queued)
+	}
+}
+
+func TestTrickledRequestTimeout(t *testing.T) {
+	const timeout = 300 * time.Millisecond
+
+	tests := []struct {
+		name  string
+		setup func(srv *Server)
+	}{
+		{"RequestTimeout", func(srv *Server) { srv.RequestTimeout = timeout }},
+		{"HandshakeTimeout", func(srv *Server) { srv.HandshakeTimeout = timeout }},
+		{"Timeout", func(srv *Server) { srv.Timeout = timeout }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := startServer(t, tt.setup)
+
+			c := rawHandshake(t, addr)
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+
+			// the byte is sent every 100ms, so the request takes a second
+			start := time.Now()
+			go func() {
+				for _, b := range []byte{Version, byte(CmdConnect), 0x00, byte(AddrIPV4), 127, 0, 0, 1, 0, 80} {
+					if _, err := c.Write([]byte{b}); err != nil {
+						return
+					}
+					time.Sleep(100 * time.Millisecond)
+				}
+			}()
+
+			readAll(c)
+			if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+				t.Fatalf("the trickled request is read for %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	srv, addr := startServer(t, nil)
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c, "ping")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	// the active transfer is waited for till the deadline
+	start := time.Now()
+	err = srv.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("Shutdown returned in %v", elapsed)
+	}
+
+	// the session is closed after the deadline
+	if _, dur := readAll(c); dur > 2*time.Second {
+		t.Fatalf("the session is closed in %v", dur)
+	}
+
+	if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Fatal("the connection is accepted after Shutdown")
+	}
+}
+
+func TestShutdownWaitsForSessions(t *testing.T) {
+	srv, addr := startServer(t, nil)
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkEcho(t, c, "ping")
+
+	res := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		res <- srv.Shutdown(testContext(t, 5*time.Second))
+	}()
+
+	// the server stops accepting, but the active session keeps working
+	time.Sleep(200 * time.Millisecond)
+	checkEcho(t, c, "pong")
+
+	select {
+	case err := <-res:
+		t.Fatalf("Shutdown returned before the session is finished: %v", err)
+	default:
+	}
+
+	c.Close()
+
+	select {
+	case err := <-res:
+		if err != nil {
+			t.Fatalf("Shutdown: %v", err)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown does not return after the session is finished")
+	}
+
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("Shutdown returned in %v", elapsed)
+	}
+}
+
+func TestShutdownIdle(t *testing.T) {
+	srv, _ := startServer(t, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown of the idle server: %v", err)
+	}
+}
+
+func TestResetHostCounters(t *testing.T) {
+	srv, addr := startServer(t, func(srv *Server) {
+		srv.MaxConnsPerDest = 1
+	})
+	echo := startEcho(t)
+
+	stuck, err := NewClient(addr).Connect(testContext(t, 5*time.Second), echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+
+	_, err = NewClient(addr).Connect(testContext(t, 5*time.Second), echo)
+	if code, _ := ReplyCodeOf(err); code != RepConnNotAllowed {
+		t.Fatalf("the connection over the limit: %v", err)
+	}
+
+	srv.ResetHostCounters()
+	if n := srv.destConns.size(); n != 0 {
+		t.Fatalf("%v destinations are counted after the reset", n)
+	}
+
+	// the active session is not counted anymore
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), echo)
+	if err != nil {
+		t.Fatalf("the connection after the reset: %v", err)
+	}
+	defer c.Close()
+
+	checkEcho(t, stuck, "ping")
+
+	// the session counted before the reset does not release the new one
+	stuck.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = NewClient(addr).Connect(testContext(t, 5*time.Second), echo)
+	if code, _ := ReplyCodeOf(err); code != RepConnNotAllowed {
+		t.Fatalf("the connection over the limit after the reset: %v", err)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	const limit = 2
+
+	_, addr := startServer(t, func(srv *Server) {
+		srv.MaxConns = limit
+	})
+	echo := startEcho(t)
+
+	var conns []net.Conn
+	for i := 0; i < limit; i++ {
+		c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		checkEcho(t, c, "ping")
+		conns = append(conns, c)
+	}
+
+	// the excess connection is accepted and closed at once
+	c := stallNegotiation(t, addr)
+	if rep, dur := readAll(c); rep != "" || dur > 2*time.Second {
+		t.Fatalf("the connection over the limit got %q in %v", rep, dur)
+	}
+
+	_, err := NewClient(addr).Connect(testContext(t, 5*time.Second), echo)
+	if err == nil {
+		t.Fatal("the connection over the limit is served")
+	}
+
+	// the finished session frees the slot
+	conns[0].Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), echo)
+		if err == nil {
+			defer c.Close()
+
+			checkEcho(t, c, "ping")
+			checkEcho(t, conns[1], "ping")
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("the connection after the session is finished: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNegativeLimitsDisabled(t *testing.T) {
+	_, addr := startServer(t, func(srv *Server) {
+		srv.MaxConns = -1
+		srv.MaxBindListeners = -1
+		srv.MaxConnsPerDest = -1
+	})
+	echo := startEcho(t)
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), echo)
+	if err != nil {
+		t.Fatalf("CONNECT with the negative limits: %v", err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c, "ping")
+
+	bindAddr := make(chan net.Addr, 1)
+	bindErr := make(chan error, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		_, err := NewClient(addr).Bind(ctx, "127.0.0.1:0", bindAddr)
+		bindErr <- err
+	}()
+
+	select {
+	case <-bindAddr:
+	case err := <-bindErr:
+		t.Fatalf("BIND with the negative limits: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first BIND reply is not received")
+	}
+}
+
+func TestDisabledCommands(t *testing.T) {
+	listened := make(chan net.Addr, 1)
+	_, addr := startServer(t, func(srv *Server) {
+		srv.DisableBind = true
+		srv.DisableUDP = true
+		srv.Auth = NewPassAuth("user", "pass")
+		srv.OnBindListen = func(client, listenAddr net.Addr) { listened <- listenAddr }
+	})
+
+	client := NewClient(addr)
+	client.Auth = NewPassAuth("user", "pass")
+
+	_, err := client.Bind(testContext(t, 5*time.Second), "127.0.0.1:0", make(chan net.Addr, 1))
+	if code, _ := ReplyCodeOf(err); code != RepCmdNotSupported {
+		t.Fatalf("the disabled BIND: %v", err)
+	}
+
+	select {
+	case l := <-listened:
+		t.Fatalf("the disabled BIND is listening at %v", l)
+	default:
+	}
+
+	_, err = client.UDP(testContext(t, 5*time.Second), "0.0.0.0:0")
+	if code, _ := ReplyCodeOf(err); code != RepCmdNotSupported {
+		t.Fatalf("the disabled UDP ASSOCIATE: %v", err)
+	}
+
+	// the handshake and CONNECT are not affected
+	c, err := client.Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c, "ping")
+}
+
+// upperConn sends the data in upper case
+type upperConn struct {
+	net.Conn
+}
+
+func (c upperConn) Write(p []byte) (int, error) {
+	return c.Conn.Write(bytes.ToUpper(p))
+}
+
+func TestWrapUpstream(t *testing.T) {
+	echo := startEcho(t)
+	requests := make(chan *Request, 1)
+
+	_, addr := startServer(t, func(srv *Server) {
+		srv.WrapUpstream = func(ctx context.Context, conn net.Conn, req *Request) (net.Conn, error) {
+			requests <- req
+			return upperConn{conn}, nil
+		}
+	})
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if req := <-requests; req.Dst.String() != echo {
+		t.Fatalf("WrapUpstream got the request to %v", req.Dst)
+	}
+
+	// the data is relayed through the wrapped connection
+	_, err = c.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readExactly(t, c, "PING")
+}
+
+func TestWrapUpstreamError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	upstreams := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			upstreams <- c
+		}
+	}()
+
+	_, addr := startServer(t, func(srv *Server) {
+		srv.WrapUpstream = func(ctx context.Context, conn net.Conn, req *Request) (net.Conn, error) {
+			return nil, errors.New("the TLS handshake is failed")
+		}
+	})
+
+	_, err = NewClient(addr).Connect(testContext(t, 5*time.Second), l.Addr().String())
+	if code, _ := ReplyCodeOf(err); code != RepServerFailure {
+		t.Fatalf("the failed wrap: %v", err)
+	}
+
+	// the dialed connection is closed
+	upstream := <-upstreams
+	defer upstream.Close()
+
+	if rep, dur := readAll(upstream); rep != "" || dur > 2*time.Second {
+		t.Fatalf("the upstream got %q and is closed in %v", rep, dur)
+	}
+}
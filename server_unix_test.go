@@ -0,0 +1,60 @@
+//go:build unix
+
+package socks5
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestListenAndServeWithSignalsShutdown(t *testing.T) {
+	srv := NewServer("127.0.0.1:0")
+	srv.DisableLogger()
+
+	result := make(chan error, 1)
+	go func() { result <- srv.ListenAndServeWithSignals(syscall.SIGUSR1) }()
+
+	<-srv.Ready()
+
+	srv.listenerMu.Lock()
+	addr := srv.listener.Addr().String()
+	srv.listenerMu.Unlock()
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+
+	// new connections are not accepted, but the active session is finished gracefully
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = net.DialTimeout("tcp", addr, time.Second)
+	if err == nil {
+		t.Error("the connection is accepted after the signal")
+	}
+
+	checkEcho(t, c, "ping")
+
+	select {
+	case err := <-result:
+		t.Fatalf("the server is stopped before the session is finished (%v)", err)
+	default:
+	}
+
+	c.Close()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("ListenAndServeWithSignals: %v", err)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server is not stopped after the session is finished")
+	}
+}
@@ -0,0 +1,89 @@
+package socks5
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// SessionInfo represents an established session between the client and the server
+type SessionInfo struct {
+	ID      string   // Unique ID of the session (see SessionIDFromContext)
+	User    string   // Username of the authenticated client (empty, if the authentication method has no identity)
+	Client  net.Addr // Remote address of the client
+	Request *Request // Request sent by the client
+
+	TLS *tls.ConnectionState // State of the upstream TLS connection, if Server.WrapUpstream returned a *tls.Conn (nil otherwise)
+}
+
+// Collect the information about the session
+func makeSessionInfo(c conn) *SessionInfo {
+	info := &SessionInfo{
+		ID:      c.Client().SessionID(),
+		User:    c.Client().User(),
+		Client:  c.Client().Raw().RemoteAddr(),
+		Request: c.Request(),
+	}
+
+	if upstream, ok := c.Server().(*tls.Conn); ok {
+		state := upstream.ConnectionState()
+		info.TLS = &state
+	}
+
+	return info
+}
+
+// Return the client address prefixed by the username, if the client is authenticated ("user@127.0.0.1:5000")
+func clientString(c *Conn) string {
+	remote := c.Raw().RemoteAddr().String()
+	if c.User() == "" {
+		return remote
+	}
+
+	return c.User() + "@" + remote
+}
+
+type sessionIDKey struct{}
+
+// Return the ID of the session the request belongs to (see Conn.SessionID).
+// The context is passed to Rules, Dialer, Server.OnRequest and Server.WrapUpstream
+func SessionIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(sessionIDKey{}).(string)
+	return id
+}
+
+func contextWithSessionID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, sessionIDKey{}, id)
+}
+
+// Return a random session ID (16 hex digits)
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// activity tracks the time of the last data transfer of the session
+type activity struct {
+	last int64 // unix nanoseconds (0, if the transfer is not started)
+}
+
+// Mark the session as active
+func (a *activity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// Duration since the last data transfer. 0 is returned, if the transfer is not started
+func (a *activity) idleFor() time.Duration {
+	last := atomic.LoadInt64(&a.last)
+	if last == 0 {
+		return 0
+	}
+
+	return time.Since(time.Unix(0, last))
+}
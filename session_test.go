@@ -0,0 +1,147 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionInfoUpstreamTLS(t *testing.T) {
+	echo := startTLSEcho(t, &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t)},
+		NextProtos:   []string{"echo/1"},
+	})
+
+	sessions := make(chan *SessionInfo, 1)
+	_, addr := startServer(t, func(srv *Server) {
+		srv.WrapUpstream = func(ctx context.Context, conn net.Conn, req *Request) (net.Conn, error) {
+			upstream := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"echo/1"}})
+			return upstream, upstream.HandshakeContext(ctx)
+		}
+		srv.OnSession = func(info *SessionInfo) { sessions <- info }
+	})
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c, "ping")
+
+	info := <-sessions
+	if info.TLS == nil {
+		t.Fatal("the upstream TLS state is not reported")
+	}
+
+	if !info.TLS.HandshakeComplete || info.TLS.NegotiatedProtocol != "echo/1" || len(info.TLS.PeerCertificates) != 1 {
+		t.Fatalf("the upstream TLS state: %+v", info.TLS)
+	}
+}
+
+func TestSessionInfoPlainUpstream(t *testing.T) {
+	sessions := make(chan *SessionInfo, 1)
+	_, addr := startServer(t, func(srv *Server) {
+		srv.OnSession = func(info *SessionInfo) { sessions <- info }
+	})
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if info := <-sessions; info.TLS != nil {
+		t.Fatalf("the TLS state of the plain upstream: %+v", info.TLS)
+	}
+}
+
+// idRules records the session ID passed to Rules
+type idRules struct {
+	ids chan string
+}
+
+func (r *idRules) Allow(ctx context.Context, cmd cmdType, dst *Addr) (bool, repType) {
+	r.ids <- "Rules " + SessionIDFromContext(ctx)
+	return true, RepSucceeded
+}
+
+// idDialer records the session ID passed to the dialer
+type idDialer struct {
+	net.Dialer
+	ids chan string
+}
+
+func (d *idDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.ids <- "Dialer " + SessionIDFromContext(ctx)
+	return d.Dialer.DialContext(ctx, network, address)
+}
+
+func TestSessionIDInHooks(t *testing.T) {
+	ids := make(chan string, 8)
+	srv, addr := startServer(t, func(srv *Server) {
+		srv.OnRequest = func(ctx context.Context, conn *Conn, req *Request) (context.Context, error) {
+			ids <- "OnRequest " + SessionIDFromContext(ctx)
+			return ctx, nil
+		}
+		srv.Rules = &idRules{ids}
+		srv.Dialer = &idDialer{ids: ids}
+		srv.WrapUpstream = func(ctx context.Context, conn net.Conn, req *Request) (net.Conn, error) {
+			ids <- "WrapUpstream " + SessionIDFromContext(ctx)
+			return conn, nil
+		}
+		srv.OnSession = func(info *SessionInfo) { ids <- "OnSession " + info.ID }
+	})
+	events := srv.Events()
+
+	session := func() string {
+		c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), startEcho(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		var id string
+		for _, hook := range []string{"OnRequest", "Rules", "Dialer", "WrapUpstream", "OnSession"} {
+			got := <-ids
+			if !strings.HasPrefix(got, hook+" ") {
+				t.Fatalf("%v is called instead of %v", got, hook)
+			}
+
+			got = strings.TrimPrefix(got, hook+" ")
+			if got == "" || (id != "" && got != id) {
+				t.Fatalf("%v got the session ID %q, the previous hooks got %q", hook, got, id)
+			}
+			id = got
+		}
+
+		return id
+	}
+
+	first, second := session(), session()
+	if first == second {
+		t.Fatalf("two sessions have the same ID %q", first)
+	}
+
+	// every event carries the ID the hooks of the session got
+	closed := map[string]bool{}
+	timeout := time.After(5 * time.Second)
+	for !closed[first] || !closed[second] {
+		select {
+		case e := <-events:
+			if e.SessionID != first && e.SessionID != second {
+				t.Fatalf("the %v event has the session ID %q, the hooks got %q and %q", e.Type, e.SessionID, first, second)
+			}
+
+			if e.Type == EventClose {
+				closed[e.SessionID] = true
+			}
+
+		case <-timeout:
+			t.Fatal("the close events are not received")
+		}
+	}
+}
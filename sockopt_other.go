@@ -0,0 +1,23 @@
+//go:build !unix && !windows
+
+package socks5
+
+import (
+	"net"
+	"runtime"
+)
+
+// Allow the UDP connection to send datagrams to broadcast addresses (not supported on this platform)
+func setBroadcast(c *net.UDPConn) error {
+	return ErrConn.New("SO_BROADCAST is not supported on %v", runtime.GOOS)
+}
+
+// Set the length of the accept queue of the listening socket (not supported on this platform)
+func setBacklog(l *net.TCPListener, backlog int) error {
+	return ErrConn.New("the listen backlog is not supported on %v", runtime.GOOS)
+}
+
+// Wait till a datagram is received by the UDP connection (not supported on this platform, the following read waits instead)
+func waitReadable(c *net.UDPConn) error {
+	return nil
+}
@@ -0,0 +1,59 @@
+//go:build unix
+
+package socks5
+
+import (
+	"net"
+	"syscall"
+)
+
+// Allow the UDP connection to send datagrams to broadcast addresses (SO_BROADCAST)
+func setBroadcast(c *net.UDPConn) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var opterr error
+	err = raw.Control(func(fd uintptr) {
+		opterr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+	})
+	if err != nil {
+		return err
+	}
+
+	return opterr
+}
+
+// Set the length of the accept queue of the listening socket (the kernel caps it by SOMAXCONN)
+func setBacklog(l *net.TCPListener, backlog int) error {
+	raw, err := l.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var listenErr error
+	err = raw.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+
+	return listenErr
+}
+
+// Wait till a datagram is received by the UDP connection without reading it (MSG_PEEK), so no buffer is held while waiting.
+// The read deadline of the connection is applied. Errors of the peek are returned by the following read
+func waitReadable(c *net.UDPConn) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var b [1]byte
+	return raw.Read(func(fd uintptr) bool {
+		_, _, err := syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK)
+		return err != syscall.EAGAIN
+	})
+}
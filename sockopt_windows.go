@@ -0,0 +1,49 @@
+//go:build windows
+
+package socks5
+
+import (
+	"net"
+	"syscall"
+)
+
+// Allow the UDP connection to send datagrams to broadcast addresses (SO_BROADCAST)
+func setBroadcast(c *net.UDPConn) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var opterr error
+	err = raw.Control(func(fd uintptr) {
+		opterr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+	})
+	if err != nil {
+		return err
+	}
+
+	return opterr
+}
+
+// Set the length of the accept queue of the listening socket (the system caps it by SOMAXCONN)
+func setBacklog(l *net.TCPListener, backlog int) error {
+	raw, err := l.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var listenErr error
+	err = raw.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(syscall.Handle(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+
+	return listenErr
+}
+
+// Wait till a datagram is received by the UDP connection (not supported on Windows, the following read waits instead)
+func waitReadable(c *net.UDPConn) error {
+	return nil
+}
@@ -0,0 +1,69 @@
+package socks5
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// Stats represents counters of the server activity
+type Stats struct {
+	ActiveConns int64            `json:"active_conns"` // Number of connections that are being served
+	Bytes       int64            `json:"bytes"`        // Total number of bytes transferred between clients and servers
+	Commands    map[string]int64 `json:"commands"`     // Number of requests per command ("CONNECT", "BIND", "UDP ASSOCIATE")
+	Errors      int64            `json:"errors"`       // Number of connections that failed during the authentication, the request handling or the data transfer
+
+	DroppedEvents int64 `json:"dropped_events"` // Number of events dropped, cause the consumer of Server.Events is slow
+}
+
+// serverStats collects the server activity. All the counters are updated atomically
+type serverStats struct {
+	active int64
+	bytes  int64
+	errors int64
+
+	droppedEvents int64
+
+	commands [4]int64 // indexed by cmdType
+}
+
+func (s *serverStats) addBytes(n int) {
+	atomic.AddInt64(&s.bytes, int64(n))
+}
+
+func (s *serverStats) addCommand(cmd cmdType) {
+	if cmd.Valid() {
+		atomic.AddInt64(&s.commands[cmd], 1)
+	}
+}
+
+func (s *serverStats) snapshot() Stats {
+	stats := Stats{
+		ActiveConns: atomic.LoadInt64(&s.active),
+		Bytes:       atomic.LoadInt64(&s.bytes),
+		Errors:      atomic.LoadInt64(&s.errors),
+		Commands:    make(map[string]int64),
+
+		DroppedEvents: atomic.LoadInt64(&s.droppedEvents),
+	}
+
+	for _, cmd := range []cmdType{CmdConnect, CmdBind, CmdUDP} {
+		stats.Commands[cmd.String()] = atomic.LoadInt64(&s.commands[cmd])
+	}
+
+	return stats
+}
+
+// countWriter counts bytes written to the underlying writer and marks the session as active
+type countWriter struct {
+	w        io.Writer
+	stats    *serverStats
+	activity *activity
+}
+
+func (w *countWriter) Write(p []byte) (n int, err error) {
+	n, err = w.w.Write(p)
+	w.stats.addBytes(n)
+	w.activity.touch()
+
+	return n, err
+}
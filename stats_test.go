@@ -0,0 +1,39 @@
+package socks5
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	srv, addr := startServer(t, nil)
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkEcho(t, c, "ping")
+
+	if stats := srv.Stats(); stats.ActiveConns != 1 || stats.Commands["CONNECT"] != 1 || stats.Commands["BIND"] != 0 {
+		t.Fatalf("the stats of the active session: %+v", stats)
+	}
+
+	// the handshake failure is counted as an error
+	_, err = NewClient(addr).Connect(testContext(t, 5*time.Second), closedPort(t))
+	if err == nil {
+		t.Fatal("the connection to the closed port is established")
+	}
+
+	c.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.Stats().ActiveConns != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := srv.Stats()
+	if stats.ActiveConns != 0 || stats.Errors != 1 || stats.Bytes != 8 || stats.Commands["CONNECT"] != 2 {
+		t.Fatalf("the stats after the sessions: %+v", stats)
+	}
+}
@@ -0,0 +1,34 @@
+package socks5
+
+import "crypto/tls"
+
+var (
+	// Cipher suites with forward secrecy and authenticated encryption that are allowed for TLS 1.2
+	// (cipher suites of TLS 1.3 are not configurable and secure)
+	secureCipherSuites = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+	}
+)
+
+// Load the certificate and enable TLS with secure defaults (TLS 1.2 or newer, cipher suites with forward secrecy).
+//
+// Error is returned, if the certificate or the key can not be loaded
+func (srv *Server) SetSecureTLS(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return ErrConn.Wrap(err, "unable to load the TLS certificate")
+	}
+
+	srv.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		CipherSuites: secureCipherSuites,
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+package socks5
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Return the self-signed certificate for 127.0.0.1
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "socks5 test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// Start the TLS server that echoes everything it reads. It is closed, when the test is finished
+func startTLSEcho(t *testing.T, config *tls.Config) string {
+	t.Helper()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// Write the self-signed certificate and its key to the PEM files in the temporary directory of the test
+func writeCertificate(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+
+	cert := testCertificate(t)
+
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600)
+	if err == nil {
+		err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+// Start the server with SetSecureTLS and return its address
+func startSecureTLSServer(t *testing.T) string {
+	t.Helper()
+
+	certFile, keyFile := writeCertificate(t)
+
+	var tlsErr error
+	_, addr := startServer(t, func(srv *Server) {
+		tlsErr = srv.SetSecureTLS(certFile, keyFile)
+	})
+	if tlsErr != nil {
+		t.Fatal(tlsErr)
+	}
+
+	return addr
+}
+
+func TestSetSecureTLSRejectsTLS10(t *testing.T) {
+	addr := startSecureTLSServer(t)
+
+	c, err := tls.Dial("tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS10,
+		MaxVersion:         tls.VersionTLS10,
+	})
+	if err == nil {
+		c.Close()
+		t.Fatal("the TLS 1.0 client is accepted")
+	}
+}
+
+func TestSetSecureTLSAcceptsTLS12(t *testing.T) {
+	addr := startSecureTLSServer(t)
+
+	client := NewClient(addr)
+	client.Dialer = &tls.Dialer{Config: &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+	}}
+
+	c, err := client.Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c, "ping")
+
+	state := c.(*tls.Conn).ConnectionState()
+	if state.Version != tls.VersionTLS12 || state.NegotiatedProtocol != "" {
+		t.Fatalf("the TLS state: version %#x, protocol %q", state.Version, state.NegotiatedProtocol)
+	}
+}
+
+func TestSetSecureTLSMissingFiles(t *testing.T) {
+	srv := NewServer("")
+
+	err := srv.SetSecureTLS(filepath.Join(t.TempDir(), "cert.pem"), filepath.Join(t.TempDir(), "key.pem"))
+	if err == nil || srv.TLSConfig != nil {
+		t.Fatalf("missing files: %v, TLSConfig %v", err, srv.TLSConfig)
+	}
+}
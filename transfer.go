@@ -0,0 +1,24 @@
+package socks5
+
+import "io"
+
+var (
+	// CopyTransferer copies the data with io.Copy. It is used by the server, if Server.Transferer is nil
+	CopyTransferer Transferer = copyTransferer{}
+)
+
+// Transferer copies the data of CONNECT and BIND connections in one direction.
+//
+// Transfer is called twice for every connection (client -> destination and destination -> client),
+// it must copy the data from src to dst till EOF or an error and return the number of copied bytes.
+// dst counts the transferred bytes and the activity of the connection, so Transferer may wrap dst and src
+// (e.g. to limit the rate), but must not bypass them
+type Transferer interface {
+	Transfer(dst io.Writer, src io.Reader) (int64, error)
+}
+
+type copyTransferer struct{}
+
+func (copyTransferer) Transfer(dst io.Writer, src io.Reader) (int64, error) {
+	return io.Copy(dst, src)
+}
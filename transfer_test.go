@@ -0,0 +1,139 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// upperTransferer copies the data in upper case and counts the calls
+type upperTransferer struct {
+	calls int64
+}
+
+func (t *upperTransferer) Transfer(dst io.Writer, src io.Reader) (int64, error) {
+	atomic.AddInt64(&t.calls, 1)
+
+	var written int64
+	b := make([]byte, 512)
+	for {
+		n, err := src.Read(b)
+		if n > 0 {
+			m, werr := dst.Write(bytes.ToUpper(b[:n]))
+			written += int64(m)
+
+			if werr != nil {
+				return written, werr
+			}
+		}
+
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// Read len(want) bytes from c and compare them with want
+func readExactly(t *testing.T, c net.Conn, want string) {
+	t.Helper()
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer c.SetReadDeadline(time.Time{})
+
+	b := make([]byte, len(want))
+	_, err := io.ReadFull(c, b)
+	if err != nil || string(b) != want {
+		t.Fatalf("read %q, want %q: %v", b, want, err)
+	}
+}
+
+func TestTCPConnTransferer(t *testing.T) {
+	client, clientProxy := net.Pipe()
+	serverProxy, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	transferer := &upperTransferer{}
+	c := &tcpConn{
+		client:     NewConn(clientProxy),
+		server:     serverProxy,
+		stats:      &serverStats{},
+		transferer: transferer,
+	}
+	defer c.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- c.Transfer(context.Background())
+	}()
+
+	go client.Write([]byte("ping"))
+	readExactly(t, server, "PING")
+
+	go server.Write([]byte("pong"))
+	readExactly(t, client, "PONG")
+
+	// EOF of one side finishes the transfer without an error
+	server.Close()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("transfer: %v", err)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("the transfer is not finished on EOF")
+	}
+
+	if calls := atomic.LoadInt64(&transferer.calls); calls != 2 {
+		t.Errorf("Transfer is called %v times", calls)
+	}
+
+	// the bytes are counted after the write returns
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&c.stats.bytes) < 8 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if n := atomic.LoadInt64(&c.stats.bytes); n != 8 {
+		t.Errorf("%v bytes are counted", n)
+	}
+}
+
+func TestServerTransferer(t *testing.T) {
+	transferer := &upperTransferer{}
+	srv, addr := startServer(t, func(srv *Server) {
+		srv.Transferer = transferer
+	})
+
+	c, err := NewClient(addr).Connect(testContext(t, 5*time.Second), startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = c.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readExactly(t, c, "PING")
+
+	if calls := atomic.LoadInt64(&transferer.calls); calls != 2 {
+		t.Errorf("Transfer is called %v times", calls)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.Stats().Bytes < 8 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if n := srv.Stats().Bytes; n != 8 {
+		t.Errorf("%v bytes are counted", n)
+	}
+}
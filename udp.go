@@ -3,8 +3,11 @@ package socks5
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/osf4/socks5/internal/errio"
@@ -12,16 +15,42 @@ import (
 
 const (
 	maxUDPHeaderLength = 65535
+	controlBuffer      = 512                    // buffer size for data read from the control connection
+	batchWait          = 100 * time.Microsecond // time ReadHeaders waits for the next datagram of the batch
 )
 
-// UDPConn represents a UDP connection
+// UDPConn represents a UDP connection.
+//
+// WriteTo addresses every datagram separately, so one connection could be used for many destinations.
+// Write sends datagrams to the fixed destination Dst. Datagrams of concurrent Write and WriteTo calls are not interleaved,
+// but Dst must not be modified while Write is running. Reads must not be called concurrently
 type UDPConn struct {
-	control net.Conn // control TCP connection (UDP connection terminates on control.Close)
-	data    net.Conn
+	control     net.Conn // control TCP connection (UDP connection terminates on control.Close)
+	data        net.Conn
+	ownsControl bool          // close the control connection on Close (false, if the connection is made by Client.UDPOn)
+	drain       time.Duration // time the queued datagrams are read for, when the control connection is closed (0 closes the association at once)
 
-	income []byte // buffer for incoming headers
+	income  []byte      // buffer for incoming headers
+	batch   [][]byte    // buffers for the datagrams read by ReadHeaders at once (allocated on the first batch read)
+	writeMu sync.Mutex  // serializes encoding of outgoing headers
+	closed  atomic.Bool // true, if the association is closed
 
-	Dst *Addr
+	done      chan struct{} // closed, when the association is closed
+	closeOnce sync.Once
+
+	keepAlive   chan struct{} // closed to stop the running keepalive (nil, if it is not enabled)
+	keepAliveMu sync.Mutex
+
+	peerMu sync.Mutex
+	peer   net.Addr // source of the last datagram, if data is not connected (server side of the association)
+
+	accept func(addr net.Addr) bool // filter of the datagram sources, if data is not connected (nil accepts all the sources)
+
+	deadlineMu   sync.Mutex
+	readDeadline time.Time // read deadline set by the user (ReadHeaders restores it)
+
+	Dst   *Addr
+	Codec UDPCodec // Codec of UDP headers (DefaultUDPCodec is used, if Codec is nil)
 }
 
 // Return a UDP connection with default internal buffer size
@@ -31,6 +60,14 @@ func NewUDPConn(control, data net.Conn) *UDPConn {
 
 // Return a UDP connection with custom buffer size
 func NewUDPConnSize(control, data net.Conn, buffer int) *UDPConn {
+	return newUDPConn(control, data, buffer, 0, true, nil)
+}
+
+// Return a UDP connection with custom buffer size.
+// Data read from the control connection is passed to onControl (if it is not nil).
+// If drain is not 0, the queued datagrams could be read during drain after the control connection is closed.
+// If ownsControl is true, Close closes the control connection as well
+func newUDPConn(control, data net.Conn, buffer int, drain time.Duration, ownsControl bool, onControl func([]byte)) *UDPConn {
 	if buffer == 0 {
 		buffer = maxUDPHeaderLength
 	}
@@ -39,12 +76,17 @@ func NewUDPConnSize(control, data net.Conn, buffer int) *UDPConn {
 		control: control,
 		data:    data,
 		income:  make([]byte, buffer),
+		done:    make(chan struct{}),
+		drain:   drain,
+
+		ownsControl: ownsControl,
 	}
-	go c.onTCPClose()
+	go c.onTCPClose(onControl)
 
 	return c
 }
 
+// Send the datagram to c.Dst
 func (c *UDPConn) Write(p []byte) (n int, err error) {
 	if c.Dst == nil {
 		return 0, ErrProtocol.New("unable to use UDPConn.Write, cause UDPConn.Dst == nil")
@@ -58,6 +100,7 @@ func (c *UDPConn) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
+// Send the datagram to addr. Dst is not used and not modified
 func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	header := &UDPHeader{
 		Frag: 0x00,
@@ -65,7 +108,15 @@ func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 		Data: p,
 	}
 
-	err = header.Write(c.data)
+	wr, err := c.writer()
+	if err != nil {
+		return 0, err
+	}
+
+	c.writeMu.Lock()
+	err = c.codec().Encode(wr, header)
+	c.writeMu.Unlock()
+
 	if err != nil {
 		return 0, err
 	}
@@ -73,25 +124,43 @@ func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	return len(p), nil
 }
 
+// Read the datagram into p. addr is the destination the datagram was received from.
+//
+// If p is smaller than the datagram, the rest of the datagram is discarded
 func (c *UDPConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	header, err := c.ReadHeader()
+	header, err := c.ReadHeaderInto(c.income)
 	if err != nil {
 		return 0, nil, err
 	}
 
-	return len(header.Data), header.Dst, nil
+	n = copy(p, header.Data)
+	return n, header.Dst, nil
 }
 
+// Read the datagram. Data of the header is not reused by the following reads
 func (c *UDPConn) ReadHeader() (*UDPHeader, error) {
-	n, err := c.data.Read(c.income)
+	header, err := c.ReadHeaderInto(c.income)
+	if err != nil {
+		return nil, err
+	}
+
+	return header.detach(), nil
+}
+
+// Read the datagram into buf, that is provided by the caller (e.g. taken from a pool).
+//
+// Data of the returned header aliases buf, so buf must not be reused till the header is processed.
+// If buf is smaller than the datagram, the rest of the datagram is discarded
+func (c *UDPConn) ReadHeaderInto(buf []byte) (*UDPHeader, error) {
+	n, err := c.read(buf)
 	if err != nil {
 		return nil, err
 	}
 
-	payload := c.income[:n]
+	payload := buf[:n]
 	header := &UDPHeader{}
 
-	err = header.Read(bytes.NewReader(payload))
+	err = c.codec().Decode(payload, header)
 	if err != nil {
 		return nil, err
 	}
@@ -99,6 +168,141 @@ func (c *UDPConn) ReadHeader() (*UDPHeader, error) {
 	return header, nil
 }
 
+// Read up to max datagrams, that have been received by the connection.
+//
+// The call blocks till the first datagram is received, the next ones are read while they are queued in the socket.
+// On Linux the datagrams are read with one recvmmsg call into max buffers of the connection buffer size, that are kept for the next calls.
+// Other platforms read the datagrams one by one.
+// Unlike ReadHeader, the data of the returned headers is not reused by the following reads
+func (c *UDPConn) ReadHeaders(max int) ([]*UDPHeader, error) {
+	if max > 1 {
+		headers, ok, err := c.readBatch(max)
+		if ok {
+			return headers, err
+		}
+	}
+
+	header, err := c.ReadHeader()
+	if err != nil {
+		return nil, err
+	}
+	headers := []*UDPHeader{header}
+
+	if max <= 1 {
+		return headers, nil
+	}
+
+	deadline := c.userReadDeadline()
+	defer c.data.SetReadDeadline(deadline)
+
+	for len(headers) < max {
+		wait := time.Now().Add(batchWait)
+		if !deadline.IsZero() && deadline.Before(wait) {
+			wait = deadline
+		}
+		c.data.SetReadDeadline(wait)
+
+		header, err = c.ReadHeader()
+		if err != nil {
+			break
+		}
+		headers = append(headers, header)
+	}
+
+	return headers, nil
+}
+
+func (c *UDPConn) userReadDeadline() time.Time {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+
+	return c.readDeadline
+}
+
+func (c *UDPConn) setUserReadDeadline(t time.Time) {
+	c.deadlineMu.Lock()
+	c.readDeadline = t
+	c.deadlineMu.Unlock()
+}
+
+func (c *UDPConn) codec() UDPCodec {
+	if c.Codec == nil {
+		return DefaultUDPCodec
+	}
+
+	return c.Codec
+}
+
+// Read a datagram from the data connection.
+//
+// If the data connection is not connected, the source of the datagram is remembered as the peer.
+// Datagrams from the sources rejected by c.accept are dropped.
+// ErrAssociationClosed is returned, if the association is closed
+func (c *UDPConn) read(b []byte) (int, error) {
+	n, err := c.readData(b)
+	if err != nil && c.closed.Load() {
+		return n, ErrAssociationClosed.Wrap(err, "the UDP association is closed")
+	}
+
+	return n, err
+}
+
+func (c *UDPConn) readData(b []byte) (int, error) {
+	pc, ok := c.data.(net.PacketConn)
+	if !ok || c.data.RemoteAddr() != nil {
+		return c.data.Read(b)
+	}
+
+	for {
+		n, addr, err := pc.ReadFrom(b)
+		if err != nil {
+			return n, err
+		}
+
+		if !c.accepts(addr) {
+			continue
+		}
+
+		c.peerMu.Lock()
+		c.peer = addr
+		c.peerMu.Unlock()
+
+		return n, nil
+	}
+}
+
+// True, if the datagrams sent from addr are accepted
+func (c *UDPConn) accepts(addr net.Addr) bool {
+	return c.accept == nil || c.accept(addr)
+}
+
+// Return the writer for outgoing datagrams.
+//
+// If the data connection is not connected, datagrams are sent to the peer
+func (c *UDPConn) writer() (io.Writer, error) {
+	pc, ok := c.data.(net.PacketConn)
+	if !ok || c.data.RemoteAddr() != nil {
+		return c.data, nil
+	}
+
+	c.peerMu.Lock()
+	peer := c.peer
+	c.peerMu.Unlock()
+
+	if peer == nil {
+		return nil, ErrProtocol.New("unable to write the UDP header, cause the peer address is unknown")
+	}
+
+	return &packetWriter{pc, peer}, nil
+}
+
+// Return the control TCP connection of the association.
+//
+// Closing the control connection closes the association. Data read from it is lost for the association
+func (c *UDPConn) Control() net.Conn {
+	return c.control
+}
+
 func (c *UDPConn) LocalAddr() net.Addr {
 	return c.data.LocalAddr()
 }
@@ -108,6 +312,7 @@ func (c *UDPConn) RemoteAddr() net.Addr {
 }
 
 func (c *UDPConn) SetDeadline(t time.Time) error {
+	c.setUserReadDeadline(t)
 	return c.data.SetDeadline(t)
 }
 
@@ -116,32 +321,179 @@ func (c *UDPConn) SetWriteDeadline(t time.Time) error {
 }
 
 func (c *UDPConn) SetReadDeadline(t time.Time) error {
+	c.setUserReadDeadline(t)
 	return c.data.SetReadDeadline(t)
 }
 
+// Set the deadline of the control TCP connection.
+//
+// The association is closed, if the deadline is expired, cause the control connection is read till an error occurs.
+// A zero value of t means no deadline
+func (c *UDPConn) SetControlDeadline(t time.Time) error {
+	return c.control.SetDeadline(t)
+}
+
+// Send a zero-length datagram to c.Dst every interval till the association is closed.
+// It keeps the NAT bindings and the firewall state of the UDP path alive, while the association is idle.
+// The next call replaces the running keepalive (e.g. to change the interval).
+//
+// Error is returned, if c.Dst is nil or interval is not positive
+func (c *UDPConn) EnableKeepAlive(interval time.Duration) error {
+	if c.Dst == nil {
+		return ErrProtocol.New("unable to enable the UDP keepalive, cause UDPConn.Dst == nil")
+	}
+
+	if interval <= 0 {
+		return ErrProtocol.New("unable to enable the UDP keepalive, cause the interval (%v) is not positive", interval)
+	}
+	dst := c.Dst
+
+	stop := make(chan struct{})
+
+	c.keepAliveMu.Lock()
+	if c.keepAlive != nil {
+		close(c.keepAlive)
+	}
+	c.keepAlive = stop
+	c.keepAliveMu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.done:
+				return
+
+			case <-stop:
+				return
+
+			case <-ticker.C:
+				c.WriteTo(nil, dst)
+			}
+		}
+	}()
+
+	return nil
+}
+
 func (c *UDPConn) Close() error {
-	c.control.Close()
+	c.closeOnce.Do(func() { close(c.done) })
+	c.closed.Store(true)
+	if c.ownsControl {
+		c.control.Close()
+	}
+
 	return c.data.Close()
 }
 
-// Close the UDP connection, when the control TCP connection is closed
-func (c *UDPConn) onTCPClose() {
-	c.control.Read(nil) // wait till the connection is closed
+// Close the UDP connection, when the control TCP connection is closed.
+//
+// Data sent over the control connection is passed to onControl (if it is not nil) and ignored otherwise
+func (c *UDPConn) onTCPClose(onControl func([]byte)) {
+	b := make([]byte, controlBuffer)
+
+	for {
+		n, err := c.control.Read(b)
+		if n > 0 && onControl != nil {
+			onControl(b[:n])
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	if c.drain != 0 {
+		// reads fail with ErrAssociationClosed, when the queue is drained
+		c.closed.Store(true)
+		c.data.SetReadDeadline(time.Now().Add(c.drain))
+
+		time.Sleep(c.drain)
+	}
 
 	c.Close()
 }
 
+var (
+	DefaultUDPCodec UDPCodec = &socksCodec{} // DefaultUDPCodec implements the standard SOCKS5 framing of UDP headers
+)
+
+// UDPCodec represents an encoder/decoder of UDP headers.
+//
+// Custom codecs allow to extend the framing (e.g. add sequence numbers) between the matched client and server
+type UDPCodec interface {
+	Encode(wr io.Writer, h *UDPHeader) error // Write the header to wr with a single Write call (every call produces a datagram)
+	Decode(b []byte, h *UDPHeader) error     // Read the header from the datagram (h.Data may alias b)
+}
+
+// socksCodec represents the standard SOCKS5 framing of UDP headers
+type socksCodec struct {
+}
+
+func (c *socksCodec) Encode(wr io.Writer, h *UDPHeader) error {
+	return h.Write(wr)
+}
+
+// Decode the header without copying, h.Data aliases b
+func (c *socksCodec) Decode(b []byte, h *UDPHeader) error {
+	rd := bytes.NewReader(b)
+	erd := errio.NewReader(rd)
+
+	rsv := make([]byte, 3)
+	erd.Read(rsv)
+	if err := erd.Error(); err != nil {
+		return ErrProtocol.Wrap(err, "unable to read the UDP header")
+	}
+
+	h.Rsv = binary.BigEndian.Uint16(rsv[:2])
+	h.Frag = rsv[2]
+
+	h.Dst = new(Addr)
+	err := h.Dst.Read("udp", rd)
+	if err != nil {
+		return err
+	}
+
+	h.Data = b[len(b)-rd.Len():]
+	return nil
+}
+
+// packetWriter sends every write as a datagram to addr
+type packetWriter struct {
+	pc   net.PacketConn
+	addr net.Addr
+}
+
+func (w *packetWriter) Write(p []byte) (int, error) {
+	return w.pc.WriteTo(p, w.addr)
+}
+
 // UDPHeader represents UDP headers sent between the client and the server
 type UDPHeader struct {
+	Rsv  uint16 // RSV field (must be 0x0000)
 	Frag byte
 	Dst  *Addr
 	Data []byte
 }
 
+// Return a copy of the header, that does not share Data with the read buffer
+func (h *UDPHeader) detach() *UDPHeader {
+	clone := *h
+	clone.Data = append([]byte(nil), h.Data...)
+
+	return &clone
+}
+
 func (h *UDPHeader) Write(wr io.Writer) error {
 	w := bufio.NewWriterSize(wr, 3+h.Dst.Len()+len(h.Data))
 
-	w.Write([]byte{0x00, 0x00, h.Frag})
+	rsv := make([]byte, binary.Size(h.Rsv))
+	binary.BigEndian.PutUint16(rsv, h.Rsv)
+
+	w.Write(rsv)
+	w.WriteByte(h.Frag)
 
 	err := h.Dst.Write(w)
 	if err != nil {
@@ -163,6 +515,7 @@ func (h *UDPHeader) Read(rd io.Reader) error {
 	b := make([]byte, 3)
 
 	erd.Read(b)
+	h.Rsv = binary.BigEndian.Uint16(b[:2])
 	h.Frag = b[2]
 
 	h.Dst = new(Addr)
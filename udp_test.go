@@ -0,0 +1,649 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+// Return the UDP connection and the socket that sends datagrams to it
+func udpPair(tb testing.TB) (*UDPConn, *net.UDPConn) {
+	tb.Helper()
+
+	sender, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { sender.Close() })
+
+	data, err := net.DialUDP("udp4", nil, sender.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	control, peer := tcpPipe(tb)
+	tb.Cleanup(func() { peer.Close() })
+
+	c := NewUDPConn(control, data)
+	tb.Cleanup(func() { c.Close() })
+
+	return c, sender
+}
+
+// Send the datagram with the SOCKS5 header to the UDP connection
+func sendHeader(tb testing.TB, sender *net.UDPConn, to *UDPConn, data []byte) {
+	tb.Helper()
+
+	var b bytes.Buffer
+
+	header := &UDPHeader{Dst: ParseAddr("udp", "127.0.0.1:53"), Data: data}
+	err := header.Write(&b)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	_, err = sender.WriteTo(b.Bytes(), to.LocalAddr())
+	if err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// packetlessConn hides the UDP socket, so ReadHeaders reads the datagrams one by one
+type packetlessConn struct {
+	net.Conn
+}
+
+func testReadHeaders(t *testing.T, c *UDPConn, sender *net.UDPConn) {
+	for i := 0; i < 5; i++ {
+		sendHeader(t, sender, c, []byte(fmt.Sprintf("datagram %v", i)))
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var headers []*UDPHeader
+	for len(headers) < 5 {
+		batch, err := c.ReadHeaders(10)
+		if err != nil {
+			t.Fatalf("read %v datagrams: %v", len(headers), err)
+		}
+
+		headers = append(headers, batch...)
+	}
+
+	for i, header := range headers {
+		want := fmt.Sprintf("datagram %v", i)
+		if string(header.Data) != want {
+			t.Errorf("datagram %v: got %q, want %q", i, header.Data, want)
+		}
+	}
+
+	if len(headers) != 5 {
+		t.Errorf("got %v datagrams, want 5", len(headers))
+	}
+}
+
+func TestReadHeadersBatch(t *testing.T) {
+	c, sender := udpPair(t)
+	testReadHeaders(t, c, sender)
+}
+
+func TestReadHeadersLoop(t *testing.T) {
+	c, sender := udpPair(t)
+	c.data = packetlessConn{c.data}
+
+	testReadHeaders(t, c, sender)
+}
+
+// Return the UDP connection accepting the datagrams of the first returned socket only and both the sockets
+func filteredUDPPair(t *testing.T) (c *UDPConn, accepted, rejected *net.UDPConn) {
+	t.Helper()
+
+	c, accepted = udpPair(t)
+	_, rejected = udpPair(t)
+
+	data, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.data.Close()
+	c.data = data
+	c.accept = func(addr net.Addr) bool { return addr.String() == accepted.LocalAddr().String() }
+
+	return c, accepted, rejected
+}
+
+func TestReadHeadersRejectedSource(t *testing.T) {
+	c, accepted, rejected := filteredUDPPair(t)
+
+	sendHeader(t, rejected, c, []byte("rejected"))
+	time.Sleep(20 * time.Millisecond)
+	sendHeader(t, accepted, c, []byte("accepted"))
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	headers, err := c.ReadHeaders(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(headers) != 1 || string(headers[0].Data) != "accepted" {
+		t.Fatalf("got %v datagrams (%q)", len(headers), headers[0].Data)
+	}
+}
+
+func TestReadHeadersMalformed(t *testing.T) {
+	c, accepted, rejected := filteredUDPPair(t)
+
+	// the malformed datagram is followed by the rejected one, so no datagram is valid
+	_, err := accepted.WriteTo([]byte{0x00}, c.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendHeader(t, rejected, c, []byte("rejected"))
+	time.Sleep(20 * time.Millisecond)
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = c.ReadHeaders(10)
+	if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("the decoding error is not returned: %v", err)
+	}
+}
+
+func TestReadHeadersDeadline(t *testing.T) {
+	c, _ := udpPair(t)
+
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	_, err := c.ReadHeaders(10)
+	if err == nil {
+		t.Fatal("ReadHeaders returned without datagrams")
+	}
+}
+
+// Read b.N datagrams sent in bursts of burst datagrams with read. If loop is true, the batch read is disabled
+func benchmarkReadHeaders(b *testing.B, burst int, loop bool, read func(c *UDPConn) (int, error)) {
+	c, sender := udpPair(b)
+	if loop {
+		c.data = packetlessConn{c.data}
+	}
+
+	payload := make([]byte, 512)
+
+	b.ResetTimer()
+	for done := 0; done < b.N; {
+		for i := 0; i < burst; i++ {
+			sendHeader(b, sender, c, payload)
+		}
+
+		for received := 0; received < burst; {
+			n, err := read(c)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			received += n
+		}
+
+		done += burst
+	}
+}
+
+func BenchmarkReadHeader(b *testing.B) {
+	benchmarkReadHeaders(b, 32, false, func(c *UDPConn) (int, error) {
+		_, err := c.ReadHeader()
+		return 1, err
+	})
+}
+
+func BenchmarkReadHeadersBatch(b *testing.B) {
+	benchmarkReadHeaders(b, 32, false, func(c *UDPConn) (int, error) {
+		headers, err := c.ReadHeaders(32)
+		return len(headers), err
+	})
+}
+
+func BenchmarkReadHeadersLoop(b *testing.B) {
+	benchmarkReadHeaders(b, 32, true, func(c *UDPConn) (int, error) {
+		headers, err := c.ReadHeaders(32)
+		return len(headers), err
+	})
+}
+
+// magicCodec prefixes the standard SOCKS5 framing with the magic bytes
+type magicCodec struct{}
+
+const codecMagic = "EXT1"
+
+func (c *magicCodec) Encode(wr io.Writer, h *UDPHeader) error {
+	var b bytes.Buffer
+	b.WriteString(codecMagic)
+
+	err := DefaultUDPCodec.Encode(&b, h)
+	if err != nil {
+		return err
+	}
+
+	_, err = wr.Write(b.Bytes())
+	return err
+}
+
+func (c *magicCodec) Decode(b []byte, h *UDPHeader) error {
+	if !bytes.HasPrefix(b, []byte(codecMagic)) {
+		return ErrProtocol.New("the magic bytes are missing")
+	}
+
+	return DefaultUDPCodec.Decode(b[len(codecMagic):], h)
+}
+
+func TestUDPCodecRoundTrip(t *testing.T) {
+	echo, sources := startUDPEcho(t)
+	_, addr := startServer(t, func(srv *Server) {
+		srv.UDPCodec = &magicCodec{}
+	})
+
+	c, err := NewClient(addr).UDP(testContext(t, 10*time.Second), "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Codec = &magicCodec{}
+
+	_, err = c.WriteTo([]byte("extended"), echo.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	readDatagram(t, c, "extended")
+	<-sources
+
+	// the server does not relay the datagrams of the standard framing
+	c.Codec = nil
+
+	_, err = c.WriteTo([]byte("standard"), echo.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-sources:
+		t.Fatal("the datagram of the standard framing is relayed")
+
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestDefaultUDPCodecWireCompatible(t *testing.T) {
+	header := &UDPHeader{Dst: ParseAddr("udp", "192.0.2.1:53"), Data: []byte("query")}
+
+	var encoded, written bytes.Buffer
+	err := DefaultUDPCodec.Encode(&encoded, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = header.Write(&written)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(encoded.Bytes(), written.Bytes()) {
+		t.Fatalf("encoded %x, UDPHeader.Write %x", encoded.Bytes(), written.Bytes())
+	}
+
+	decoded := &UDPHeader{}
+	err = DefaultUDPCodec.Decode(encoded.Bytes(), decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Dst.String() != header.Dst.String() || string(decoded.Data) != "query" {
+		t.Fatalf("decoded %v %q", decoded.Dst, decoded.Data)
+	}
+}
+
+func TestSetControlDeadline(t *testing.T) {
+	c, _ := udpPair(t)
+
+	err := c.SetControlDeadline(time.Now().Add(100 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !associationClosed(t, c, 5*time.Second) {
+		t.Fatal("the association is not closed after the control deadline")
+	}
+
+	_, _, err = c.ReadFrom(make([]byte, 64))
+	if !errorx.IsOfType(err, ErrAssociationClosed) {
+		t.Fatalf("the read after the control deadline: %v", err)
+	}
+}
+
+func TestSetControlDeadlineCleared(t *testing.T) {
+	c, _ := udpPair(t)
+
+	c.SetControlDeadline(time.Now().Add(100 * time.Millisecond))
+	c.SetControlDeadline(time.Time{})
+
+	if associationClosed(t, c, 300*time.Millisecond) {
+		t.Fatal("the association is closed after the control deadline is cleared")
+	}
+}
+
+func TestUDPConnWriteToTwoDestinations(t *testing.T) {
+	first, _ := startUDPEcho(t)
+	second, _ := startUDPEcho(t)
+	_, addr := startServer(t, nil)
+
+	c, err := NewClient(addr).UDP(testContext(t, 5*time.Second), "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = c.WriteTo([]byte("first"), first.LocalAddr())
+	if err == nil {
+		_, err = c.WriteTo([]byte("second"), second.LocalAddr())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]string{}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	b := make([]byte, 64)
+	for len(got) < 2 {
+		n, from, err := c.ReadFrom(b)
+		if err != nil {
+			t.Fatalf("received %v: %v", got, err)
+		}
+
+		got[string(b[:n])] = from.String()
+	}
+
+	if got["first"] != first.LocalAddr().String() || got["second"] != second.LocalAddr().String() {
+		t.Fatalf("received %v", got)
+	}
+
+	if c.Dst != nil {
+		t.Fatalf("WriteTo modified Dst: %v", c.Dst)
+	}
+}
+
+func TestUDPConnConcurrentWriteAndWriteTo(t *testing.T) {
+	fixed, fixedSources := startUDPEcho(t)
+	other, otherSources := startUDPEcho(t)
+	_, addr := startServer(t, nil)
+
+	c, err := NewClient(addr).UDP(testContext(t, 5*time.Second), "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Dst = ParseAddr("udp", fixed.LocalAddr().String())
+
+	done := make(chan error, 2)
+	go func() {
+		for i := 0; i < 50; i++ {
+			if _, err := c.Write([]byte("fixed")); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	go func() {
+		for i := 0; i < 50; i++ {
+			if _, err := c.WriteTo([]byte("other"), other.LocalAddr()); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if countDatagrams(fixedSources, 300*time.Millisecond) == 0 || countDatagrams(otherSources, 100*time.Millisecond) == 0 {
+		t.Fatal("the datagrams of Write or WriteTo are not relayed")
+	}
+}
+
+// Overwrite buf with zeros
+func zeroBytes(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
+
+func TestReadHeaderInto(t *testing.T) {
+	c, sender := udpPair(t)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	pool := NewBufferPool(maxUDPHeaderLength)
+
+	sendHeader(t, sender, c, []byte("first"))
+	sendHeader(t, sender, c, []byte("second"))
+
+	first, second := pool.Get(), pool.Get()
+
+	h1, err := c.ReadHeaderInto(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h2, err := c.ReadHeaderInto(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the headers read into different buffers are independent
+	if string(h1.Data) != "first" || string(h2.Data) != "second" {
+		t.Fatalf("read %q and %q", h1.Data, h2.Data)
+	}
+
+	if h1.Dst.String() != "127.0.0.1:53" {
+		t.Fatalf("the destination is %v", h1.Dst)
+	}
+
+	// the data aliases the buffer of the caller
+	zeroBytes(first)
+	if string(h1.Data) == "first" || string(h2.Data) != "second" {
+		t.Fatalf("the data of the headers does not alias the buffers: %q and %q", h1.Data, h2.Data)
+	}
+
+	pool.Put(first)
+	pool.Put(second)
+}
+
+func TestReadHeaderDetached(t *testing.T) {
+	c, sender := udpPair(t)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	sendHeader(t, sender, c, []byte("first"))
+	sendHeader(t, sender, c, []byte("second"))
+
+	h1, err := c.ReadHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.ReadHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zeroBytes(c.income)
+	if string(h1.Data) != "first" {
+		t.Fatalf("the data of ReadHeader is reused by the next read: %q", h1.Data)
+	}
+}
+
+func BenchmarkReadHeaderInto(b *testing.B) {
+	c, sender := udpPair(b)
+	buf := make([]byte, maxUDPHeaderLength)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sendHeader(b, sender, c, []byte("datagram"))
+
+		_, err := c.ReadHeaderInto(buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestReadAfterControlClose(t *testing.T) {
+	c, _ := udpPair(t)
+
+	c.Control().Close()
+	if !associationClosed(t, c, 5*time.Second) {
+		t.Fatal("the association is not closed with the control connection")
+	}
+
+	_, err := c.ReadHeader()
+	if !errorx.IsOfType(err, ErrAssociationClosed) {
+		t.Errorf("ReadHeader: %v", err)
+	}
+
+	_, err = c.ReadHeaders(4)
+	if !errorx.IsOfType(err, ErrAssociationClosed) {
+		t.Errorf("ReadHeaders: %v", err)
+	}
+
+	_, _, err = c.ReadFrom(make([]byte, 64))
+	if !errorx.IsOfType(err, ErrAssociationClosed) {
+		t.Errorf("ReadFrom: %v", err)
+	}
+}
+
+func TestReadTimeoutIsNotAssociationClosed(t *testing.T) {
+	c, _ := udpPair(t)
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	_, err := c.ReadHeader()
+	if err == nil || errorx.IsOfType(err, ErrAssociationClosed) {
+		t.Fatalf("the read timeout: %v", err)
+	}
+
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("the read timeout is not a timeout error: %v", err)
+	}
+}
+
+func TestUDPKeepAlive(t *testing.T) {
+	c, sender := udpPair(t)
+	c.Dst = ParseAddr("udp", "127.0.0.1:53")
+
+	err := c.EnableKeepAlive(20 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	b := make([]byte, 1500)
+	for i := 0; i < 3; i++ {
+		n, err := sender.Read(b)
+		if err != nil {
+			t.Fatalf("keepalive %v is not sent: %v", i, err)
+		}
+
+		header := &UDPHeader{}
+		err = header.Read(bytes.NewReader(b[:n]))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if header.Dst.String() != c.Dst.String() || len(header.Data) != 0 {
+			t.Fatalf("keepalive %v is sent to %v with %v bytes", i, header.Dst, len(header.Data))
+		}
+	}
+
+	c.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	// drop the datagrams sent before Close
+	for {
+		sender.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if _, err := sender.Read(b); err != nil {
+			break
+		}
+	}
+
+	sender.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := sender.Read(b); err == nil {
+		t.Error("the keepalive is sent after Close")
+	}
+}
+
+func TestUDPKeepAliveNilDst(t *testing.T) {
+	c, _ := udpPair(t)
+
+	err := c.EnableKeepAlive(time.Second)
+	if !errorx.IsOfType(err, ErrProtocol) {
+		t.Fatalf("EnableKeepAlive with nil Dst: %v", err)
+	}
+}
+
+func TestUDPKeepAliveInvalidInterval(t *testing.T) {
+	c, _ := udpPair(t)
+	c.Dst = ParseAddr("udp", "127.0.0.1:53")
+
+	for _, interval := range []time.Duration{0, -time.Second} {
+		err := c.EnableKeepAlive(interval)
+		if !errorx.IsOfType(err, ErrProtocol) {
+			t.Errorf("EnableKeepAlive(%v): %v", interval, err)
+		}
+	}
+}
+
+func TestUDPKeepAliveReplaced(t *testing.T) {
+	c, sender := udpPair(t)
+	c.Dst = ParseAddr("udp", "127.0.0.1:53")
+
+	err := c.EnableKeepAlive(10 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second call stops the first keepalive
+	err = c.EnableKeepAlive(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	// drop the datagrams sent before the replacement
+	b := make([]byte, 1500)
+	for {
+		sender.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if _, err := sender.Read(b); err != nil {
+			break
+		}
+	}
+
+	sender.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := sender.Read(b); err == nil {
+		t.Error("the replaced keepalive is still sent")
+	}
+}
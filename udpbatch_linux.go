@@ -0,0 +1,83 @@
+//go:build linux
+
+package socks5
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// batchReader reads several datagrams with one system call (recvmmsg)
+type batchReader interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// Read up to max queued datagrams with one recvmmsg call, the call blocks till the first datagram is received.
+// ok is false, if the data connection is not a UDP socket and the datagrams must be read one by one
+func (c *UDPConn) readBatch(max int) (headers []*UDPHeader, ok bool, err error) {
+	udp, isUDP := c.data.(*net.UDPConn)
+	if !isUDP {
+		return nil, false, nil
+	}
+
+	var rd batchReader = ipv4.NewPacketConn(udp)
+	if addr, isUDPAddr := udp.LocalAddr().(*net.UDPAddr); isUDPAddr && addr.IP.To4() == nil {
+		rd = ipv6.NewPacketConn(udp)
+	}
+
+	for len(c.batch) < max {
+		c.batch = append(c.batch, make([]byte, len(c.income)))
+	}
+
+	msgs := make([]ipv4.Message, max)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{c.batch[i]}
+	}
+
+	// malformed datagrams and datagrams from the rejected sources are skipped, the batches are read
+	// till a datagram is valid. The first decoding error is returned, if neither of the datagrams is valid
+	for len(headers) == 0 {
+		n, err := rd.ReadBatch(msgs, 0)
+		if err != nil {
+			if c.closed.Load() {
+				return nil, true, ErrAssociationClosed.Wrap(err, "the UDP association is closed")
+			}
+
+			return nil, true, err
+		}
+
+		var decodeErr error
+		for i, msg := range msgs[:n] {
+			if udp.RemoteAddr() == nil && !c.accepts(msg.Addr) {
+				continue
+			}
+
+			header := &UDPHeader{}
+
+			err = c.codec().Decode(c.batch[i][:msg.N], header)
+			if err != nil {
+				if decodeErr == nil {
+					decodeErr = err
+				}
+
+				continue
+			}
+
+			headers = append(headers, header.detach())
+
+			if udp.RemoteAddr() == nil {
+				c.peerMu.Lock()
+				c.peer = msg.Addr
+				c.peerMu.Unlock()
+			}
+		}
+
+		if len(headers) == 0 && decodeErr != nil {
+			return nil, true, decodeErr
+		}
+	}
+
+	return headers, true, nil
+}
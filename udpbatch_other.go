@@ -0,0 +1,8 @@
+//go:build !linux
+
+package socks5
+
+// Read the queued datagrams with one system call (not supported on this platform, the datagrams are read one by one)
+func (c *UDPConn) readBatch(max int) (headers []*UDPHeader, ok bool, err error) {
+	return nil, false, nil
+}
@@ -0,0 +1,164 @@
+package socks5
+
+import (
+	"net"
+	"sync"
+)
+
+// udpShare represents outgoing UDP sockets shared between the associations (Server.ShareUDPSockets).
+// Sockets are keyed by the destination address
+type udpShare struct {
+	mu      sync.Mutex
+	sockets map[string]*sharedSocket
+}
+
+func newUDPShare() *udpShare {
+	return &udpShare{
+		sockets: make(map[string]*sharedSocket),
+	}
+}
+
+// Return the socket for the destination, a new one is opened on the network, if there is no socket yet.
+// Every acquire must be paired with release
+func (s *udpShare) acquire(dst, network string, buffer int, broadcast bool) (*sharedSocket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	socket, ok := s.sockets[dst]
+	if ok {
+		socket.refs++
+		return socket, nil
+	}
+
+	pc, err := net.ListenPacket(network, randomAddress())
+	if err != nil {
+		return nil, err
+	}
+
+	conn := pc.(*net.UDPConn)
+
+	if broadcast {
+		err = setBroadcast(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	socket = &sharedSocket{conn: conn, refs: 1}
+	s.sockets[dst] = socket
+
+	go socket.deliver(buffer)
+
+	return socket, nil
+}
+
+// Release the socket acquired by the association for the destination.
+// The socket is closed, when the last association releases it
+func (s *udpShare) release(dst string, socket *sharedSocket, c *udpConn) {
+	socket.forget(c)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	socket.refs--
+	if socket.refs > 0 {
+		return
+	}
+
+	delete(s.sockets, dst)
+	socket.conn.Close()
+}
+
+// sharedSocket is a UDP socket that relays datagrams of several associations to the same destination.
+//
+// The responses cannot be matched to the datagrams, so they are delivered to every association
+// that sent a datagram to the remote address of the response. Datagrams from other addresses are dropped
+type sharedSocket struct {
+	conn *net.UDPConn
+	refs int // number of associations using the socket (guarded by udpShare.mu)
+
+	sendersMu sync.Mutex
+	senders   map[string]map[*udpConn]struct{} // associations keyed by the remote address they sent datagrams to
+}
+
+// Send the datagram of the association to addr
+func (s *sharedSocket) send(c *udpConn, b []byte, addr net.Addr) (int, error) {
+	key := udpAddrKey(addr)
+
+	s.sendersMu.Lock()
+	if s.senders == nil {
+		s.senders = make(map[string]map[*udpConn]struct{})
+	}
+
+	if s.senders[key] == nil {
+		s.senders[key] = make(map[*udpConn]struct{})
+	}
+	s.senders[key][c] = struct{}{}
+	s.sendersMu.Unlock()
+
+	return s.conn.WriteTo(b, addr)
+}
+
+// Remove the association from the senders, so it does not get the responses anymore
+func (s *sharedSocket) forget(c *udpConn) {
+	s.sendersMu.Lock()
+	defer s.sendersMu.Unlock()
+
+	for key, conns := range s.senders {
+		delete(conns, c)
+
+		if len(conns) == 0 {
+			delete(s.senders, key)
+		}
+	}
+}
+
+// Return the associations that sent datagrams to addr
+func (s *sharedSocket) sendersOf(addr net.Addr) []*udpConn {
+	s.sendersMu.Lock()
+	defer s.sendersMu.Unlock()
+
+	conns := s.senders[udpAddrKey(addr)]
+	if len(conns) == 0 {
+		return nil
+	}
+
+	senders := make([]*udpConn, 0, len(conns))
+	for c := range conns {
+		senders = append(senders, c)
+	}
+
+	return senders
+}
+
+// Read the responses till the socket is closed and pass them to the associations that sent datagrams to the remote address
+func (s *sharedSocket) deliver(buffer int) {
+	b := make([]byte, buffer)
+
+	for {
+		n, addr, err := s.conn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+
+		for _, c := range s.sendersOf(addr) {
+			c.deliver(b[:n], addr)
+		}
+	}
+}
+
+// Return the key of the UDP address, IPv4 and IPv4-mapped IPv6 addresses have the same key
+func udpAddrKey(addr net.Addr) string {
+	udp, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return addr.String()
+	}
+
+	ip := udp.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return (&net.UDPAddr{IP: ip, Port: udp.Port, Zone: udp.Zone}).String()
+}
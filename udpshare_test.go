@@ -0,0 +1,153 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Start the UDP server that echoes every datagram. The sources of the datagrams are sent to the returned channel
+func startUDPEcho(t *testing.T) (*net.UDPConn, chan net.Addr) {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	sources := make(chan net.Addr, 16)
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+
+			select {
+			case sources <- addr:
+			default:
+			}
+
+			pc.WriteTo(b[:n], addr)
+		}
+	}()
+
+	return pc.(*net.UDPConn), sources
+}
+
+// Read datagrams from c till msg is received
+func readDatagram(t *testing.T, c *UDPConn, msg string) {
+	t.Helper()
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer c.SetReadDeadline(time.Time{})
+
+	b := make([]byte, 1500)
+	for {
+		n, _, err := c.ReadFrom(b)
+		if err != nil {
+			t.Fatalf("the datagram %q is not received: %v", msg, err)
+		}
+
+		if string(b[:n]) == msg {
+			return
+		}
+	}
+}
+
+// Check, that no datagram with msg is received by c within d
+func noDatagram(t *testing.T, c *UDPConn, msg string, d time.Duration) {
+	t.Helper()
+
+	c.SetReadDeadline(time.Now().Add(d))
+	defer c.SetReadDeadline(time.Time{})
+
+	b := make([]byte, 1500)
+	for {
+		n, _, err := c.ReadFrom(b)
+		if err != nil {
+			return
+		}
+
+		if string(b[:n]) == msg {
+			t.Fatalf("the datagram %q is delivered", msg)
+		}
+	}
+}
+
+func TestShareUDPSocketsTwoClients(t *testing.T) {
+	echo, sources := startUDPEcho(t)
+
+	_, addr := startServer(t, func(srv *Server) {
+		srv.ShareUDPSockets = true
+	})
+
+	ctx := testContext(t, 10*time.Second)
+
+	a, err := NewClient(addr).UDP(ctx, "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	b, err := NewClient(addr).UDP(ctx, "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	a.WriteTo([]byte("from a"), echo.LocalAddr())
+	readDatagram(t, a, "from a")
+	srcA := <-sources
+
+	b.WriteTo([]byte("from b"), echo.LocalAddr())
+	readDatagram(t, b, "from b")
+	srcB := <-sources
+
+	if srcA.String() != srcB.String() {
+		t.Fatalf("the associations use different sockets (%v, %v)", srcA, srcB)
+	}
+
+	// a datagram from the address no association sent to is not delivered to anyone
+	stranger, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+
+	stranger.WriteTo([]byte("stranger"), srcA)
+
+	noDatagram(t, a, "stranger", 300*time.Millisecond)
+	noDatagram(t, b, "stranger", 300*time.Millisecond)
+}
+
+func TestShareUDPSocketsClosedClient(t *testing.T) {
+	echo, _ := startUDPEcho(t)
+
+	_, addr := startServer(t, func(srv *Server) {
+		srv.ShareUDPSockets = true
+	})
+
+	ctx := testContext(t, 10*time.Second)
+
+	a, err := NewClient(addr).UDP(ctx, "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewClient(addr).UDP(ctx, "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	a.WriteTo([]byte("from a"), echo.LocalAddr())
+	readDatagram(t, a, "from a")
+	a.Close()
+
+	// the socket stays open for b after a releases it
+	b.WriteTo([]byte("from b"), echo.LocalAddr())
+	readDatagram(t, b, "from b")
+}